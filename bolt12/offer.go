@@ -22,14 +22,18 @@ import (
 )
 
 type RegisterBolt12OfferRequest struct {
-	Time      int64  `json:"time"`
-	Username  string `json:"username"`
-	Offer     string `json:"offer"`
-	Signature string `json:"signature"`
+	Time                 int64   `json:"time"`
+	Username             string  `json:"username"`
+	Offer                string  `json:"offer"`
+	BitcoinAddress       *string `json:"bitcoin_address,omitempty"`
+	SilentPaymentAddress *string `json:"silent_payment_address,omitempty"`
+	LnurlFallback        bool    `json:"lnurl_fallback,omitempty"`
+	Signature            string  `json:"signature"`
 }
 
 type RegisterRecoverBolt12OfferResponse struct {
-	BIP353Address string `json:"bip353_address"`
+	BIP353Address string  `json:"bip353_address"`
+	DnsStatus     *string `json:"dns_status,omitempty"`
 }
 
 func (w *RegisterBolt12OfferRequest) Verify(pubkey string) error {
@@ -44,6 +48,20 @@ func (w *RegisterBolt12OfferRequest) Verify(pubkey string) error {
 	}
 
 	messageToVerify := fmt.Sprintf("%v-%v-%v", w.Time, w.Username, w.Offer)
+	if w.hasPaymentInstructions() {
+		// Validate the additional BIP-321 payment instructions if present
+		instructions := w.dnsPaymentInstructions()
+		if err := instructions.Validate(); err != nil {
+			return err
+		}
+		messageToVerify = fmt.Sprintf(
+			"%v-%v-%v-%v",
+			messageToVerify,
+			lnurl.ValueOrEmpty(w.BitcoinAddress),
+			lnurl.ValueOrEmpty(w.SilentPaymentAddress),
+			w.LnurlFallback,
+		)
+	}
 	verifiedPubkey, err := lightning.VerifyMessage([]byte(messageToVerify), w.Signature)
 	if err != nil {
 		return err
@@ -54,6 +72,27 @@ func (w *RegisterBolt12OfferRequest) Verify(pubkey string) error {
 	return nil
 }
 
+func (w *RegisterBolt12OfferRequest) hasPaymentInstructions() bool {
+	return w.BitcoinAddress != nil || w.SilentPaymentAddress != nil || w.LnurlFallback
+}
+
+func (w *RegisterBolt12OfferRequest) paymentInstructions() lnurl.PaymentInstructions {
+	return lnurl.PaymentInstructions{
+		BitcoinAddress:       w.BitcoinAddress,
+		SilentPaymentAddress: w.SilentPaymentAddress,
+		LnurlFallback:        w.LnurlFallback,
+	}
+}
+
+func (w *RegisterBolt12OfferRequest) dnsPaymentInstructions() dns.PaymentInstructions {
+	return dns.PaymentInstructions{
+		Offer:                w.Offer,
+		BitcoinAddress:       w.BitcoinAddress,
+		SilentPaymentAddress: w.SilentPaymentAddress,
+		LnurlFallback:        w.LnurlFallback,
+	}
+}
+
 type UnregisterRecoverBolt12OfferRequest struct {
 	Time      int64  `json:"time"`
 	Offer     string `json:"offer"`
@@ -77,11 +116,11 @@ func (w *UnregisterRecoverBolt12OfferRequest) Verify(pubkey string) error {
 
 type Bolt12OfferRouter struct {
 	store   *persist.Store
-	dns     dns.DnsService
+	dns     *dns.Queue
 	rootURL *url.URL
 }
 
-func RegisterBolt12OfferRouter(router *mux.Router, rootURL *url.URL, store *persist.Store, dns dns.DnsService) {
+func RegisterBolt12OfferRouter(router *mux.Router, rootURL *url.URL, store *persist.Store, dns *dns.Queue) {
 	Bolt12OfferRouter := &Bolt12OfferRouter{
 		store:   store,
 		dns:     dns,
@@ -122,8 +161,13 @@ func (s *Bolt12OfferRouter) Recover(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	bip353Address := fmt.Sprintf("%v@%v", lastPkUsername.Username, s.rootURL.Host)
+	dnsStatus, err := s.dns.Status(r.Context(), lastPkUsername.Username)
+	if err != nil {
+		log.Printf("failed to get DNS status for %v: %v", lastPkUsername.Username, err)
+	}
 	body, err := json.Marshal(RegisterRecoverBolt12OfferResponse{
 		BIP353Address: bip353Address,
+		DnsStatus:     dnsStatus,
 	})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -183,38 +227,41 @@ func (s *Bolt12OfferRouter) Register(w http.ResponseWriter, r *http.Request) {
 		shouldSetOffer := lastPkUsername == nil || lastPkUsername.Offer == nil
 		username := updatedPkUsername.Username
 		offer := *updatedPkUsername.Offer
+		instructions := addRequest.paymentInstructions()
 
 		if lastPkUsername != nil && lastPkUsername.Offer != nil {
-			// If the last webhook exists, we need to check if the username or offer has changed
+			// If the last webhook exists, we need to check if the username, offer or payment instructions have changed
 			lastUsername := lastPkUsername.Username
 			lastOffer := *lastPkUsername.Offer
-			shouldSetOffer = username != lastUsername || offer != lastOffer
+			shouldSetOffer = username != lastUsername || offer != lastOffer || !instructions.Equal(lastPkUsername.PaymentInstructions)
 
 			if username != lastUsername {
-				if err = s.dns.Remove(lastUsername); err != nil {
-					log.Printf("failed to remove DNS TXT record for %v: %v", lastUsername, err)
+				if err = s.dns.Remove(r.Context(), pubkey, lastUsername); err != nil {
+					log.Printf("failed to queue DNS TXT record removal for %v: %v", lastUsername, err)
 				}
 			}
 		}
 
 		if shouldSetOffer {
-			ttl, err := s.dns.Set(username, offer)
-			if err != nil {
-				log.Printf("failed to set DNS TXT record for %v, %v: %v", username, offer, err)
+			if err = s.store.LnUrl.SetPaymentInstructions(r.Context(), pubkey, instructions); err != nil {
+				log.Printf("failed to set payment instructions for %v: %v", username, err)
 			}
-			// Only set the offer if the DNS service returns a TTL
-			maybeOffer := &offer
-			if ttl == 0 {
-				maybeOffer = nil
+			// The DNS TXT record is published in the background
+			if err = s.dns.Set(r.Context(), pubkey, username, addRequest.dnsPaymentInstructions()); err != nil {
+				log.Printf("failed to queue DNS TXT record for %v, %v: %v", username, offer, err)
 			}
-			s.store.LnUrl.SetPubkeyDetails(r.Context(), pubkey, username, maybeOffer)
 		}
 	}
 
 	log.Printf("registration added: pubkey:%v\n", pubkey)
 	bip353Address := fmt.Sprintf("%v@%v", updatedPkUsername.Username, s.rootURL.Host)
+	dnsStatus, err := s.dns.Status(r.Context(), updatedPkUsername.Username)
+	if err != nil {
+		log.Printf("failed to get DNS status for %v: %v", updatedPkUsername.Username, err)
+	}
 	body, err := json.Marshal(RegisterRecoverBolt12OfferResponse{
 		BIP353Address: bip353Address,
+		DnsStatus:     dnsStatus,
 	})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -258,8 +305,8 @@ func (s *Bolt12OfferRouter) Unregister(w http.ResponseWriter, r *http.Request) {
 	// Remove the DNS TXT record for this username/offer
 	if pkUsername.Offer != nil {
 		username := pkUsername.Username
-		if err = s.dns.Remove(username); err != nil {
-			log.Printf("failed to remove DNS TXT record for %v: %v", username, err)
+		if err = s.dns.Remove(r.Context(), pubkey, username); err != nil {
+			log.Printf("failed to queue DNS TXT record removal for %v: %v", username, err)
 		}
 		s.store.LnUrl.SetPubkeyDetails(r.Context(), pubkey, username, nil)
 	}
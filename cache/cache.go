@@ -1,27 +1,120 @@
 package cache
 
 import (
+	"context"
+	"expvar"
+	"sync"
 	"time"
 
 	"github.com/jellydator/ttlcache/v3"
 )
 
+// The interval to remove the expired entries from the in-process caches.
+var CleanupInterval time.Duration = time.Minute
+
+// The duration an owner invalidation is kept, longer than any request in flight.
+var InvalidationRetention time.Duration = 10 * time.Minute
+
+var (
+	cacheMetrics = expvar.NewMap("cache")
+	// The running in-process caches, summed up in the size metric.
+	caches sync.Map
+)
+
+func init() {
+	cacheMetrics.Set("size", expvar.Func(func() any {
+		size := 0
+		caches.Range(func(c, _ any) bool {
+			size += c.(*Cache).cache.Len()
+			return true
+		})
+		return size
+	}))
+}
+
 type CacheService interface {
 	Delete(key string)
 	Get(key string) []byte
 	Set(key string, data []byte, ttl time.Duration)
+	// SetOwned sets the entry of a key, indexed by the owner of the entry. The
+	// entry is not set if the entries of the owner were deleted since requestedAt.
+	SetOwned(key string, owner string, data []byte, ttl time.Duration, requestedAt time.Time)
+	// DeleteOwned removes all the entries of the owner, and rejects the entries requested before.
+	DeleteOwned(owner string)
+}
+
+type entry struct {
+	owner string
+	data  []byte
 }
 
 type Cache struct {
-	cache *ttlcache.Cache[string, []byte]
+	cache *ttlcache.Cache[string, entry]
+	// The time the entries of each owner were last deleted
+	mu            sync.Mutex
+	invalidations map[string]time.Time
+	stop          chan struct{}
+	stopOnce      sync.Once
 }
 
 func NewCache(ttl time.Duration) *Cache {
-	return &Cache{
-		cache: ttlcache.New(ttlcache.WithTTL[string, []byte](ttl), ttlcache.WithDisableTouchOnHit[string, []byte]()),
+	return NewCacheWithCapacity(ttl, 0)
+}
+
+/*
+NewCacheWithCapacity creates an in-process cache holding at most capacity
+entries, the least recently used evicted first. A zero capacity is
+unlimited. The expired entries are removed in the background until the
+cache is stopped.
+*/
+func NewCacheWithCapacity(ttl time.Duration, capacity uint64) *Cache {
+	options := []ttlcache.Option[string, entry]{
+		ttlcache.WithTTL[string, entry](ttl),
+		ttlcache.WithDisableTouchOnHit[string, entry](),
+	}
+	if capacity > 0 {
+		options = append(options, ttlcache.WithCapacity[string, entry](capacity))
+	}
+	c := &Cache{
+		cache:         ttlcache.New(options...),
+		invalidations: make(map[string]time.Time),
+		stop:          make(chan struct{}),
+	}
+	c.cache.OnEviction(func(_ context.Context, reason ttlcache.EvictionReason, _ *ttlcache.Item[string, entry]) {
+		switch reason {
+		case ttlcache.EvictionReasonCapacityReached:
+			cacheMetrics.Add("evictions_capacity", 1)
+		case ttlcache.EvictionReasonExpired:
+			cacheMetrics.Add("evictions_expired", 1)
+		}
+	})
+	caches.Store(c, true)
+	go c.cleanup()
+	return c
+}
+
+func (c *Cache) cleanup() {
+	ticker := time.NewTicker(CleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.cache.DeleteExpired()
+			c.pruneInvalidations(time.Now().Add(-InvalidationRetention))
+		case <-c.stop:
+			return
+		}
 	}
 }
 
+// Stop ends the background removal of the expired entries and the reporting of the cache size.
+func (c *Cache) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		caches.Delete(c)
+	})
+}
+
 func (c *Cache) Delete(key string) {
 	c.cache.Delete(key)
 }
@@ -29,11 +122,45 @@ func (c *Cache) Delete(key string) {
 func (c *Cache) Get(key string) []byte {
 	item := c.cache.Get(key)
 	if item == nil || item.IsExpired() {
+		cacheMetrics.Add("misses", 1)
 		return nil
 	}
-	return item.Value()
+	cacheMetrics.Add("hits", 1)
+	return item.Value().data
 }
 
 func (c *Cache) Set(key string, data []byte, ttl time.Duration) {
-	c.cache.Set(key, data, ttl)
+	c.cache.Set(key, entry{data: data}, ttl)
+}
+
+func (c *Cache) SetOwned(key string, owner string, data []byte, ttl time.Duration, requestedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if invalidatedAt, ok := c.invalidations[owner]; ok && !invalidatedAt.Before(requestedAt) {
+		return
+	}
+	c.cache.Set(key, entry{owner: owner, data: data}, ttl)
+}
+
+// DeleteOwned scans the entries, the cache being bounded by its capacity.
+func (c *Cache) DeleteOwned(owner string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations[owner] = time.Now()
+	for key, item := range c.cache.Items() {
+		if item.Value().owner == owner {
+			c.cache.Delete(key)
+		}
+	}
+}
+
+// pruneInvalidations forgets the invalidations older than the requests in flight.
+func (c *Cache) pruneInvalidations(before time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for owner, invalidatedAt := range c.invalidations {
+		if invalidatedAt.Before(before) {
+			delete(c.invalidations, owner)
+		}
+	}
 }
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"gotest.tools/assert"
+)
+
+// testCacheService checks the entries are returned until they expire or are deleted.
+func testCacheService(t *testing.T, cache CacheService) {
+	key := fmt.Sprintf("/lnurlp/test-%d", time.Now().UnixNano())
+	assert.Check(t, cache.Get(key) == nil, "missing entry should be nil")
+
+	cache.Set(key, []byte("data"), time.Minute)
+	assert.Equal(t, string(cache.Get(key)), "data")
+	cache.Set(key, []byte("updated"), time.Minute)
+	assert.Equal(t, string(cache.Get(key)), "updated")
+	cache.Delete(key)
+	assert.Check(t, cache.Get(key) == nil, "deleted entry should be nil")
+
+	owner := key + "-owner"
+	cache.SetOwned(key, owner, []byte("data"), time.Minute, time.Now())
+	cache.SetOwned(key+"/alias", owner, []byte("data"), time.Minute, time.Now())
+	cache.SetOwned(key+"/other", owner+"-other", []byte("other"), time.Minute, time.Now())
+	cache.DeleteOwned(owner)
+	assert.Check(t, cache.Get(key) == nil, "owned entry should be deleted")
+	assert.Check(t, cache.Get(key+"/alias") == nil, "owned alias entry should be deleted")
+	assert.Equal(t, string(cache.Get(key+"/other")), "other", "entry of another owner should be kept")
+
+	// An entry requested before the deletion is rejected
+	cache.SetOwned(key, owner, []byte("stale"), time.Minute, time.Now().Add(-time.Second))
+	assert.Check(t, cache.Get(key) == nil, "entry requested before the deletion should be rejected")
+	cache.SetOwned(key, owner, []byte("data"), time.Minute, time.Now())
+	assert.Equal(t, string(cache.Get(key)), "data")
+
+	cache.Set(key, []byte("data"), time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Check(t, cache.Get(key) == nil, "expired entry should be nil")
+}
+
+func TestMemoryCache(t *testing.T) {
+	cache := NewCache(time.Minute)
+	defer cache.Stop()
+	testCacheService(t, cache)
+}
+
+func TestMemoryCacheInvalidations(t *testing.T) {
+	cache := NewCache(time.Minute)
+	defer cache.Stop()
+	cache.DeleteOwned("owner")
+	cache.pruneInvalidations(time.Now().Add(-time.Minute))
+	assert.Equal(t, len(cache.invalidations), 1)
+	cache.pruneInvalidations(time.Now())
+	assert.Equal(t, len(cache.invalidations), 0)
+}
+
+func TestMemoryCacheCapacity(t *testing.T) {
+	cache := NewCacheWithCapacity(time.Minute, 2)
+	defer cache.Stop()
+	cache.Set("a", []byte("a"), time.Minute)
+	cache.Set("b", []byte("b"), time.Minute)
+	cache.Set("c", []byte("c"), time.Minute)
+	assert.Check(t, cache.Get("a") == nil, "oldest entry should be evicted")
+	assert.Equal(t, string(cache.Get("b")), "b")
+	assert.Equal(t, string(cache.Get("c")), "c")
+}
+
+func TestMemoryCacheSize(t *testing.T) {
+	size := func() int {
+		return cacheMetrics.Get("size").(expvar.Func).Value().(int)
+	}
+	initial := size()
+
+	first := NewCache(time.Minute)
+	defer first.Stop()
+	first.Set("a", []byte("a"), time.Minute)
+	second := NewCache(time.Minute)
+	second.Set("a", []byte("a"), time.Minute)
+	second.Set("b", []byte("b"), time.Minute)
+	assert.Equal(t, size(), initial+3, "size should sum up the caches")
+
+	second.Stop()
+	second.Stop()
+	assert.Equal(t, size(), initial+1, "stopped cache should not be counted")
+}
+
+func TestPgCache(t *testing.T) {
+	pool, err := pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
+	assert.NilError(t, err, "failed to connect to database")
+	defer pool.Close()
+	testCacheService(t, NewPgCache(pool))
+}
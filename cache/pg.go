@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The timeout of a cache query, the request goes on without the cache past it.
+var PgCacheTimeout time.Duration = time.Second
+
+// The interval to remove the expired entries.
+var PgCacheCleanupInterval time.Duration = 10 * time.Minute
+
+/*
+PgCache is a cache shared by the instances, stored in an unlogged table. The
+cache is best effort: errors are logged and handled as misses. The owner
+invalidations are shared too, so a response requested on any instance before
+an invalidation is not written back.
+*/
+type PgCache struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgCache(pool *pgxpool.Pool) *PgCache {
+	return &PgCache{
+		pool,
+	}
+}
+
+func (c *PgCache) Delete(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), PgCacheTimeout)
+	defer cancel()
+	_, err := c.pool.Exec(ctx, `DELETE FROM public.lnurl_cache WHERE key = $1`, key)
+	if err != nil {
+		cacheMetrics.Add("errors", 1)
+		log.Printf("failed to delete cache entry %s: %v", key, err)
+	}
+}
+
+func (c *PgCache) DeleteOwned(owner string) {
+	ctx, cancel := context.WithTimeout(context.Background(), PgCacheTimeout)
+	defer cancel()
+	err := pgx.BeginFunc(ctx, c.pool, func(tx pgx.Tx) error {
+		if err := lockOwner(ctx, tx, owner); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			ctx,
+			`INSERT INTO public.lnurl_cache_invalidations (owner, invalidated_at)
+			 VALUES ($1, $2)
+			 ON CONFLICT (owner) DO UPDATE
+			 SET invalidated_at = GREATEST(lnurl_cache_invalidations.invalidated_at, EXCLUDED.invalidated_at)`,
+			owner,
+			time.Now().UnixMicro(),
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM public.lnurl_cache WHERE owner = $1`, owner)
+		return err
+	})
+	if err != nil {
+		cacheMetrics.Add("errors", 1)
+		log.Printf("failed to delete cache entries of %s: %v", owner, err)
+	}
+}
+
+func (c *PgCache) Get(key string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), PgCacheTimeout)
+	defer cancel()
+	var data []byte
+	err := c.pool.QueryRow(
+		ctx,
+		`SELECT data FROM public.lnurl_cache
+		 WHERE key = $1 AND expires_at > NOW()`,
+		key,
+	).Scan(&data)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			cacheMetrics.Add("errors", 1)
+			log.Printf("failed to get cache entry %s: %v", key, err)
+		}
+		cacheMetrics.Add("misses", 1)
+		return nil
+	}
+	cacheMetrics.Add("hits", 1)
+	return data
+}
+
+func (c *PgCache) Set(key string, data []byte, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), PgCacheTimeout)
+	defer cancel()
+	_, err := c.pool.Exec(
+		ctx,
+		`INSERT INTO public.lnurl_cache (key, owner, data, expires_at)
+		 VALUES ($1, NULL, $2, NOW() + make_interval(secs => $3))
+		 ON CONFLICT (key) DO UPDATE
+		 SET owner = EXCLUDED.owner, data = EXCLUDED.data, expires_at = EXCLUDED.expires_at`,
+		key,
+		data,
+		ttl.Seconds(),
+	)
+	if err != nil {
+		cacheMetrics.Add("errors", 1)
+		log.Printf("failed to set cache entry %s: %v", key, err)
+	}
+}
+
+// SetOwned holds the owner lock, so the entry is either rejected or removed by a concurrent invalidation.
+func (c *PgCache) SetOwned(key string, owner string, data []byte, ttl time.Duration, requestedAt time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), PgCacheTimeout)
+	defer cancel()
+	err := pgx.BeginFunc(ctx, c.pool, func(tx pgx.Tx) error {
+		if err := lockOwner(ctx, tx, owner); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			ctx,
+			`INSERT INTO public.lnurl_cache (key, owner, data, expires_at)
+			 SELECT $1, $2, $3, NOW() + make_interval(secs => $4)
+			 WHERE NOT EXISTS (
+			   SELECT 1 FROM public.lnurl_cache_invalidations
+			   WHERE owner = $2 AND invalidated_at >= $5)
+			 ON CONFLICT (key) DO UPDATE
+			 SET owner = EXCLUDED.owner, data = EXCLUDED.data, expires_at = EXCLUDED.expires_at`,
+			key,
+			owner,
+			data,
+			ttl.Seconds(),
+			requestedAt.UnixMicro(),
+		)
+		return err
+	})
+	if err != nil {
+		cacheMetrics.Add("errors", 1)
+		log.Printf("failed to set cache entry %s: %v", key, err)
+	}
+}
+
+// lockOwner serializes the writes and the invalidations of the entries of the owner until the transaction ends.
+func lockOwner(ctx context.Context, tx pgx.Tx, owner string) error {
+	_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('lnurl_cache:' || $1))`, owner)
+	return err
+}
+
+// Periodically removes the expired entries and invalidations until the context is done.
+func (c *PgCache) Start(ctx context.Context) {
+	for {
+		res, err := c.pool.Exec(ctx, `DELETE FROM public.lnurl_cache WHERE expires_at <= NOW()`)
+		if err != nil {
+			log.Printf("failed to remove expired cache entries: %v", err)
+		} else {
+			cacheMetrics.Add("evictions_expired", res.RowsAffected())
+		}
+		_, err = c.pool.Exec(
+			ctx,
+			`DELETE FROM public.lnurl_cache_invalidations WHERE invalidated_at < $1`,
+			time.Now().Add(-InvalidationRetention).UnixMicro(),
+		)
+		if err != nil {
+			log.Printf("failed to remove expired cache invalidations: %v", err)
+		}
+		select {
+		case <-time.After(PgCacheCleanupInterval):
+			continue
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrWebhookURL      = errors.New("invalid webhook url")
+	ErrWebhookScheme   = errors.New("webhook url scheme not allowed")
+	ErrWebhookAddress  = errors.New("webhook host resolves to a denied address")
+	ErrWebhookRedirect = errors.New("too many webhook redirects")
+)
+
+// Ranges not covered by the net.IP helpers: "this network" and the carrier-grade NAT.
+var deniedNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// IsPrivateIP returns whether the address is not reachable on the internet: private, loopback, link-local...
+func IsPrivateIP(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range deniedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+EgressPolicy restricts the webhook urls the server sends requests to. The
+hosts resolving to private addresses are denied, unless allow-listed (such
+as the notify service running in the network). The addresses are checked
+when connecting, so a host resolving to another address after validation is
+still denied.
+*/
+type EgressPolicy struct {
+	httpsOnly  bool
+	allowHosts []string
+	resolver   *net.Resolver
+}
+
+func NewEgressPolicy(httpsOnly bool, allowHosts []string) *EgressPolicy {
+	var hosts []string
+	for _, host := range allowHosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return &EgressPolicy{
+		httpsOnly:  httpsOnly,
+		allowHosts: hosts,
+		resolver:   net.DefaultResolver,
+	}
+}
+
+// allowed returns whether the host is allow-listed, exempting it from the address checks.
+func (p *EgressPolicy) allowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range p.allowHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *EgressPolicy) checkScheme(u *url.URL) error {
+	switch {
+	case u.Scheme == "https":
+		return nil
+	case u.Scheme == "http" && !p.httpsOnly:
+		return nil
+	default:
+		return ErrWebhookScheme
+	}
+}
+
+/*
+ValidateURL checks the webhook url when registered: the scheme, and the
+addresses the host resolves to. A nil policy allows any url.
+*/
+func (p *EgressPolicy) ValidateURL(ctx context.Context, rawURL string) error {
+	if p == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" || u.User != nil {
+		return ErrWebhookURL
+	}
+	if err := p.checkScheme(u); err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if p.allowed(host) {
+		return nil
+	}
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrWebhookURL, err)
+	}
+	for _, addr := range addrs {
+		if IsPrivateIP(addr.IP) {
+			return ErrWebhookAddress
+		}
+	}
+	return nil
+}
+
+// dialContext returns the dial function enforcing the policy on the resolved addresses.
+func (p *EgressPolicy) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if p == nil {
+		return dialer.DialContext
+	}
+	guardedDialer := *dialer
+	// Called with the resolved address, right before connecting
+	guardedDialer.Control = func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || IsPrivateIP(ip) {
+			return ErrWebhookAddress
+		}
+		return nil
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if p.allowed(host) {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return guardedDialer.DialContext(ctx, network, address)
+	}
+}
+
+// checkRedirect enforces the policy on the redirects.
+func (p *EgressPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return ErrWebhookRedirect
+	}
+	if p == nil {
+		return nil
+	}
+	return p.checkScheme(req.URL)
+}
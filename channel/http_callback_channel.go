@@ -32,7 +32,10 @@ type CallbackResponse struct {
 }
 
 type WebhookChannel interface {
-	SendRequest(context context.Context, url string, message WebhookMessage, rw http.ResponseWriter) (*CallbackResponse, error)
+	// SendRequest sends the request to the app of the pubkey, registered with the webhook url.
+	SendRequest(context context.Context, pubkey string, url string, message WebhookMessage, rw http.ResponseWriter) (*CallbackResponse, error)
+	// ValidateURL checks the url can be sent requests to, when registered.
+	ValidateURL(context context.Context, url string) error
 }
 
 type PendingRequest struct {
@@ -42,16 +45,19 @@ type PendingRequest struct {
 
 type HttpCallbackChannel struct {
 	sync.Mutex
-	httpClient      *http.Client
+	client          *WebhookClient
 	callbackBaseURL string
 	random          *rand.Rand
 	pendingRequests map[uint64]*PendingRequest
 }
 
-func NewHttpCallbackChannel(router *mux.Router, callbackBaseURL string) *HttpCallbackChannel {
+func NewHttpCallbackChannel(router *mux.Router, callbackBaseURL string, client *WebhookClient) *HttpCallbackChannel {
+	if client == nil {
+		client = NewDefaultWebhookClient()
+	}
 
 	channel := &HttpCallbackChannel{
-		httpClient:      http.DefaultClient,
+		client:          client,
 		callbackBaseURL: callbackBaseURL,
 		random:          rand.New(rand.NewSource(time.Now().UnixNano())),
 		pendingRequests: make(map[uint64]*PendingRequest),
@@ -63,21 +69,39 @@ func NewHttpCallbackChannel(router *mux.Router, callbackBaseURL string) *HttpCal
 	return channel
 }
 
-func (p *HttpCallbackChannel) SendRequest(c context.Context, url string, message WebhookMessage, rw http.ResponseWriter) (*CallbackResponse, error) {
+func (p *HttpCallbackChannel) SendRequest(c context.Context, pubkey string, url string, message WebhookMessage, rw http.ResponseWriter) (*CallbackResponse, error) {
+	return p.awaitResponse(c, message, func(message WebhookMessage) error {
+		jsonBytes, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		log.Printf("Sending webhook callback message %v", string(jsonBytes))
+		httpRes, err := p.client.Post(c, url, jsonBytes)
+		if err != nil {
+			return err
+		}
+		if httpRes.StatusCode != 200 {
+			return errors.New("webhook proxy returned non-200 status code")
+		}
+		return nil
+	})
+}
+
+/*
+awaitResponse sets the reply url of a new pending request in the message,
+delivers the message to the app and waits for the app to post the response
+to the reply url.
+*/
+func (p *HttpCallbackChannel) awaitResponse(c context.Context, message WebhookMessage, deliver func(message WebhookMessage) error) (*CallbackResponse, error) {
+	p.Lock()
 	reqID := p.random.Uint64()
-	callbackURL := fmt.Sprintf("%s/%d", p.callbackBaseURL, reqID)
-	message.Data["reply_url"] = callbackURL
-	jsonBytes, err := json.Marshal(message)
-	if err != nil {
-		return nil, err
-	}
 	pendingRequest := &PendingRequest{
 		id:       reqID,
 		response: make(chan CallbackResponse, 1),
 	}
-	p.Lock()
 	p.pendingRequests[reqID] = pendingRequest
 	p.Unlock()
+	message.Data["reply_url"] = fmt.Sprintf("%s/%d", p.callbackBaseURL, reqID)
 
 	// We only delete the request from the map and close the channel only if it was not deleted before.
 	defer func() {
@@ -89,20 +113,9 @@ func (p *HttpCallbackChannel) SendRequest(c context.Context, url string, message
 		p.Unlock()
 	}()
 
-	req, err := http.NewRequestWithContext(c, "POST", url, strings.NewReader(string(jsonBytes)))
-	if err != nil {
+	if err := deliver(message); err != nil {
 		return nil, err
 	}
-	req.Header.Add("Content-Type", "application/json")
-
-	log.Printf("Sending webhook callback message %v", string(jsonBytes))
-	httpRes, err := p.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if httpRes.StatusCode != 200 {
-		return nil, errors.New("webhook proxy returned non-200 status code")
-	}
 	select {
 	case response := <-pendingRequest.response:
 		return &response, nil
@@ -113,6 +126,10 @@ func (p *HttpCallbackChannel) SendRequest(c context.Context, url string, message
 	}
 }
 
+func (p *HttpCallbackChannel) ValidateURL(c context.Context, url string) error {
+	return p.client.ValidateURL(c, url)
+}
+
 func (p *HttpCallbackChannel) OnResponse(reqID uint64, response CallbackResponse) error {
 	p.Lock()
 	defer p.Unlock()
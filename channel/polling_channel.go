@@ -0,0 +1,257 @@
+package channel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The webhook url registered by the apps fetching their requests instead of receiving them.
+const PullWebhookURL = "pull:"
+
+// The duration a fetch waits for a request before returning none.
+var LongPollTimeout time.Duration = 25 * time.Second
+
+// The duration after a fetch the app is still polling this instance, reconnecting for its next fetch.
+var PollIdleTimeout time.Duration = 10 * time.Second
+
+// The maximum requests queued for an app, the next ones fail until fetched.
+const maxQueuedMessages = 100
+
+var errQueueFull = errors.New("too many pending requests")
+var errNotPolling = errors.New("app not polling this instance")
+
+// QueuedRequest is a pending request of an app, with the id to fetch the next ones after it.
+type QueuedRequest struct {
+	Id       uint64                 `json:"id"`
+	Template string                 `json:"template"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+/*
+PollingChannel queues the requests of the apps that cannot receive webhooks,
+registered with the pull webhook url. The app long-polls its pending
+requests and posts the responses to their reply url, as with the webhook.
+The requests stay queued until answered or abandoned, so a request fetched
+by a dropped poll is fetched again. The queues are kept in the instance, the
+requests to an app not polling this instance fail right away. The requests
+to the other apps go through the fallback channel.
+*/
+type PollingChannel struct {
+	mu      sync.Mutex
+	lastId  uint64
+	queues  map[string][]QueuedRequest
+	waiters map[string]chan struct{}
+	// The fetches in flight and the last time each app polled this instance
+	polls     map[string]int
+	polledAt  map[string]time.Time
+	prunedAt  time.Time
+	callbacks *HttpCallbackChannel
+	fallback  WebhookChannel
+}
+
+func NewPollingChannel(router *mux.Router, callbacks *HttpCallbackChannel, fallback WebhookChannel) *PollingChannel {
+	channel := &PollingChannel{
+		queues:    make(map[string][]QueuedRequest),
+		waiters:   make(map[string]chan struct{}),
+		polls:     make(map[string]int),
+		polledAt:  make(map[string]time.Time),
+		callbacks: callbacks,
+		fallback:  fallback,
+	}
+
+	// The app fetches with the time and the signature of "<time>-pending" as query parameters
+	router.HandleFunc("/pending/{pubkey}", channel.HandlePending).Methods("GET")
+
+	return channel
+}
+
+func isPullURL(url string) bool {
+	return strings.HasPrefix(url, PullWebhookURL)
+}
+
+func (c *PollingChannel) SendRequest(ctx context.Context, pubkey string, url string, message WebhookMessage, rw http.ResponseWriter) (*CallbackResponse, error) {
+	if !isPullURL(url) {
+		return c.fallback.SendRequest(ctx, pubkey, url, message, rw)
+	}
+
+	var queuedId uint64
+	defer func() {
+		if queuedId != 0 {
+			c.dequeue(pubkey, queuedId)
+		}
+	}()
+	return c.callbacks.awaitResponse(ctx, message, func(message WebhookMessage) error {
+		id, err := c.enqueue(pubkey, message)
+		queuedId = id
+		return err
+	})
+}
+
+func (c *PollingChannel) ValidateURL(ctx context.Context, url string) error {
+	if isPullURL(url) {
+		return nil
+	}
+	return c.fallback.ValidateURL(ctx, url)
+}
+
+// enqueue queues the message and wakes the pending fetch of the app, if polling this instance.
+func (c *PollingChannel) enqueue(pubkey string, message WebhookMessage) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.polls[pubkey] == 0 && time.Since(c.polledAt[pubkey]) > PollIdleTimeout {
+		return 0, errNotPolling
+	}
+	if len(c.queues[pubkey]) >= maxQueuedMessages {
+		return 0, errQueueFull
+	}
+	c.lastId++
+	c.queues[pubkey] = append(c.queues[pubkey], QueuedRequest{
+		Id:       c.lastId,
+		Template: message.Template,
+		Data:     message.Data,
+	})
+	if waiter, ok := c.waiters[pubkey]; ok {
+		close(waiter)
+		delete(c.waiters, pubkey)
+	}
+	return c.lastId, nil
+}
+
+// dequeue removes the message once answered or abandoned.
+func (c *PollingChannel) dequeue(pubkey string, id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	queue := slices.DeleteFunc(c.queues[pubkey], func(queued QueuedRequest) bool {
+		return queued.Id == id
+	})
+	if len(queue) == 0 {
+		delete(c.queues, pubkey)
+	} else {
+		c.queues[pubkey] = queue
+	}
+}
+
+/*
+fetch returns the queued messages of the app after the given id, kept in the
+queue until answered. If none, it returns the channel closed once a message
+is queued.
+*/
+func (c *PollingChannel) fetch(pubkey string, after uint64) ([]QueuedRequest, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var messages []QueuedRequest
+	for _, queued := range c.queues[pubkey] {
+		if queued.Id > after {
+			messages = append(messages, queued)
+		}
+	}
+	if len(messages) == 0 {
+		waiter, ok := c.waiters[pubkey]
+		if !ok {
+			waiter = make(chan struct{})
+			c.waiters[pubkey] = waiter
+		}
+		return nil, waiter
+	}
+	return messages, nil
+}
+
+// startPoll records the app polling this instance, forgetting the apps that stopped polling.
+func (c *PollingChannel) startPoll(pubkey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.polls[pubkey]++
+	c.polledAt[pubkey] = now
+	if now.Sub(c.prunedAt) < PollIdleTimeout {
+		return
+	}
+	c.prunedAt = now
+	for polled, polledAt := range c.polledAt {
+		if c.polls[polled] == 0 && now.Sub(polledAt) > PollIdleTimeout {
+			delete(c.polledAt, polled)
+		}
+	}
+}
+
+// endPoll removes the waiter of the app once none of its fetches is in flight.
+func (c *PollingChannel) endPoll(pubkey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.polledAt[pubkey] = time.Now()
+	if c.polls[pubkey]--; c.polls[pubkey] > 0 {
+		return
+	}
+	delete(c.polls, pubkey)
+	delete(c.waiters, pubkey)
+}
+
+/*
+HandlePending returns the pending requests of the app, waiting for one up to
+the long-poll timeout. The app answers each request by posting the response
+to its reply_url, and fetches the next requests after the id of the last one
+received.
+*/
+func (c *PollingChannel) HandlePending(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	pubkey, ok := params["pubkey"]
+	if !ok {
+		http.Error(w, "invalid pubkey", http.StatusBadRequest)
+		return
+	}
+
+	signedAt, _ := strconv.ParseInt(r.URL.Query().Get("time"), 10, 64)
+	if err := verifySignature(pubkey, signedAt, "pending", r.URL.Query().Get("signature")); err != nil {
+		log.Printf("failed to verify pending requests fetch: %v", err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var after uint64
+	if value := r.URL.Query().Get("after"); value != "" {
+		var err error
+		if after, err = strconv.ParseUint(value, 10, 64); err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c.startPoll(pubkey)
+	defer c.endPoll(pubkey)
+	timeout := time.After(LongPollTimeout)
+	messages, waiter := c.fetch(pubkey, after)
+	for messages == nil {
+		select {
+		case <-waiter:
+			messages, waiter = c.fetch(pubkey, after)
+		case <-timeout:
+			messages = []QueuedRequest{}
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	jsonBytes, err := json.Marshal(messages)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
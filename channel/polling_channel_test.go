@@ -0,0 +1,122 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/gorilla/mux"
+	"gotest.tools/assert"
+)
+
+func TestPollingChannel(t *testing.T) {
+	ctx := context.Background()
+	privKey, err := secp256k1.GeneratePrivateKey()
+	assert.NilError(t, err)
+	pubkey := hex.EncodeToString(privKey.PubKey().SerializeCompressed())
+
+	router := mux.NewRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+	callbacks := NewHttpCallbackChannel(router, server.URL+"/response", nil)
+	fallback := &fallbackChannel{}
+	channel := NewPollingChannel(router, callbacks, fallback)
+
+	assert.NilError(t, channel.ValidateURL(ctx, PullWebhookURL))
+	res, err := http.Get(server.URL + "/pending/" + pubkey + "?time=1&signature=invalid")
+	assert.NilError(t, err)
+	assert.Equal(t, res.StatusCode, http.StatusUnauthorized, "unsigned fetch should be refused")
+
+	// The app long-polls before the request is sent, and answers on the reply url
+	go func() {
+		res, err := http.Get(server.URL + "/pending/" + pubkey + "?" + signedQuery(privKey, "pending"))
+		if err != nil {
+			return
+		}
+		defer res.Body.Close()
+		var messages []QueuedRequest
+		json.NewDecoder(res.Body).Decode(&messages)
+		for _, message := range messages {
+			req, _ := http.NewRequest("POST", message.Data["reply_url"].(string), bytes.NewReader([]byte(`{"template":"`+message.Template+`"}`)))
+			req.Header.Set("Cache-Control", "max-age=60")
+			http.DefaultClient.Do(req)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	message := WebhookMessage{Template: "lnurlpay_info", Data: map[string]interface{}{}}
+	response, err := channel.SendRequest(ctx, pubkey, PullWebhookURL, message, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, string(response.Body), `{"template":"lnurlpay_info"}`)
+	assert.Equal(t, *response.MaxAge, int64(60))
+
+	_, err = channel.SendRequest(ctx, pubkey, "http://webhook", WebhookMessage{Data: map[string]interface{}{}}, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, fallback.requests, 1, "app with a webhook should be sent the webhook")
+
+	// An abandoned request is removed from the queue
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = channel.SendRequest(canceled, pubkey, PullWebhookURL, WebhookMessage{Data: map[string]interface{}{}}, nil)
+	assert.Check(t, err != nil, "unanswered request should fail")
+	messages, _ := channel.fetch(pubkey, 0)
+	assert.Equal(t, len(messages), 0, "abandoned request should not be fetched")
+}
+
+func TestPollingChannelRefetch(t *testing.T) {
+	ctx := context.Background()
+	privKey, err := secp256k1.GeneratePrivateKey()
+	assert.NilError(t, err)
+	pubkey := hex.EncodeToString(privKey.PubKey().SerializeCompressed())
+
+	longPollTimeout := LongPollTimeout
+	LongPollTimeout = 50 * time.Millisecond
+	defer func() { LongPollTimeout = longPollTimeout }()
+
+	router := mux.NewRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+	callbacks := NewHttpCallbackChannel(router, server.URL+"/response", nil)
+	channel := NewPollingChannel(router, callbacks, &fallbackChannel{})
+	poll := func(after string) []QueuedRequest {
+		res, err := http.Get(server.URL + "/pending/" + pubkey + "?" + signedQuery(privKey, "pending") + after)
+		assert.NilError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusOK)
+		var messages []QueuedRequest
+		assert.NilError(t, json.NewDecoder(res.Body).Decode(&messages))
+		return messages
+	}
+
+	// The requests to an app not polling this instance fail right away
+	_, err = channel.SendRequest(ctx, pubkey, PullWebhookURL, WebhookMessage{Data: map[string]interface{}{}}, nil)
+	assert.Check(t, errors.Is(err, errNotPolling), "request to an app not polling should fail")
+
+	assert.Equal(t, len(poll("")), 0)
+	result := make(chan error, 1)
+	go func() {
+		_, err := channel.SendRequest(ctx, pubkey, PullWebhookURL, WebhookMessage{Template: "lnurlpay_info", Data: map[string]interface{}{}}, nil)
+		result <- err
+	}()
+
+	// A request fetched by a dropped poll is fetched again until answered
+	messages := poll("")
+	assert.Equal(t, len(messages), 1)
+	messages = poll("")
+	assert.Equal(t, len(messages), 1, "unanswered request should be fetched again")
+	assert.Equal(t, len(poll(fmt.Sprintf("&after=%d", messages[0].Id))), 0, "fetched request should be skipped after its id")
+
+	res, err := http.Post(messages[0].Data["reply_url"].(string), "application/json", bytes.NewReader([]byte(`{}`)))
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.NilError(t, <-result)
+	assert.Equal(t, len(poll("")), 0, "answered request should be removed")
+}
@@ -0,0 +1,28 @@
+package channel
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/breez/breez-lnurl/constant"
+	"github.com/breez/lspd/lightning"
+)
+
+// verifySignature checks the signature of "<time>-<purpose>" by the pubkey, at a time close to now.
+func verifySignature(pubkey string, signedAt int64, purpose string, signature string) error {
+	if math.Abs(float64(time.Now().Unix()-signedAt)) > constant.ACCEPTABLE_TIME_DIFF {
+		return errors.New("invalid time")
+	}
+	messageToVerify := fmt.Sprintf("%v-%v", signedAt, purpose)
+	verifiedPubkey, err := lightning.VerifyMessage([]byte(messageToVerify), signature)
+	if err != nil {
+		return err
+	}
+	if pubkey != hex.EncodeToString(verifiedPubkey.SerializeCompressed()) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
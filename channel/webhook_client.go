@@ -0,0 +1,143 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The response bytes read past the limit to reuse the connection, beyond it the connection is closed.
+const maxDrainBytes = 256 * 1024
+
+type WebhookClientOptions struct {
+	// The timeouts to connect, to complete the TLS handshake, to receive the response headers
+	// and of the whole request.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	RequestTimeout        time.Duration
+	// The connections kept per webhook host.
+	MaxConnsPerHost     int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// The response bytes read, the rest is discarded.
+	MaxResponseBytes int64
+	UserAgent        string
+	// The client certificate presented to the webhooks requiring mTLS (optional).
+	ClientCertFile string
+	ClientKeyFile  string
+	// The policy restricting the webhook urls (optional).
+	Egress *EgressPolicy
+}
+
+func DefaultWebhookClientOptions() WebhookClientOptions {
+	return WebhookClientOptions{
+		DialTimeout:           10 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+		RequestTimeout:        30 * time.Second,
+		MaxConnsPerHost:       100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		MaxResponseBytes:      64 * 1024,
+		UserAgent:             "breez-lnurl",
+	}
+}
+
+type WebhookResponse struct {
+	StatusCode int
+	// The response body, truncated to the max response bytes.
+	Body []byte
+}
+
+/*
+WebhookClient sends the requests to the webhooks, shared by the lnurl
+callback channel and the NWC manager. The connections are pooled per host
+and the responses always drained and closed, so they are reused.
+*/
+type WebhookClient struct {
+	client           *http.Client
+	egress           *EgressPolicy
+	userAgent        string
+	maxResponseBytes int64
+}
+
+func NewWebhookClient(options WebhookClientOptions) (*WebhookClient, error) {
+	dialer := &net.Dialer{Timeout: options.DialTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		// A proxy would connect on behalf of the server, bypassing the egress policy
+		Proxy:                 nil,
+		DialContext:           options.Egress.dialContext(dialer),
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   options.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: options.ResponseHeaderTimeout,
+		MaxConnsPerHost:       options.MaxConnsPerHost,
+		MaxIdleConns:          options.MaxIdleConnsPerHost * 10,
+		MaxIdleConnsPerHost:   options.MaxIdleConnsPerHost,
+		IdleConnTimeout:       options.IdleConnTimeout,
+	}
+	if options.ClientCertFile != "" || options.ClientKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(options.ClientCertFile, options.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the webhook client certificate: %w", err)
+		}
+		transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+
+	return &WebhookClient{
+		client: &http.Client{
+			Transport:     transport,
+			Timeout:       options.RequestTimeout,
+			CheckRedirect: options.Egress.checkRedirect,
+		},
+		egress:           options.Egress,
+		userAgent:        options.UserAgent,
+		maxResponseBytes: options.MaxResponseBytes,
+	}, nil
+}
+
+// NewDefaultWebhookClient returns a client with the default options, without egress policy.
+func NewDefaultWebhookClient() *WebhookClient {
+	client, _ := NewWebhookClient(DefaultWebhookClientOptions())
+	return client
+}
+
+// ValidateURL checks the webhook url against the egress policy, when registered.
+func (c *WebhookClient) ValidateURL(ctx context.Context, url string) error {
+	return c.egress.ValidateURL(ctx, url)
+}
+
+// Post sends the json body to the webhook, returning the response whatever its status.
+func (c *WebhookClient) Post(ctx context.Context, url string, body []byte) (*WebhookResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(io.Discard, io.LimitReader(res.Body, maxDrainBytes))
+		res.Body.Close()
+	}()
+
+	responseBody, err := io.ReadAll(io.LimitReader(res.Body, c.maxResponseBytes))
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookResponse{
+		StatusCode: res.StatusCode,
+		Body:       responseBody,
+	}, nil
+}
@@ -0,0 +1,46 @@
+package channel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestWebhookClientPost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Check(t, r.Header.Get("Content-Type") == "application/json")
+		assert.Check(t, r.Header.Get("User-Agent") == "test-agent", "unexpected user agent %s", r.Header.Get("User-Agent"))
+		assert.Check(t, string(body) == `{"template":"test"}`)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(strings.Repeat("a", 100)))
+	}))
+	defer server.Close()
+
+	options := DefaultWebhookClientOptions()
+	options.UserAgent = "test-agent"
+	options.MaxResponseBytes = 10
+	client, err := NewWebhookClient(options)
+	assert.NilError(t, err)
+
+	// The connection is reused across requests, the responses being drained
+	for i := 0; i < 3; i++ {
+		res, err := client.Post(context.Background(), server.URL, []byte(`{"template":"test"}`))
+		assert.NilError(t, err)
+		assert.Equal(t, res.StatusCode, http.StatusAccepted)
+		assert.Equal(t, string(res.Body), strings.Repeat("a", 10), "response body should be truncated")
+	}
+}
+
+func TestWebhookClientCertificate(t *testing.T) {
+	options := DefaultWebhookClientOptions()
+	options.ClientCertFile = "missing.pem"
+	options.ClientKeyFile = "missing.key"
+	_, err := NewWebhookClient(options)
+	assert.Check(t, err != nil, "missing client certificate should fail")
+}
@@ -0,0 +1,244 @@
+package channel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/gorilla/mux"
+)
+
+// The interval to ping the connected apps, closing the connections not answering.
+var SocketPingInterval time.Duration = 30 * time.Second
+
+// The timeout to write a request or a ping to a connected app.
+var SocketWriteTimeout time.Duration = 10 * time.Second
+
+// The maximum size of a response sent by a connected app.
+const maxSocketMessageSize = 1024 * 1024
+
+var errSocketUnavailable = errors.New("socket unavailable")
+
+// SocketRequest is a webhook message sent down the socket of the app.
+type SocketRequest struct {
+	Id       string                 `json:"id"`
+	Template string                 `json:"template"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+// SocketResponse is the response of the app to a request, with the max-age to cache it.
+type SocketResponse struct {
+	Id     string          `json:"id"`
+	Body   json.RawMessage `json:"body"`
+	MaxAge *int64          `json:"max_age,omitempty"`
+}
+
+/*
+WebSocketChannel sends the requests down the WebSocket held by the app while
+in the foreground, answered on the same socket without waking the app. The
+requests to an app not connected to this instance go through the fallback
+channel, the webhook.
+*/
+type WebSocketChannel struct {
+	mu          sync.Mutex
+	connections map[string]*socketConnection
+	fallback    WebhookChannel
+}
+
+func NewWebSocketChannel(router *mux.Router, fallback WebhookChannel) *WebSocketChannel {
+	channel := &WebSocketChannel{
+		connections: make(map[string]*socketConnection),
+		fallback:    fallback,
+	}
+
+	// The app connects with the time and the signature of "<time>-websocket" as query parameters
+	router.HandleFunc("/ws/{pubkey}", channel.HandleConnect).Methods("GET")
+
+	return channel
+}
+
+func (c *WebSocketChannel) SendRequest(ctx context.Context, pubkey string, url string, message WebhookMessage, rw http.ResponseWriter) (*CallbackResponse, error) {
+	c.mu.Lock()
+	conn := c.connections[pubkey]
+	c.mu.Unlock()
+
+	if conn != nil {
+		response, err := conn.request(ctx, message)
+		if !errors.Is(err, errSocketUnavailable) {
+			return response, err
+		}
+		log.Printf("socket of %v unavailable, falling back to the webhook: %v", pubkey, err)
+	}
+	return c.fallback.SendRequest(ctx, pubkey, url, message, rw)
+}
+
+func (c *WebSocketChannel) ValidateURL(ctx context.Context, url string) error {
+	return c.fallback.ValidateURL(ctx, url)
+}
+
+/*
+HandleConnect upgrades the request of the app to a WebSocket, replacing any
+previous connection of the app. The connection is served until closed.
+*/
+func (c *WebSocketChannel) HandleConnect(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	pubkey, ok := params["pubkey"]
+	if !ok {
+		http.Error(w, "invalid pubkey", http.StatusBadRequest)
+		return
+	}
+
+	signedAt, _ := strconv.ParseInt(r.URL.Query().Get("time"), 10, 64)
+	if err := verifySignature(pubkey, signedAt, "websocket", r.URL.Query().Get("signature")); err != nil {
+		log.Printf("failed to verify socket connection: %v", err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	ws, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		log.Printf("failed to accept socket of %v: %v", pubkey, err)
+		return
+	}
+	ws.SetReadLimit(maxSocketMessageSize)
+	conn := newSocketConnection(ws)
+
+	c.mu.Lock()
+	previous := c.connections[pubkey]
+	c.connections[pubkey] = conn
+	c.mu.Unlock()
+	if previous != nil {
+		previous.ws.Close(websocket.StatusPolicyViolation, "replaced by a new connection")
+	}
+
+	log.Printf("socket connected: pubkey:%v", pubkey)
+	conn.serve(r.Context())
+	log.Printf("socket disconnected: pubkey:%v", pubkey)
+
+	c.mu.Lock()
+	if c.connections[pubkey] == conn {
+		delete(c.connections, pubkey)
+	}
+	c.mu.Unlock()
+}
+
+// socketConnection is the socket of an app, matching the responses with the pending requests.
+type socketConnection struct {
+	ws      *websocket.Conn
+	mu      sync.Mutex
+	pending map[string]chan CallbackResponse
+	closed  chan struct{}
+}
+
+func newSocketConnection(ws *websocket.Conn) *socketConnection {
+	return &socketConnection{
+		ws:      ws,
+		pending: make(map[string]chan CallbackResponse),
+		closed:  make(chan struct{}),
+	}
+}
+
+// serve reads the responses and pings the app until the connection is closed.
+func (s *socketConnection) serve(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer close(s.closed)
+	defer s.ws.CloseNow()
+
+	go func() {
+		for {
+			select {
+			case <-time.After(SocketPingInterval):
+			case <-ctx.Done():
+				return
+			}
+			pingCtx, pingCancel := context.WithTimeout(ctx, SocketWriteTimeout)
+			err := s.ws.Ping(pingCtx)
+			pingCancel()
+			if err != nil {
+				s.ws.Close(websocket.StatusGoingAway, "ping timeout")
+				return
+			}
+		}
+	}()
+
+	for {
+		_, data, err := s.ws.Read(ctx)
+		if err != nil {
+			return
+		}
+		var response SocketResponse
+		if err := json.Unmarshal(data, &response); err != nil {
+			log.Printf("invalid socket response: %v", err)
+			continue
+		}
+		s.mu.Lock()
+		responseChan, ok := s.pending[response.Id]
+		delete(s.pending, response.Id)
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		responseChan <- CallbackResponse{
+			Body:   response.Body,
+			MaxAge: response.MaxAge,
+		}
+	}
+}
+
+/*
+request sends the message down the socket and waits for its response. It
+fails with errSocketUnavailable if the socket is closed before responding,
+so the request can be sent through the webhook.
+*/
+func (s *socketConnection) request(ctx context.Context, message WebhookMessage) (*CallbackResponse, error) {
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+	data, err := json.Marshal(SocketRequest{
+		Id:       id,
+		Template: message.Template,
+		Data:     message.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	responseChan := make(chan CallbackResponse, 1)
+	s.mu.Lock()
+	s.pending[id] = responseChan
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+	}()
+
+	writeCtx, cancel := context.WithTimeout(ctx, SocketWriteTimeout)
+	defer cancel()
+	if err := s.ws.Write(writeCtx, websocket.MessageText, data); err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.New("canceled")
+		}
+		return nil, errors.Join(errSocketUnavailable, err)
+	}
+
+	select {
+	case response := <-responseChan:
+		return &response, nil
+	case <-s.closed:
+		return nil, errSocketUnavailable
+	case <-ctx.Done():
+		return nil, errors.New("canceled")
+	case <-time.After(CALLBACK_TIMEOUT):
+		return nil, errors.New("timeout")
+	}
+}
@@ -0,0 +1,110 @@
+package channel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/breez/lspd/lightning"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/coder/websocket"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/gorilla/mux"
+	"github.com/tv42/zbase32"
+	"gotest.tools/assert"
+)
+
+// fallbackChannel answers all the requests, counting them.
+type fallbackChannel struct {
+	requests int
+}
+
+func (f *fallbackChannel) SendRequest(ctx context.Context, pubkey string, url string, message WebhookMessage, rw http.ResponseWriter) (*CallbackResponse, error) {
+	f.requests++
+	return &CallbackResponse{Body: []byte(`"fallback"`)}, nil
+}
+
+func (f *fallbackChannel) ValidateURL(ctx context.Context, url string) error {
+	return nil
+}
+
+// signedQuery returns the time and signature query parameters signing the purpose with the key.
+func signedQuery(privKey *secp256k1.PrivateKey, purpose string) string {
+	now := time.Now().Unix()
+	msg := append(lightning.SignedMsgPrefix, []byte(fmt.Sprintf("%v-%v", now, purpose))...)
+	first := sha256.Sum256(msg)
+	second := sha256.Sum256(first[:])
+	sig := ecdsa.SignCompact(privKey, second[:], true)
+	return fmt.Sprintf("time=%v&signature=%v", now, zbase32.EncodeToString(sig))
+}
+
+func TestWebSocketChannel(t *testing.T) {
+	ctx := context.Background()
+	privKey, err := secp256k1.GeneratePrivateKey()
+	assert.NilError(t, err)
+	pubkey := hex.EncodeToString(privKey.PubKey().SerializeCompressed())
+
+	router := mux.NewRouter()
+	fallback := &fallbackChannel{}
+	channel := NewWebSocketChannel(router, fallback)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	wsURL := strings.Replace(server.URL, "http", "ws", 1) + "/ws/" + pubkey
+
+	_, _, err = websocket.Dial(ctx, wsURL+"?time=1&signature=invalid", nil)
+	assert.Check(t, err != nil, "unsigned connection should be refused")
+
+	ws, _, err := websocket.Dial(ctx, wsURL+"?"+signedQuery(privKey, "websocket"), nil)
+	assert.NilError(t, err)
+	go func() {
+		for {
+			_, data, err := ws.Read(ctx)
+			if err != nil {
+				return
+			}
+			var request SocketRequest
+			json.Unmarshal(data, &request)
+			maxAge := int64(60)
+			response, _ := json.Marshal(SocketResponse{Id: request.Id, Body: json.RawMessage(`{"template":"` + request.Template + `"}`), MaxAge: &maxAge})
+			ws.Write(ctx, websocket.MessageText, response)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		channel.mu.Lock()
+		connected := channel.connections[pubkey] != nil
+		channel.mu.Unlock()
+		if connected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	message := func() WebhookMessage {
+		return WebhookMessage{Template: "lnurlpay_info", Data: map[string]interface{}{}}
+	}
+	response, err := channel.SendRequest(ctx, pubkey, "http://webhook", message(), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, string(response.Body), `{"template":"lnurlpay_info"}`)
+	assert.Equal(t, *response.MaxAge, int64(60))
+	assert.Equal(t, fallback.requests, 0, "connected app should answer on the socket")
+
+	_, err = channel.SendRequest(ctx, "other", "http://webhook", message(), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, fallback.requests, 1, "app not connected should be sent the webhook")
+
+	ws.Close(websocket.StatusNormalClosure, "")
+	for i := 0; i < 100; i++ {
+		if response, err = channel.SendRequest(ctx, pubkey, "http://webhook", message(), nil); err == nil && string(response.Body) == `"fallback"` {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, string(response.Body), `"fallback"`, "disconnected app should be sent the webhook")
+}
@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// The networks an on-chain address is accepted for.
+var bitcoinNetworks = []*chaincfg.Params{
+	&chaincfg.MainNetParams,
+	&chaincfg.TestNet3Params,
+	&chaincfg.SigNetParams,
+	&chaincfg.RegressionNetParams,
+}
+
+// PaymentInstructions are the payment methods published in a BIP353 TXT record.
+type PaymentInstructions struct {
+	Offer                string
+	BitcoinAddress       *string
+	SilentPaymentAddress *string
+	LnurlFallback        bool
+}
+
+func (p *PaymentInstructions) Validate() error {
+	if !strings.HasPrefix(p.Offer, "lno") {
+		return fmt.Errorf("invalid offer %v", p.Offer)
+	}
+	if p.BitcoinAddress != nil {
+		if err := validateBitcoinAddress(*p.BitcoinAddress); err != nil {
+			return err
+		}
+	}
+	if p.SilentPaymentAddress != nil {
+		if err := validateSilentPaymentAddress(*p.SilentPaymentAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Bip321Uri builds the BIP-321 URI for the payment instructions. The on-chain
+address is set as the URI path, the offer, silent payment address and the
+optional LNURL fallback are added as query parameters.
+*/
+func Bip321Uri(instructions PaymentInstructions, lnurl *string) (string, error) {
+	if err := instructions.Validate(); err != nil {
+		return "", err
+	}
+
+	address := ""
+	if instructions.BitcoinAddress != nil {
+		address = *instructions.BitcoinAddress
+	}
+
+	params := url.Values{}
+	params.Set("lno", instructions.Offer)
+	if instructions.SilentPaymentAddress != nil {
+		params.Set("sp", *instructions.SilentPaymentAddress)
+	}
+	if lnurl != nil {
+		if !strings.HasPrefix(strings.ToLower(*lnurl), "lnurl") {
+			return "", fmt.Errorf("invalid lnurl %v", *lnurl)
+		}
+		params.Set("lightning", *lnurl)
+	}
+
+	return fmt.Sprintf("bitcoin:%s?%s", address, params.Encode()), nil
+}
+
+/*
+Record builds the BIP-321 URI published in the TXT record of the username.
+If requested, the LNURL fallback points to this server's lnurlp endpoint.
+*/
+func Record(externalURL *url.URL, username string, instructions PaymentInstructions) (string, error) {
+	var lnurl *string
+	if instructions.LnurlFallback {
+		encoded, err := encodeLnurl(externalURL.JoinPath("lnurlp", username).String())
+		if err != nil {
+			return "", err
+		}
+		lnurl = &encoded
+	}
+	return Bip321Uri(instructions, lnurl)
+}
+
+func validateBitcoinAddress(address string) error {
+	for _, net := range bitcoinNetworks {
+		decoded, err := btcutil.DecodeAddress(address, net)
+		if err == nil && decoded.IsForNet(net) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid bitcoin address %v", address)
+}
+
+func validateSilentPaymentAddress(address string) error {
+	hrp, data, err := bech32.DecodeNoLimit(address)
+	if err != nil {
+		return fmt.Errorf("invalid silent payment address %v: %w", address, err)
+	}
+	if hrp != "sp" && hrp != "tsp" {
+		return fmt.Errorf("invalid silent payment address hrp %v", hrp)
+	}
+	// The first 5-bit group is the silent payment version, only v0 is defined.
+	if len(data) == 0 || data[0] != 0 {
+		return fmt.Errorf("unsupported silent payment address version %v", address)
+	}
+	return nil
+}
+
+func encodeLnurl(s string) (string, error) {
+	converted, err := bech32.ConvertBits([]byte(s), 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode("lnurl", converted)
+}
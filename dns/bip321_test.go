@@ -0,0 +1,77 @@
+package dns
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const (
+	testOffer                = "lno1zzfq9ktw4h4r67qpq3zf4jjujdrpeenuz4jw9cwhxgjl5e7a8wvh5cqcqvet65ahjawgr0r0uk0xznn0d5hrlpn2pqkqpeauwd4lxn33kjha7qgz4g9uzme8aakpehdzgel76lne3sswk6ducu6ygnsh8d87fqah39psqtqweqrf5actfuucvmmlt3k6snksj9dhsgvscj3aa2prf3p386q7p9kzhek7n0aspfmzxpps793pq0kufnlevx9qtyem0tq5g5lym8xt6zcve2kgqe5wv3gf9fcqkmt2z"
+	testBitcoinAddress       = "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"
+	testSilentPaymentAddress = "sp1qqgste7k9hx0qftg6qmwlkqtwuy6cycyavzmzj85c6qdfhjdpdjtdgqjuexzk6murw56suy3e0rd2cgqvycxttddwsvgxe2usfpxumr70xc9pkqwv"
+)
+
+func TestBip321UriOfferOnly(t *testing.T) {
+	uri, err := Bip321Uri(PaymentInstructions{Offer: testOffer}, nil)
+	assert.NilError(t, err, "should build an offer only uri")
+	assert.Equal(t, uri, "bitcoin:?lno="+testOffer)
+}
+
+func TestBip321UriAllInstructions(t *testing.T) {
+	bitcoinAddress := testBitcoinAddress
+	silentPaymentAddress := testSilentPaymentAddress
+	lnurl, err := encodeLnurl("https://breez.domain/lnurlp/testuser")
+	assert.NilError(t, err, "should encode lnurl")
+
+	uri, err := Bip321Uri(PaymentInstructions{
+		Offer:                testOffer,
+		BitcoinAddress:       &bitcoinAddress,
+		SilentPaymentAddress: &silentPaymentAddress,
+		LnurlFallback:        true,
+	}, &lnurl)
+	assert.NilError(t, err, "should build a uri with all instructions")
+	assert.Check(t, strings.HasPrefix(uri, "bitcoin:"+testBitcoinAddress+"?"), "address should be the uri path")
+
+	query, err := url.ParseQuery(strings.SplitN(uri, "?", 2)[1])
+	assert.NilError(t, err, "should parse the uri query")
+	assert.Equal(t, query.Get("lno"), testOffer)
+	assert.Equal(t, query.Get("sp"), testSilentPaymentAddress)
+	assert.Equal(t, query.Get("lightning"), lnurl)
+}
+
+func TestBip321UriInvalidInstructions(t *testing.T) {
+	invalidBitcoinAddress := "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdz"
+	invalidSilentPaymentAddress := "sp1qqgste7k9hx0qftg6qmwlkqtwuy6cycyavzmzj85c6qdfhjdpdjtdgqjuexzk6murw56suy3e0rd2cgqvycxttddwsvgxe2usfpxumr70xc9pkqwq"
+	bech32Address := testBitcoinAddress
+	invalidLnurl := "https://breez.domain/lnurlp/testuser"
+
+	_, err := Bip321Uri(PaymentInstructions{Offer: "thisisnotavalidoffer"}, nil)
+	assert.ErrorContains(t, err, "invalid offer")
+
+	_, err = Bip321Uri(PaymentInstructions{Offer: testOffer, BitcoinAddress: &invalidBitcoinAddress}, nil)
+	assert.ErrorContains(t, err, "invalid bitcoin address")
+
+	_, err = Bip321Uri(PaymentInstructions{Offer: testOffer, SilentPaymentAddress: &invalidSilentPaymentAddress}, nil)
+	assert.ErrorContains(t, err, "invalid silent payment address")
+
+	_, err = Bip321Uri(PaymentInstructions{Offer: testOffer, SilentPaymentAddress: &bech32Address}, nil)
+	assert.ErrorContains(t, err, "invalid silent payment address hrp")
+
+	_, err = Bip321Uri(PaymentInstructions{Offer: testOffer}, &invalidLnurl)
+	assert.ErrorContains(t, err, "invalid lnurl")
+}
+
+func TestRecordLnurlFallback(t *testing.T) {
+	expected, err := encodeLnurl("https://breez.domain/lnurlp/user")
+	assert.NilError(t, err, "failed to encode lnurl")
+	for _, rawURL := range []string{"https://breez.domain", "https://breez.domain/"} {
+		externalURL, err := url.Parse(rawURL)
+		assert.NilError(t, err, "failed to parse url")
+		record, err := Record(externalURL, "user", PaymentInstructions{Offer: testOffer, LnurlFallback: true})
+		assert.NilError(t, err, "should build the record")
+		assert.Check(t, strings.Contains(record, "lightning="+expected), rawURL)
+	}
+}
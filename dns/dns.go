@@ -4,14 +4,17 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
 type DnsService interface {
-	Set(username, offer string) (uint32, error)
+	Set(username string, instructions PaymentInstructions) (uint32, error)
 	Remove(username string) error
+	// List returns the TXT records currently published by username.
+	List() (map[string]string, error)
 }
 
 func NewNoDns() DnsService {
@@ -20,9 +23,9 @@ func NewNoDns() DnsService {
 
 type NoDns struct{}
 
-func (n *NoDns) Set(username, offer string) (uint32, error) {
+func (n *NoDns) Set(username string, instructions PaymentInstructions) (uint32, error) {
 	// No DNS implementation, do nothing
-	log.Printf("No DNS implementation, not setting username: %s, offer: %s", username, offer)
+	log.Printf("No DNS implementation, not setting username: %s, offer: %s", username, instructions.Offer)
 	return 0, nil
 }
 
@@ -32,6 +35,11 @@ func (n *NoDns) Remove(username string) error {
 	return nil
 }
 
+func (n *NoDns) List() (map[string]string, error) {
+	// No DNS implementation, nothing is published
+	return map[string]string{}, nil
+}
+
 func NewDns(externalURL *url.URL, nameServer, protocol, tsigKey, tsigSecret string) *Dns {
 	dnsTimeout := 60 * time.Second
 	client := &dns.Client{
@@ -39,20 +47,38 @@ func NewDns(externalURL *url.URL, nameServer, protocol, tsigKey, tsigSecret stri
 		Net:     protocol,
 	}
 	return &Dns{
-		domain:     externalURL.Host,
-		nameServer: nameServer,
-		tsigKey:    tsigKey,
-		tsigSecret: tsigSecret,
-		client:     client,
+		externalURL: externalURL,
+		nameServer:  nameServer,
+		tsigKey:     tsigKey,
+		tsigSecret:  tsigSecret,
+		client:      client,
 	}
 }
 
 type Dns struct {
-	domain     string
-	nameServer string
-	tsigKey    string
-	tsigSecret string
-	client     *dns.Client
+	externalURL *url.URL
+	nameServer  string
+	tsigKey     string
+	tsigSecret  string
+	client      *dns.Client
+}
+
+func bip353Zone(domain string) string {
+	return fmt.Sprintf("_bitcoin-payment.%s.", domain)
+}
+
+func bip353Name(domain, username string) string {
+	return fmt.Sprintf("%s.user.%s", username, bip353Zone(domain))
+}
+
+// bip353Username returns the username of a record name in the BIP353 zone.
+func bip353Username(domain, name string) (string, bool) {
+	suffix := fmt.Sprintf(".user.%s", strings.ToLower(bip353Zone(domain)))
+	name = strings.ToLower(dns.Fqdn(name))
+	if !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, suffix), true
 }
 
 func chunks(s string, chunkSize int) []string {
@@ -77,19 +103,24 @@ func chunks(s string, chunkSize int) []string {
 	return chunks
 }
 
-func (d *Dns) Set(username, offer string) (uint32, error) {
+func (d *Dns) Set(username string, instructions PaymentInstructions) (uint32, error) {
 	ttl := uint32(3600)
-	zone := fmt.Sprintf("_bitcoin-payment.%s.", d.domain)
-	name := fmt.Sprintf("%s.user.%s", username, zone)
-	txt := fmt.Sprintf("bitcoin:?lno=%s", offer)
+	zone := bip353Zone(d.externalURL.Host)
+	name := bip353Name(d.externalURL.Host, username)
+	txt, err := Record(d.externalURL, username, instructions)
+	if err != nil {
+		return 0, err
+	}
 
 	rr := new(dns.TXT)
 	rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}
 	rr.Txt = chunks(txt, 255)
 	rrs := []dns.RR{rr}
 
+	// Replace any existing TXT record of the username
 	m := new(dns.Msg)
 	m.SetUpdate(zone)
+	m.RemoveRRset(rrs)
 	m.Insert(rrs)
 
 	z := dns.Fqdn(d.tsigKey)
@@ -111,8 +142,8 @@ func (d *Dns) Set(username, offer string) (uint32, error) {
 }
 
 func (d *Dns) Remove(username string) error {
-	zone := fmt.Sprintf("_bitcoin-payment.%s.", d.domain)
-	name := fmt.Sprintf("%s.user.%s", username, zone)
+	zone := bip353Zone(d.externalURL.Host)
+	name := bip353Name(d.externalURL.Host, username)
 
 	rr := new(dns.TXT)
 	rr.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET}
@@ -139,3 +170,44 @@ func (d *Dns) Remove(username string) error {
 
 	return nil
 }
+
+/*
+List transfers the BIP353 zone (AXFR) and returns the TXT records found under
+user._bitcoin-payment.<domain> by username.
+*/
+func (d *Dns) List() (map[string]string, error) {
+	zone := bip353Zone(d.externalURL.Host)
+
+	m := new(dns.Msg)
+	m.SetAxfr(zone)
+
+	z := dns.Fqdn(d.tsigKey)
+	m.SetTsig(z, dns.HmacSHA256, 300, time.Now().Unix())
+	transfer := &dns.Transfer{TsigSecret: map[string]string{z: d.tsigSecret}}
+	envelopes, err := transfer.In(m, d.nameServer)
+	if err != nil {
+		log.Printf("DNS zone transfer failed: %v", err)
+		return nil, err
+	}
+
+	records := make(map[string]string)
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			log.Printf("DNS zone transfer failed: %v", envelope.Error)
+			return nil, envelope.Error
+		}
+		for _, rr := range envelope.RR {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			username, ok := bip353Username(d.externalURL.Host, txt.Hdr.Name)
+			if !ok {
+				continue
+			}
+			records[username] = strings.Join(txt.Txt, "")
+		}
+	}
+
+	return records, nil
+}
@@ -0,0 +1,195 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type powerDnsRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+type powerDnsRRSet struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	Ttl        uint32           `json:"ttl,omitempty"`
+	ChangeType string           `json:"changetype,omitempty"`
+	Records    []powerDnsRecord `json:"records"`
+}
+
+type powerDnsZone struct {
+	RRSets []powerDnsRRSet `json:"rrsets"`
+}
+
+func NewPowerDns(externalURL *url.URL, apiURL, serverID, zone, apiKey string) *PowerDns {
+	if serverID == "" {
+		serverID = "localhost"
+	}
+	if zone == "" {
+		zone = bip353Zone(externalURL.Host)
+	}
+	return &PowerDns{
+		externalURL: externalURL,
+		zoneURL:     fmt.Sprintf("%s/api/v1/servers/%s/zones/%s", strings.TrimSuffix(apiURL, "/"), serverID, zone),
+		apiKey:      apiKey,
+		httpClient:  &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+/*
+PowerDns manages the BIP353 records through the PowerDNS authoritative
+server HTTP API.
+*/
+type PowerDns struct {
+	externalURL *url.URL
+	zoneURL     string
+	apiKey      string
+	httpClient  *http.Client
+}
+
+func (p *PowerDns) Set(username string, instructions PaymentInstructions) (uint32, error) {
+	ttl := uint32(3600)
+	txt, err := Record(p.externalURL, username, instructions)
+	if err != nil {
+		return 0, err
+	}
+
+	err = p.patch(powerDnsRRSet{
+		Name:       bip353Name(p.externalURL.Host, username),
+		Type:       "TXT",
+		Ttl:        ttl,
+		ChangeType: "REPLACE",
+		Records:    []powerDnsRecord{{Content: quoteTxt(txt)}},
+	})
+	if err != nil {
+		log.Printf("PowerDNS update failed: %v", err)
+		return 0, err
+	}
+	log.Printf("PowerDNS update success (Set): %v", username)
+
+	return ttl, nil
+}
+
+func (p *PowerDns) Remove(username string) error {
+	err := p.patch(powerDnsRRSet{
+		Name:       bip353Name(p.externalURL.Host, username),
+		Type:       "TXT",
+		ChangeType: "DELETE",
+		Records:    []powerDnsRecord{},
+	})
+	if err != nil {
+		log.Printf("PowerDNS update failed: %v", err)
+		return err
+	}
+	log.Printf("PowerDNS update success (Remove): %v", username)
+
+	return nil
+}
+
+func (p *PowerDns) List() (map[string]string, error) {
+	body, err := p.do("GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	var zone powerDnsZone
+	if err := json.Unmarshal(body, &zone); err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]string)
+	for _, rrset := range zone.RRSets {
+		if rrset.Type != "TXT" || len(rrset.Records) == 0 {
+			continue
+		}
+		username, ok := bip353Username(p.externalURL.Host, rrset.Name)
+		if !ok {
+			continue
+		}
+		txt, err := unquoteTxt(rrset.Records[0].Content)
+		if err != nil {
+			log.Printf("failed to parse TXT record for %v: %v", username, err)
+			continue
+		}
+		records[username] = txt
+	}
+	return records, nil
+}
+
+func (p *PowerDns) patch(rrset powerDnsRRSet) error {
+	body, err := json.Marshal(powerDnsZone{RRSets: []powerDnsRRSet{rrset}})
+	if err != nil {
+		return err
+	}
+	_, err = p.do("PATCH", body)
+	return err
+}
+
+func (p *PowerDns) do(method string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, p.zoneURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-Key", p.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("server replied: %d %s", res.StatusCode, strings.TrimSpace(string(resBody)))
+	}
+	return resBody, nil
+}
+
+// quoteTxt formats the TXT record as quoted character strings of up to 255 characters.
+func quoteTxt(txt string) string {
+	var quoted []string
+	for _, chunk := range chunks(txt, 255) {
+		chunk = strings.ReplaceAll(chunk, `\`, `\\`)
+		chunk = strings.ReplaceAll(chunk, `"`, `\"`)
+		quoted = append(quoted, fmt.Sprintf(`"%s"`, chunk))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// unquoteTxt joins the quoted character strings of a TXT record.
+func unquoteTxt(content string) (string, error) {
+	var txt strings.Builder
+	inQuotes := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '\\' && inQuotes:
+			if i+1 >= len(content) {
+				return "", fmt.Errorf("invalid escape in %v", content)
+			}
+			i++
+			txt.WriteByte(content[i])
+		case inQuotes:
+			txt.WriteByte(c)
+		case c != ' ':
+			return "", fmt.Errorf("unquoted content in %v", content)
+		}
+	}
+	if inQuotes {
+		return "", fmt.Errorf("unterminated quote in %v", content)
+	}
+	return txt.String(), nil
+}
@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// fakePowerDns implements the subset of the PowerDNS zone API used by PowerDns.
+type fakePowerDns struct {
+	sync.Mutex
+	rrsets map[string]powerDnsRRSet
+}
+
+func (f *fakePowerDns) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-API-Key") != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/api/v1/servers/localhost/zones/_bitcoin-payment.breez.domain." {
+		http.Error(w, "zone not found", http.StatusNotFound)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	switch r.Method {
+	case "GET":
+		zone := powerDnsZone{RRSets: []powerDnsRRSet{}}
+		for _, rrset := range f.rrsets {
+			zone.RRSets = append(zone.RRSets, rrset)
+		}
+		json.NewEncoder(w).Encode(zone)
+	case "PATCH":
+		var zone powerDnsZone
+		if err := json.NewDecoder(r.Body).Decode(&zone); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		for _, rrset := range zone.RRSets {
+			switch rrset.ChangeType {
+			case "REPLACE":
+				rrset.ChangeType = ""
+				f.rrsets[rrset.Name] = rrset
+			case "DELETE":
+				delete(f.rrsets, rrset.Name)
+			default:
+				http.Error(w, "invalid changetype", http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPowerDns(t *testing.T) {
+	fake := &fakePowerDns{rrsets: make(map[string]powerDnsRRSet)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	externalURL, _ := url.Parse("https://breez.domain")
+	powerDns := NewPowerDns(externalURL, server.URL, "", "", "secret")
+	instructions := PaymentInstructions{Offer: testOffer, LnurlFallback: true}
+
+	ttl, err := powerDns.Set("testuser", instructions)
+	assert.NilError(t, err, "failed to set record")
+	assert.Equal(t, ttl, uint32(3600))
+	rrset := fake.rrsets["testuser.user._bitcoin-payment.breez.domain."]
+	assert.Equal(t, len(rrset.Records), 1)
+	assert.Equal(t, rrset.Records[0].Content[0], byte('"'))
+
+	// Setting again replaces the record
+	ttl, err = powerDns.Set("testuser", instructions)
+	assert.NilError(t, err, "failed to replace record")
+	assert.Equal(t, len(fake.rrsets), 1)
+
+	records, err := powerDns.List()
+	assert.NilError(t, err, "failed to list records")
+	expected, _ := Record(externalURL, "testuser", instructions)
+	assert.DeepEqual(t, records, map[string]string{"testuser": expected})
+
+	err = powerDns.Remove("testuser")
+	assert.NilError(t, err, "failed to remove record")
+	records, err = powerDns.List()
+	assert.NilError(t, err, "failed to list records")
+	assert.Equal(t, len(records), 0)
+
+	_, err = NewPowerDns(externalURL, server.URL, "", "", "wrong").Set("testuser", instructions)
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestTxtQuoting(t *testing.T) {
+	txt := `bitcoin:?lno=lno1"quoted\escaped`
+	unquoted, err := unquoteTxt(quoteTxt(txt))
+	assert.NilError(t, err, "failed to unquote")
+	assert.Equal(t, unquoted, txt)
+
+	unquoted, err = unquoteTxt(`"bitcoin:?lno=" "lno1abc"`)
+	assert.NilError(t, err, "failed to unquote")
+	assert.Equal(t, unquoted, "bitcoin:?lno=lno1abc")
+
+	_, err = unquoteTxt(`"unterminated`)
+	assert.ErrorContains(t, err, "unterminated")
+}
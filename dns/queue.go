@@ -0,0 +1,228 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/breez/breez-lnurl/persist"
+	dnsstore "github.com/breez/breez-lnurl/persist/dns"
+)
+
+// The interval to poll for due DNS updates when not woken up by a new update.
+var QueuePollInterval time.Duration = 10 * time.Second
+
+// The duration a claimed update is hidden from other workers while processed.
+var QueueLeaseDuration time.Duration = 2 * time.Minute
+
+// The delay before the first retry, doubled on each failed attempt up to the max delay.
+var QueueRetryBaseDelay time.Duration = 10 * time.Second
+var QueueRetryMaxDelay time.Duration = time.Hour
+
+// The delay between publishing a record and its first DNSSEC verification.
+var QueueVerifyDelay time.Duration = 30 * time.Second
+
+// The number of attempts after which an update is marked as failed.
+var QueueMaxAttempts int = 10
+
+var errNotPublished = errors.New("record not published by the DNS service")
+
+/*
+Queue persists the BIP353 DNS changes and applies them in the background,
+retrying failed changes with an exponential backoff. When a verifier is set,
+published records are then verified to be resolvable and DNSSEC signed.
+Nothing is queued when DNS is disabled, the offers being kept as registered.
+*/
+type Queue struct {
+	dns      DnsService
+	verifier *Verifier
+	store    *persist.Store
+	wake     chan struct{}
+	disabled bool
+}
+
+func NewQueue(dns DnsService, verifier *Verifier, store *persist.Store) *Queue {
+	_, disabled := dns.(*NoDns)
+	return &Queue{
+		dns:      dns,
+		verifier: verifier,
+		store:    store,
+		wake:     make(chan struct{}, 1),
+		disabled: disabled,
+	}
+}
+
+// Set queues publishing the payment instructions of the username.
+func (q *Queue) Set(ctx context.Context, pubkey, username string, instructions PaymentInstructions) error {
+	if q.disabled {
+		return nil
+	}
+	offer := instructions.Offer
+	err := q.store.Dns.Enqueue(ctx, dnsstore.Update{
+		Username:             username,
+		Pubkey:               pubkey,
+		Action:               dnsstore.ActionSet,
+		Offer:                &offer,
+		BitcoinAddress:       instructions.BitcoinAddress,
+		SilentPaymentAddress: instructions.SilentPaymentAddress,
+		LnurlFallback:        instructions.LnurlFallback,
+	})
+	if err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Remove queues removing the TXT record of the username.
+func (q *Queue) Remove(ctx context.Context, pubkey, username string) error {
+	if q.disabled {
+		return nil
+	}
+	err := q.store.Dns.Enqueue(ctx, dnsstore.Update{
+		Username: username,
+		Pubkey:   pubkey,
+		Action:   dnsstore.ActionRemove,
+	})
+	if err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Status returns the DNS state of the username, nil if no change was ever queued.
+func (q *Queue) Status(ctx context.Context, username string) (*string, error) {
+	update, err := q.store.Dns.Get(ctx, username)
+	if err != nil || update == nil {
+		return nil, err
+	}
+	return &update.Status, nil
+}
+
+// Processes the due DNS updates until the context is done.
+func (q *Queue) Start(ctx context.Context) {
+	if q.disabled {
+		return
+	}
+	for {
+		for q.processNext(ctx) {
+		}
+		select {
+		case <-q.wake:
+			continue
+		case <-time.After(QueuePollInterval):
+			continue
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// processNext applies the next due update, returning false if there was none.
+func (q *Queue) processNext(ctx context.Context) bool {
+	update, err := q.store.Dns.Claim(ctx, time.Now(), QueueLeaseDuration)
+	if err != nil {
+		log.Printf("failed to claim DNS update: %v", err)
+		return false
+	}
+	if update == nil {
+		return false
+	}
+
+	switch {
+	case update.Status == dnsstore.StatusVerifying:
+		q.verify(ctx, update)
+		return true
+	case update.Action == dnsstore.ActionSet:
+		err = q.set(ctx, update)
+	case update.Action == dnsstore.ActionRemove:
+		err = q.dns.Remove(update.Username)
+	default:
+		log.Printf("unknown DNS update action %v for %v", update.Action, update.Username)
+		if err := q.store.Dns.SetFailed(ctx, update.Username, update.Version, "unknown action"); err != nil {
+			log.Printf("failed to update DNS state for %v: %v", update.Username, err)
+		}
+		return true
+	}
+
+	switch {
+	case err == nil && update.Action == dnsstore.ActionSet && q.verifier != nil:
+		err = q.store.Dns.SetVerifying(ctx, update.Username, update.Version, time.Now().Add(QueueVerifyDelay))
+	case err == nil:
+		err = q.store.Dns.SetPublished(ctx, update.Username, update.Version)
+	default:
+		err = q.retry(ctx, update, update.Action, err)
+	}
+	if err != nil {
+		log.Printf("failed to update DNS state for %v: %v", update.Username, err)
+	}
+	return true
+}
+
+// retry postpones the failed update with an exponential backoff, or marks it as failed.
+func (q *Queue) retry(ctx context.Context, update *dnsstore.Update, operation string, err error) error {
+	if errors.Is(err, errNotPublished) || update.Attempts+1 >= QueueMaxAttempts {
+		log.Printf("DNS %v for %v failed after %v attempts: %v", operation, update.Username, update.Attempts+1, err)
+		return q.store.Dns.SetFailed(ctx, update.Username, update.Version, err.Error())
+	}
+	delay := QueueRetryBaseDelay << update.Attempts
+	if delay < QueueRetryBaseDelay || delay > QueueRetryMaxDelay {
+		delay = QueueRetryMaxDelay
+	}
+	log.Printf("DNS %v for %v failed, retrying in %v: %v", operation, update.Username, delay, err)
+	return q.store.Dns.SetRetry(ctx, update.Username, update.Version, time.Now().Add(delay), err.Error())
+}
+
+func (q *Queue) verify(ctx context.Context, update *dnsstore.Update) {
+	err := q.verifier.Verify(update.Username, instructionsOf(update))
+	if err == nil {
+		verifyMetrics.Add("verified", 1)
+		log.Printf("DNS record of %v verified", update.Username)
+		err = q.store.Dns.SetVerified(ctx, update.Username, update.Version)
+	} else {
+		verifyMetrics.Add("errors", 1)
+		if update.Attempts+1 >= QueueMaxAttempts {
+			verifyMetrics.Add("failed", 1)
+		}
+		err = q.retry(ctx, update, "verification", err)
+	}
+	if err != nil {
+		log.Printf("failed to update DNS state for %v: %v", update.Username, err)
+	}
+}
+
+func instructionsOf(update *dnsstore.Update) PaymentInstructions {
+	return PaymentInstructions{
+		Offer:                *update.Offer,
+		BitcoinAddress:       update.BitcoinAddress,
+		SilentPaymentAddress: update.SilentPaymentAddress,
+		LnurlFallback:        update.LnurlFallback,
+	}
+}
+
+func (q *Queue) set(ctx context.Context, update *dnsstore.Update) error {
+	ttl, err := q.dns.Set(update.Username, instructionsOf(update))
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		// Only keep the offer if the DNS service returns a TTL
+		details, err := q.store.LnUrl.GetPubkeyDetails(ctx, update.Pubkey)
+		if err == nil && details != nil && strings.EqualFold(details.Username, update.Username) &&
+			details.Offer != nil && *details.Offer == *update.Offer {
+			q.store.LnUrl.SetPubkeyDetails(ctx, update.Pubkey, update.Username, nil)
+		}
+		return errNotPublished
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/breez/breez-lnurl/persist"
+	dnsstore "github.com/breez/breez-lnurl/persist/dns"
+	"gotest.tools/assert"
+)
+
+type failingDns struct {
+	memoryDns
+	failures int
+}
+
+func (f *failingDns) Set(username string, instructions PaymentInstructions) (uint32, error) {
+	if f.failures > 0 {
+		f.failures--
+		return 0, errors.New("name server unavailable")
+	}
+	return f.memoryDns.Set(username, instructions)
+}
+
+func setupQueue(t *testing.T, failures int) (*Queue, *failingDns, *persist.Store) {
+	externalURL, err := url.Parse("https://breez.domain")
+	assert.NilError(t, err, "failed to parse url")
+
+	dns := &failingDns{
+		memoryDns: memoryDns{externalURL: externalURL, records: make(map[string]string)},
+		failures:  failures,
+	}
+	store := persist.NewMemoryStore()
+	return NewQueue(dns, nil, store), dns, store
+}
+
+func assertStatus(t *testing.T, queue *Queue, username string, expected string) {
+	status, err := queue.Status(context.Background(), username)
+	assert.NilError(t, err, "failed to get status")
+	assert.Assert(t, status != nil, "status should be set")
+	assert.Equal(t, *status, expected)
+}
+
+func TestQueueRetry(t *testing.T) {
+	QueueRetryBaseDelay = 0
+	defer func() { QueueRetryBaseDelay = 10 * time.Second }()
+
+	queue, dns, _ := setupQueue(t, 2)
+	ctx := context.Background()
+
+	status, err := queue.Status(ctx, "testuser")
+	assert.NilError(t, err, "failed to get status")
+	assert.Assert(t, status == nil, "status should not be set")
+
+	err = queue.Set(ctx, "pubkey", "testuser", PaymentInstructions{Offer: testOffer})
+	assert.NilError(t, err, "failed to queue update")
+	assertStatus(t, queue, "testuser", dnsstore.StatusPending)
+
+	// The first attempts fail and are retried
+	assert.Assert(t, queue.processNext(ctx), "update should be processed")
+	assertStatus(t, queue, "testuser", dnsstore.StatusPending)
+	assert.Assert(t, queue.processNext(ctx), "update should be processed")
+	assertStatus(t, queue, "testuser", dnsstore.StatusPending)
+	assert.Assert(t, queue.processNext(ctx), "update should be processed")
+	assertStatus(t, queue, "testuser", dnsstore.StatusPublished)
+	assert.Assert(t, !queue.processNext(ctx), "no update should be left")
+
+	expected, _ := Record(dns.externalURL, "testuser", PaymentInstructions{Offer: testOffer})
+	assert.Equal(t, dns.records["testuser"], expected)
+
+	err = queue.Remove(ctx, "pubkey", "testuser")
+	assert.NilError(t, err, "failed to queue update")
+	assert.Assert(t, queue.processNext(ctx), "update should be processed")
+	assertStatus(t, queue, "testuser", dnsstore.StatusPublished)
+	_, exists := dns.records["testuser"]
+	assert.Check(t, !exists, "record should be removed")
+}
+
+func TestQueueFailed(t *testing.T) {
+	QueueRetryBaseDelay = 0
+	QueueMaxAttempts = 2
+	defer func() {
+		QueueRetryBaseDelay = 10 * time.Second
+		QueueMaxAttempts = 10
+	}()
+
+	queue, dns, _ := setupQueue(t, 5)
+	ctx := context.Background()
+
+	err := queue.Set(ctx, "pubkey", "testuser", PaymentInstructions{Offer: testOffer})
+	assert.NilError(t, err, "failed to queue update")
+	assert.Assert(t, queue.processNext(ctx), "update should be processed")
+	assertStatus(t, queue, "testuser", dnsstore.StatusPending)
+	assert.Assert(t, queue.processNext(ctx), "update should be processed")
+	assertStatus(t, queue, "testuser", dnsstore.StatusFailed)
+	assert.Assert(t, !queue.processNext(ctx), "failed update should not be retried")
+	assert.Equal(t, len(dns.records), 0)
+
+	// A new registration queues the update again
+	dns.failures = 0
+	err = queue.Set(ctx, "pubkey", "testuser", PaymentInstructions{Offer: testOffer})
+	assert.NilError(t, err, "failed to queue update")
+	assert.Assert(t, queue.processNext(ctx), "update should be processed")
+	assertStatus(t, queue, "testuser", dnsstore.StatusPublished)
+}
+
+func TestQueueNoDns(t *testing.T) {
+	store := persist.NewMemoryStore()
+	queue := NewQueue(NewNoDns(), nil, store)
+	ctx := context.Background()
+
+	offer := testOffer
+	_, err := store.LnUrl.SetPubkeyDetails(ctx, "pubkey", "testuser", &offer)
+	assert.NilError(t, err, "failed to set pubkey details")
+
+	// Nothing is queued, so the registered offer is kept
+	err = queue.Set(ctx, "pubkey", "testuser", PaymentInstructions{Offer: testOffer})
+	assert.NilError(t, err, "failed to queue update")
+	status, err := queue.Status(ctx, "testuser")
+	assert.NilError(t, err, "failed to get status")
+	assert.Assert(t, status == nil, "status should not be set")
+	assert.Assert(t, !queue.processNext(ctx), "no update should be queued")
+
+	details, err := store.LnUrl.GetPubkeyDetails(ctx, "pubkey")
+	assert.NilError(t, err, "failed to get pubkey details")
+	assert.Assert(t, details.Offer != nil && *details.Offer == testOffer, "offer should be kept")
+
+	err = queue.Remove(ctx, "pubkey", "testuser")
+	assert.NilError(t, err, "failed to queue update")
+	assert.Assert(t, !queue.processNext(ctx), "no update should be queued")
+}
@@ -0,0 +1,153 @@
+package dns
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/breez/breez-lnurl/persist"
+	dnsstore "github.com/breez/breez-lnurl/persist/dns"
+)
+
+// The interval to reconcile the BIP353 zone with the stored offers.
+var ReconcileInterval time.Duration = time.Hour
+
+type ReconcileReport struct {
+	Added   []string
+	Updated []string
+	Removed []string
+	Failed  []string
+}
+
+func (r *ReconcileReport) HasChanges() bool {
+	return len(r.Added) > 0 || len(r.Updated) > 0 || len(r.Removed) > 0
+}
+
+/*
+Reconciler repairs drift between the offers stored in pubkey_details and the
+TXT records published in the BIP353 zone. In dry-run mode the changes are only
+reported. The usernames with a change still queued are left to the queue.
+*/
+type Reconciler struct {
+	dns         DnsService
+	store       *persist.Store
+	externalURL *url.URL
+	dryRun      bool
+}
+
+func NewReconciler(dns DnsService, store *persist.Store, externalURL *url.URL, dryRun bool) *Reconciler {
+	return &Reconciler{
+		dns:         dns,
+		store:       store,
+		externalURL: externalURL,
+		dryRun:      dryRun,
+	}
+}
+
+// Periodically reconciles the BIP353 zone, on a single instance at a time.
+func (r *Reconciler) Start(ctx context.Context) {
+	for {
+		claimed, err := r.store.Dns.ClaimReconcile(ctx, time.Now(), ReconcileInterval)
+		if err != nil {
+			log.Printf("Failed to claim the DNS reconciliation: %v", err)
+		}
+		if claimed {
+			if _, err := r.Reconcile(ctx); err != nil {
+				log.Printf("Failed to reconcile DNS records: %v", err)
+			}
+		}
+		select {
+		case <-time.After(ReconcileInterval):
+			continue
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Reconciler) Reconcile(ctx context.Context) (*ReconcileReport, error) {
+	// The zone is listed first, so a registration committed in between is
+	// found in the stored offers rather than removed from the zone.
+	published, err := r.dns.List()
+	if err != nil {
+		return nil, err
+	}
+	details, err := r.store.LnUrl.ListPubkeyDetails(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{}
+	expected := make(map[string]bool)
+	for _, detail := range details {
+		username := strings.ToLower(detail.Username)
+		instructions := PaymentInstructions{
+			Offer:                *detail.Offer,
+			BitcoinAddress:       detail.BitcoinAddress,
+			SilentPaymentAddress: detail.SilentPaymentAddress,
+			LnurlFallback:        detail.LnurlFallback,
+		}
+		record, err := Record(r.externalURL, detail.Username, instructions)
+		if err != nil {
+			log.Printf("failed to build DNS TXT record for %v: %v", username, err)
+			report.Failed = append(report.Failed, username)
+			continue
+		}
+		expected[username] = true
+
+		current, exists := published[username]
+		if exists && current == record {
+			continue
+		}
+		if r.queued(ctx, username) {
+			continue
+		}
+		if !r.dryRun {
+			if _, err := r.dns.Set(detail.Username, instructions); err != nil {
+				log.Printf("failed to set DNS TXT record for %v: %v", username, err)
+				report.Failed = append(report.Failed, username)
+				continue
+			}
+		}
+		if exists {
+			report.Updated = append(report.Updated, username)
+		} else {
+			report.Added = append(report.Added, username)
+		}
+	}
+
+	for username := range published {
+		if expected[username] || r.queued(ctx, username) {
+			continue
+		}
+		if !r.dryRun {
+			if err := r.dns.Remove(username); err != nil {
+				log.Printf("failed to remove DNS TXT record for %v: %v", username, err)
+				report.Failed = append(report.Failed, username)
+				continue
+			}
+		}
+		report.Removed = append(report.Removed, username)
+	}
+
+	if r.dryRun {
+		log.Printf("DNS reconcile (dry run): would add %v, update %v, remove %v, failed %v",
+			report.Added, report.Updated, report.Removed, report.Failed)
+	} else if report.HasChanges() || len(report.Failed) > 0 {
+		log.Printf("DNS reconcile: added %v, updated %v, removed %v, failed %v",
+			report.Added, report.Updated, report.Removed, report.Failed)
+	}
+	return report, nil
+}
+
+// queued returns whether a change of the username is still to be applied by the queue.
+func (r *Reconciler) queued(ctx context.Context, username string) bool {
+	update, err := r.store.Dns.Get(ctx, username)
+	if err != nil {
+		log.Printf("failed to get the queued DNS update of %v: %v", username, err)
+		return true
+	}
+	return update != nil && (update.Status == dnsstore.StatusPending || update.Status == dnsstore.StatusVerifying)
+}
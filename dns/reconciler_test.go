@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/breez/breez-lnurl/persist"
+	dnsstore "github.com/breez/breez-lnurl/persist/dns"
+	lnurl "github.com/breez/breez-lnurl/persist/lnurl"
+	"gotest.tools/assert"
+)
+
+type memoryDns struct {
+	externalURL *url.URL
+	records     map[string]string
+}
+
+func (m *memoryDns) Set(username string, instructions PaymentInstructions) (uint32, error) {
+	record, err := Record(m.externalURL, username, instructions)
+	if err != nil {
+		return 0, err
+	}
+	m.records[username] = record
+	return 3600, nil
+}
+
+func (m *memoryDns) Remove(username string) error {
+	delete(m.records, username)
+	return nil
+}
+
+func (m *memoryDns) List() (map[string]string, error) {
+	records := make(map[string]string)
+	for username, record := range m.records {
+		records[username] = record
+	}
+	return records, nil
+}
+
+func setupReconcile(t *testing.T) (*memoryDns, *persist.Store, *url.URL) {
+	externalURL, err := url.Parse("https://breez.domain")
+	assert.NilError(t, err, "failed to parse url")
+
+	storage := persist.NewMemoryStore()
+	store := storage.LnUrl
+	offer := testOffer
+	_, err = store.SetPubkeyDetails(context.Background(), "02c811e575be2df47d8b48dab3d3f1c9b0f6e16d0d40b5ed78253308fc2bd7170d", "missinguser", &offer)
+	assert.NilError(t, err, "failed to set pubkey details")
+	_, err = store.SetPubkeyDetails(context.Background(), "03d749c8b0bec96c34b7e9243953b45e61abbc086acbdc9c9992c59c63e370d667", "driftuser", &offer)
+	assert.NilError(t, err, "failed to set pubkey details")
+	err = store.SetPaymentInstructions(context.Background(), "03d749c8b0bec96c34b7e9243953b45e61abbc086acbdc9c9992c59c63e370d667", lnurl.PaymentInstructions{LnurlFallback: true})
+	assert.NilError(t, err, "failed to set payment instructions")
+	_, err = store.SetPubkeyDetails(context.Background(), "032c711e575be2df47d8b48dab3d3f1c9b0f6e16d0d40b5ed78253308fc2bd7170", "syncuser", &offer)
+	assert.NilError(t, err, "failed to set pubkey details")
+
+	syncRecord, err := Record(externalURL, "syncuser", PaymentInstructions{Offer: offer})
+	assert.NilError(t, err, "failed to build record")
+	dns := &memoryDns{
+		externalURL: externalURL,
+		records: map[string]string{
+			"syncuser":  syncRecord,
+			"driftuser": "bitcoin:?lno=lnooldoffer",
+			"staleuser": "bitcoin:?lno=lnostaleoffer",
+		},
+	}
+	return dns, storage, externalURL
+}
+
+func TestReconcile(t *testing.T) {
+	dns, store, externalURL := setupReconcile(t)
+
+	report, err := NewReconciler(dns, store, externalURL, false).Reconcile(context.Background())
+	assert.NilError(t, err, "failed to reconcile")
+	assert.DeepEqual(t, report.Added, []string{"missinguser"})
+	assert.DeepEqual(t, report.Updated, []string{"driftuser"})
+	assert.DeepEqual(t, report.Removed, []string{"staleuser"})
+	assert.Equal(t, len(report.Failed), 0)
+
+	assert.Equal(t, len(dns.records), 3)
+	_, exists := dns.records["staleuser"]
+	assert.Check(t, !exists, "stale record should be removed")
+	expected, _ := Record(externalURL, "driftuser", PaymentInstructions{Offer: testOffer, LnurlFallback: true})
+	assert.Equal(t, dns.records["driftuser"], expected)
+
+	// A second run has nothing left to repair
+	report, err = NewReconciler(dns, store, externalURL, false).Reconcile(context.Background())
+	assert.NilError(t, err, "failed to reconcile")
+	assert.Check(t, !report.HasChanges(), "zone should be in sync")
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	dns, store, externalURL := setupReconcile(t)
+	before, _ := dns.List()
+
+	report, err := NewReconciler(dns, store, externalURL, true).Reconcile(context.Background())
+	assert.NilError(t, err, "failed to reconcile")
+	assert.DeepEqual(t, report.Added, []string{"missinguser"})
+	assert.DeepEqual(t, report.Updated, []string{"driftuser"})
+	assert.DeepEqual(t, report.Removed, []string{"staleuser"})
+	assert.DeepEqual(t, dns.records, before)
+}
+
+func TestReconcileQueued(t *testing.T) {
+	dns, store, externalURL := setupReconcile(t)
+
+	// The changes still queued are left to the queue
+	offer := "lnonewoffer"
+	err := store.Dns.Enqueue(context.Background(), dnsstore.Update{Username: "missinguser", Pubkey: "02c811e575be2df47d8b48dab3d3f1c9b0f6e16d0d40b5ed78253308fc2bd7170d", Action: dnsstore.ActionSet, Offer: &offer})
+	assert.NilError(t, err, "failed to enqueue update")
+	err = store.Dns.Enqueue(context.Background(), dnsstore.Update{Username: "staleuser", Pubkey: "03d749c8b0bec96c34b7e9243953b45e61abbc086acbdc9c9992c59c63e370d667", Action: dnsstore.ActionSet, Offer: &offer})
+	assert.NilError(t, err, "failed to enqueue update")
+
+	report, err := NewReconciler(dns, store, externalURL, false).Reconcile(context.Background())
+	assert.NilError(t, err, "failed to reconcile")
+	assert.Equal(t, len(report.Added), 0)
+	assert.DeepEqual(t, report.Updated, []string{"driftuser"})
+	assert.Equal(t, len(report.Removed), 0)
+	_, exists := dns.records["staleuser"]
+	assert.Check(t, exists, "queued record should be kept")
+}
+
+func TestClaimReconcile(t *testing.T) {
+	store := dnsstore.NewMemoryStore()
+	now := time.Now()
+
+	claimed, err := store.ClaimReconcile(context.Background(), now, time.Hour)
+	assert.NilError(t, err, "failed to claim")
+	assert.Check(t, claimed, "first claim should succeed")
+
+	// Another instance skips the run until the interval elapsed
+	claimed, err = store.ClaimReconcile(context.Background(), now.Add(time.Minute), time.Hour)
+	assert.NilError(t, err, "failed to claim")
+	assert.Check(t, !claimed, "claim should be held")
+
+	claimed, err = store.ClaimReconcile(context.Background(), now.Add(time.Hour), time.Hour)
+	assert.NilError(t, err, "failed to claim")
+	assert.Check(t, claimed, "claim should be due")
+}
@@ -0,0 +1,141 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type restRecord struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Ttl     uint32 `json:"ttl,omitempty"`
+	Content string `json:"content"`
+}
+
+func NewRestDns(externalURL *url.URL, recordURL, listURL, token string) *RestDns {
+	return &RestDns{
+		externalURL: externalURL,
+		recordURL:   recordURL,
+		listURL:     listURL,
+		token:       token,
+		httpClient:  &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+/*
+RestDns manages the BIP353 records through a generic HTTP API:
+  - Set sends a PUT with the JSON record to the record URL.
+  - Remove sends a DELETE to the record URL.
+  - List sends a GET to the list URL, expecting a JSON array of records.
+
+The record URL is a template where {name} is replaced by the record name
+and {username} by the username.
+*/
+type RestDns struct {
+	externalURL *url.URL
+	recordURL   string
+	listURL     string
+	token       string
+	httpClient  *http.Client
+}
+
+func (r *RestDns) Set(username string, instructions PaymentInstructions) (uint32, error) {
+	ttl := uint32(3600)
+	txt, err := Record(r.externalURL, username, instructions)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := json.Marshal(restRecord{
+		Name:    bip353Name(r.externalURL.Host, username),
+		Type:    "TXT",
+		Ttl:     ttl,
+		Content: txt,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err = r.do("PUT", r.recordURLFor(username), body); err != nil {
+		log.Printf("DNS API update failed: %v", err)
+		return 0, err
+	}
+	log.Printf("DNS API update success (Set): %v", username)
+
+	return ttl, nil
+}
+
+func (r *RestDns) Remove(username string) error {
+	if _, err := r.do("DELETE", r.recordURLFor(username), nil); err != nil {
+		log.Printf("DNS API update failed: %v", err)
+		return err
+	}
+	log.Printf("DNS API update success (Remove): %v", username)
+
+	return nil
+}
+
+func (r *RestDns) List() (map[string]string, error) {
+	body, err := r.do("GET", r.listURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []restRecord
+	if err := json.Unmarshal(body, &rrs); err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]string)
+	for _, rr := range rrs {
+		if rr.Type != "TXT" {
+			continue
+		}
+		if username, ok := bip353Username(r.externalURL.Host, rr.Name); ok {
+			records[username] = rr.Content
+		}
+	}
+	return records, nil
+}
+
+func (r *RestDns) recordURLFor(username string) string {
+	return strings.NewReplacer(
+		"{name}", url.PathEscape(bip353Name(r.externalURL.Host, username)),
+		"{username}", url.PathEscape(username),
+	).Replace(r.recordURL)
+}
+
+func (r *RestDns) do(method, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", r.token))
+	}
+
+	res, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	// Removing a record that does not exist is not an error
+	if method == "DELETE" && res.StatusCode == http.StatusNotFound {
+		return resBody, nil
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("server replied: %d %s", res.StatusCode, strings.TrimSpace(string(resBody)))
+	}
+	return resBody, nil
+}
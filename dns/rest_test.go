@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// fakeRestDns implements a generic records API keyed by record name.
+type fakeRestDns struct {
+	sync.Mutex
+	records map[string]restRecord
+}
+
+func (f *fakeRestDns) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/records/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/records":
+		records := []restRecord{}
+		for _, record := range f.records {
+			records = append(records, record)
+		}
+		json.NewEncoder(w).Encode(records)
+	case r.Method == "PUT":
+		var record restRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil || record.Name != name {
+			http.Error(w, "invalid record", http.StatusBadRequest)
+			return
+		}
+		f.records[name] = record
+	case r.Method == "DELETE":
+		if _, ok := f.records[name]; !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		delete(f.records, name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRestDns(t *testing.T) {
+	fake := &fakeRestDns{records: make(map[string]restRecord)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	externalURL, _ := url.Parse("https://breez.domain")
+	restDns := NewRestDns(externalURL, server.URL+"/records/{name}", server.URL+"/records", "secret")
+	bitcoinAddress := testBitcoinAddress
+	instructions := PaymentInstructions{Offer: testOffer, BitcoinAddress: &bitcoinAddress}
+
+	ttl, err := restDns.Set("testuser", instructions)
+	assert.NilError(t, err, "failed to set record")
+	assert.Equal(t, ttl, uint32(3600))
+	assert.Equal(t, fake.records["testuser.user._bitcoin-payment.breez.domain."].Type, "TXT")
+
+	records, err := restDns.List()
+	assert.NilError(t, err, "failed to list records")
+	expected, _ := Record(externalURL, "testuser", instructions)
+	assert.DeepEqual(t, records, map[string]string{"testuser": expected})
+
+	err = restDns.Remove("testuser")
+	assert.NilError(t, err, "failed to remove record")
+	assert.Equal(t, len(fake.records), 0)
+
+	// Removing a missing record succeeds
+	err = restDns.Remove("testuser")
+	assert.NilError(t, err, "failed to remove missing record")
+
+	_, err = NewRestDns(externalURL, server.URL+"/records/{name}", server.URL+"/records", "").Set("testuser", instructions)
+	assert.ErrorContains(t, err, "401")
+}
@@ -0,0 +1,239 @@
+package dns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The DS records of the root zone key signing keys (KSK-2017 and KSK-2024).
+var RootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// The maximum number of zones walked up from the record to a trust anchor.
+const maxChainLength = 16
+
+var errUnsigned = errors.New("no valid RRSIG")
+
+var verifyMetrics = expvar.NewMap("dns_verify")
+
+/*
+Verifier checks the published BIP353 records are resolvable through the
+configured resolver and validates their DNSSEC chain of trust, from the
+record RRSIG up to the trust anchors.
+*/
+type Verifier struct {
+	externalURL *url.URL
+	resolver    string
+	anchors     map[string][]*dns.DS
+	client      *dns.Client
+}
+
+/*
+NewVerifier creates a verifier querying the resolver (host:port). The trust
+anchors are DS records in zone file format, the root trust anchors are used
+if none is provided.
+*/
+func NewVerifier(externalURL *url.URL, resolver string, trustAnchors []string) (*Verifier, error) {
+	if len(trustAnchors) == 0 {
+		trustAnchors = RootTrustAnchors
+	}
+	anchors := make(map[string][]*dns.DS)
+	for _, anchor := range trustAnchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %v: %w", anchor, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("trust anchor %v is not a DS record", anchor)
+		}
+		zone := strings.ToLower(ds.Hdr.Name)
+		anchors[zone] = append(anchors[zone], ds)
+	}
+	return &Verifier{
+		externalURL: externalURL,
+		resolver:    resolver,
+		anchors:     anchors,
+		client:      &dns.Client{Net: "tcp", Timeout: 10 * time.Second},
+	}, nil
+}
+
+/*
+Verify checks the TXT record of the username matches the payment instructions
+and is signed by a chain of keys leading to a trust anchor.
+*/
+func (v *Verifier) Verify(username string, instructions PaymentInstructions) error {
+	expected, err := Record(v.externalURL, username, instructions)
+	if err != nil {
+		return err
+	}
+
+	name := bip353Name(v.externalURL.Host, username)
+	rrset, sigs, err := v.lookup(name, dns.TypeTXT)
+	if err != nil {
+		return err
+	}
+	if len(rrset) == 0 {
+		return fmt.Errorf("no TXT record found for %v", name)
+	}
+	if len(rrset) > 1 {
+		return fmt.Errorf("multiple TXT records found for %v", name)
+	}
+	if txt := strings.Join(rrset[0].(*dns.TXT).Txt, ""); txt != expected {
+		return fmt.Errorf("TXT record of %v does not match: %v", name, txt)
+	}
+	return v.verifyChain(name, rrset, sigs)
+}
+
+/*
+verifyChain validates the RRset with the DNSKEY set of its signer zone, then
+the DNSKEY set with the DS set of the parent zone, until reaching a zone with
+a trust anchor.
+*/
+func (v *Verifier) verifyChain(owner string, rrset []dns.RR, sigs []*dns.RRSIG) error {
+	for i := 0; i < maxChainLength; i++ {
+		if len(sigs) == 0 {
+			return fmt.Errorf("%w for %v", errUnsigned, owner)
+		}
+		zone := strings.ToLower(sigs[0].SignerName)
+		if !dns.IsSubDomain(zone, owner) {
+			return fmt.Errorf("signer %v is not a parent of %v", zone, owner)
+		}
+
+		keyset, keySigs, err := v.lookup(zone, dns.TypeDNSKEY)
+		if err != nil {
+			return err
+		}
+		keys := dnskeys(keyset)
+		if _, err := verifyRRset(rrset, sigs, keys); err != nil {
+			return fmt.Errorf("%v of %v: %w", dns.TypeToString[rrset[0].Header().Rrtype], owner, err)
+		}
+		// The DNSKEY set is signed by the key signing keys referenced in the parent zone
+		signingKeys, err := verifyRRset(keyset, keySigs, keys)
+		if err != nil {
+			return fmt.Errorf("DNSKEY of %v: %w", zone, err)
+		}
+
+		if anchors, ok := v.anchors[zone]; ok {
+			if !matchesDS(signingKeys, anchors) {
+				return fmt.Errorf("no DNSKEY of %v matches the trust anchors", zone)
+			}
+			return nil
+		}
+		if zone == "." {
+			return errors.New("no trust anchor for the root zone")
+		}
+
+		dsset, dsSigs, err := v.lookup(zone, dns.TypeDS)
+		if err != nil {
+			return err
+		}
+		var ds []*dns.DS
+		for _, rr := range dsset {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		if !matchesDS(signingKeys, ds) {
+			return fmt.Errorf("no DNSKEY of %v matches its DS records", zone)
+		}
+		if len(dsSigs) > 0 && strings.EqualFold(dsSigs[0].SignerName, zone) {
+			return fmt.Errorf("DS of %v is not signed by its parent zone", zone)
+		}
+		owner, rrset, sigs = zone, dsset, dsSigs
+	}
+	return fmt.Errorf("chain of trust longer than %v zones", maxChainLength)
+}
+
+// lookup returns the records of the name and type and their signatures.
+func (v *Verifier) lookup(name string, qtype uint16) ([]dns.RR, []*dns.RRSIG, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(4096, true)
+	// Validation is done here, get the records even if the resolver finds them bogus
+	m.CheckingDisabled = true
+
+	reply, _, err := v.client.Exchange(m, v.resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return nil, nil, fmt.Errorf("%v %v: resolver replied: %s", name, dns.TypeToString[qtype], dns.RcodeToString[reply.Rcode])
+	}
+
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range reply.Answer {
+		if !strings.EqualFold(rr.Header().Name, dns.Fqdn(name)) {
+			continue
+		}
+		switch r := rr.(type) {
+		case *dns.RRSIG:
+			if r.TypeCovered == qtype {
+				sigs = append(sigs, r)
+			}
+		default:
+			if rr.Header().Rrtype == qtype {
+				rrset = append(rrset, rr)
+			}
+		}
+	}
+	if len(rrset) == 0 && qtype != dns.TypeTXT {
+		return nil, nil, fmt.Errorf("no %v record found for %v", dns.TypeToString[qtype], name)
+	}
+	return rrset, sigs, nil
+}
+
+// verifyRRset returns the keys with a valid signature of the RRset.
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) ([]*dns.DNSKEY, error) {
+	now := time.Now()
+	var signingKeys []*dns.DNSKEY
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm ||
+				!strings.EqualFold(key.Hdr.Name, sig.SignerName) {
+				continue
+			}
+			if err := sig.Verify(key, rrset); err == nil {
+				signingKeys = append(signingKeys, key)
+			}
+		}
+	}
+	if len(signingKeys) == 0 {
+		return nil, errUnsigned
+	}
+	return signingKeys, nil
+}
+
+func matchesDS(keys []*dns.DNSKEY, dsset []*dns.DS) bool {
+	for _, ds := range dsset {
+		for _, key := range keys {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			if keyDS := key.ToDS(ds.DigestType); keyDS != nil && strings.EqualFold(keyDS.Digest, ds.Digest) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func dnskeys(rrset []dns.RR) []*dns.DNSKEY {
+	var keys []*dns.DNSKEY
+	for _, rr := range rrset {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,178 @@
+package dns
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	dnsstore "github.com/breez/breez-lnurl/persist/dns"
+	"github.com/miekg/dns"
+	"gotest.tools/assert"
+)
+
+type zoneKey struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+/*
+signedZone serves the BIP353 zone of breez.domain signed by its own key,
+delegated from the breez.domain zone used as trust anchor.
+*/
+type signedZone struct {
+	t        *testing.T
+	parent   zoneKey
+	child    zoneKey
+	records  map[string]string
+	unsigned map[string]bool
+	address  string
+}
+
+func newZoneKey(t *testing.T, zone string) zoneKey {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	assert.NilError(t, err, "failed to generate key")
+	return zoneKey{key: key, signer: private.(crypto.Signer)}
+}
+
+func (k zoneKey) sign(t *testing.T, rrset []dns.RR) []dns.RR {
+	name := rrset[0].Header().Name
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		TypeCovered: rrset[0].Header().Rrtype,
+		Algorithm:   k.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(name)),
+		OrigTtl:     3600,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      k.key.KeyTag(),
+		SignerName:  k.key.Hdr.Name,
+	}
+	assert.NilError(t, sig.Sign(k.signer, rrset), "failed to sign")
+	return append(rrset, sig)
+}
+
+func setupSignedZone(t *testing.T, records map[string]string) *signedZone {
+	zone := &signedZone{
+		t:        t,
+		parent:   newZoneKey(t, "breez.domain."),
+		child:    newZoneKey(t, bip353Zone("breez.domain")),
+		records:  records,
+		unsigned: make(map[string]bool),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err, "failed to listen")
+	server := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(zone.serve)}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	zone.address = listener.Addr().String()
+	return zone
+}
+
+func (z *signedZone) serve(w dns.ResponseWriter, req *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	question := req.Question[0]
+	name := strings.ToLower(question.Name)
+
+	switch {
+	case question.Qtype == dns.TypeDNSKEY && name == z.parent.key.Hdr.Name:
+		reply.Answer = z.parent.sign(z.t, []dns.RR{z.parent.key})
+	case question.Qtype == dns.TypeDNSKEY && name == z.child.key.Hdr.Name:
+		reply.Answer = z.child.sign(z.t, []dns.RR{z.child.key})
+	case question.Qtype == dns.TypeDS && name == z.child.key.Hdr.Name:
+		reply.Answer = z.parent.sign(z.t, []dns.RR{z.child.key.ToDS(dns.SHA256)})
+	case question.Qtype == dns.TypeTXT:
+		username, ok := bip353Username("breez.domain", name)
+		txt, exists := z.records[username]
+		if !ok || !exists {
+			break
+		}
+		rrset := []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 3600},
+			Txt: chunks(txt, 255),
+		}}
+		if !z.unsigned[username] {
+			rrset = z.child.sign(z.t, rrset)
+		}
+		reply.Answer = rrset
+	}
+	w.WriteMsg(reply)
+}
+
+func (z *signedZone) verifier(t *testing.T, externalURL *url.URL) *Verifier {
+	verifier, err := NewVerifier(externalURL, z.address, []string{z.parent.key.ToDS(dns.SHA256).String()})
+	assert.NilError(t, err, "failed to create verifier")
+	return verifier
+}
+
+func TestVerify(t *testing.T) {
+	externalURL, err := url.Parse("https://breez.domain")
+	assert.NilError(t, err, "failed to parse url")
+	instructions := PaymentInstructions{Offer: testOffer}
+	record, err := Record(externalURL, "testuser", instructions)
+	assert.NilError(t, err, "failed to build record")
+	zone := setupSignedZone(t, map[string]string{
+		"testuser":     record,
+		"unsigneduser": record,
+	})
+	zone.unsigned["unsigneduser"] = true
+	verifier := zone.verifier(t, externalURL)
+
+	assert.NilError(t, verifier.Verify("testuser", instructions))
+
+	err = verifier.Verify("testuser", PaymentInstructions{Offer: testOffer, LnurlFallback: true})
+	assert.ErrorContains(t, err, "does not match")
+
+	err = verifier.Verify("missinguser", instructions)
+	assert.ErrorContains(t, err, "no TXT record found")
+
+	err = verifier.Verify("unsigneduser", PaymentInstructions{Offer: testOffer})
+	assert.ErrorContains(t, err, errUnsigned.Error())
+
+	// A chain leading to another key is not trusted
+	other := newZoneKey(t, "breez.domain.")
+	verifier, err = NewVerifier(externalURL, zone.address, []string{other.key.ToDS(dns.SHA256).String()})
+	assert.NilError(t, err, "failed to create verifier")
+	err = verifier.Verify("testuser", instructions)
+	assert.ErrorContains(t, err, "trust anchors")
+}
+
+func TestQueueVerify(t *testing.T) {
+	QueueVerifyDelay = 0
+	QueueRetryBaseDelay = 0
+	defer func() {
+		QueueVerifyDelay = 30 * time.Second
+		QueueRetryBaseDelay = 10 * time.Second
+	}()
+
+	_, dns, store := setupQueue(t, 0)
+	zone := setupSignedZone(t, dns.records)
+	queue := NewQueue(dns, zone.verifier(t, dns.externalURL), store)
+	ctx := context.Background()
+
+	err := queue.Set(ctx, "pubkey", "testuser", PaymentInstructions{Offer: testOffer})
+	assert.NilError(t, err, "failed to queue update")
+	assert.Assert(t, queue.processNext(ctx), "update should be processed")
+	assertStatus(t, queue, "testuser", dnsstore.StatusVerifying)
+
+	// The record is not signed yet, verification is retried
+	zone.unsigned["testuser"] = true
+	assert.Assert(t, queue.processNext(ctx), "update should be processed")
+	assertStatus(t, queue, "testuser", dnsstore.StatusVerifying)
+
+	delete(zone.unsigned, "testuser")
+	assert.Assert(t, queue.processNext(ctx), "update should be processed")
+	assertStatus(t, queue, "testuser", dnsstore.StatusVerified)
+	assert.Assert(t, !queue.processNext(ctx), "no update should be left")
+}
@@ -0,0 +1,87 @@
+package lnurl
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/breez/breez-lnurl/cache"
+	"github.com/breez/breez-lnurl/channel"
+	"github.com/breez/breez-lnurl/persist"
+	lnurl "github.com/breez/breez-lnurl/persist/lnurl"
+	"github.com/gorilla/mux"
+	"gotest.tools/assert"
+)
+
+// blockingChannel answers the webhook requests once released, counting them.
+type blockingChannel struct {
+	requests atomic.Int32
+	release  chan struct{}
+}
+
+func (c *blockingChannel) SendRequest(ctx context.Context, pubkey string, url string, message channel.WebhookMessage, rw http.ResponseWriter) (*channel.CallbackResponse, error) {
+	c.requests.Add(1)
+	<-c.release
+	maxAge := int64(60)
+	return &channel.CallbackResponse{Body: []byte(`{"tag":"payRequest"}`), MaxAge: &maxAge}, nil
+}
+
+func (c *blockingChannel) ValidateURL(ctx context.Context, url string) error {
+	return nil
+}
+
+func TestPayCoalesceConcurrentRequests(t *testing.T) {
+	store := persist.NewMemoryStore()
+	_, err := store.LnUrl.Set(context.Background(), lnurl.Webhook{Pubkey: "pubkey", Url: "http://webhook"})
+	assert.NilError(t, err)
+	webhookChannel := &blockingChannel{release: make(chan struct{})}
+	rootURL, _ := url.Parse("http://localhost")
+	lnurlPayRouter := &LnurlPayRouter{
+		store:   store,
+		cache:   cache.NewCache(time.Minute),
+		channel: webhookChannel,
+		rootURL: rootURL,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/lnurlp/{identifier}", lnurlPayRouter.cacheMiddleware(lnurlPayRouter.HandleLnurlPay))
+
+	// A canceled request doesn't cancel the shared webhook request
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan struct{})
+	go func() {
+		defer close(canceled)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/lnurlp/pubkey", nil).WithContext(ctx))
+	}()
+	for webhookChannel.requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-canceled
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 10)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			router.ServeHTTP(responses[i], httptest.NewRequest("GET", "/lnurlp/pubkey", nil))
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(webhookChannel.release)
+	wg.Wait()
+
+	assert.Equal(t, webhookChannel.requests.Load(), int32(1), "concurrent requests should share a webhook request")
+	for _, response := range responses {
+		assert.Equal(t, response.Body.String(), `{"tag":"payRequest"}`)
+	}
+	cached := lnurlPayRouter.getCached("/lnurlp/pubkey")
+	assert.Check(t, cached != nil, "response should be cached")
+	assert.Equal(t, string(cached.Body), `{"tag":"payRequest"}`)
+}
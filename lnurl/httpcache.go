@@ -0,0 +1,217 @@
+package lnurl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/breez/breez-lnurl/channel"
+	"golang.org/x/sync/singleflight"
+)
+
+// The duration an expired response is still served while refreshed through the webhook.
+var StaleWhileRevalidate time.Duration = time.Minute
+
+// cachedResponse is a webhook response cached for the max-age set by the app.
+type cachedResponse struct {
+	Body     []byte `json:"body"`
+	MaxAge   int64  `json:"max_age"`
+	StoredAt int64  `json:"stored_at"`
+}
+
+/*
+cacheKey returns the cache key of the request: its path and its query with
+the parameters sorted, so their order doesn't split the entries.
+*/
+func cacheKey(r *http.Request) string {
+	query := r.URL.Query()
+	if len(query) == 0 {
+		return r.URL.Path
+	}
+	return r.URL.Path + "?" + query.Encode()
+}
+
+/*
+cacheMiddleware serves the cached responses. A response past its max-age is
+still served during the stale-while-revalidate window, while refreshed in
+the background.
+*/
+func (l *LnurlPayRouter) cacheMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := cacheKey(r)
+		entry := l.getCached(key)
+		if entry == nil {
+			next(w, r)
+			return
+		}
+
+		age := time.Now().Unix() - entry.StoredAt
+		if age > entry.MaxAge {
+			log.Printf("Cache stale for %s, revalidating", key)
+			l.revalidate(key, next, r)
+		} else {
+			log.Printf("Cache hit for %s", key)
+		}
+		writeCacheableResponse(w, r, entry.Body, &entry.MaxAge, max(age, 0))
+	})
+}
+
+func (l *LnurlPayRouter) getCached(key string) *cachedResponse {
+	data := l.cache.Get(key)
+	if data == nil {
+		return nil
+	}
+	var entry cachedResponse
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Body == nil {
+		return nil
+	}
+	return &entry
+}
+
+/*
+updateCache caches the response for the max-age set by the app, plus the
+stale-while-revalidate window, indexed by the pubkey of the webhook. A
+response without max-age removes the cached response. A response requested
+before the cache of the pubkey was invalidated is rejected by the cache.
+*/
+func (l *LnurlPayRouter) updateCache(key string, owner string, requestedAt time.Time, response *channel.CallbackResponse) {
+	if response.MaxAge == nil || *response.MaxAge <= 0 {
+		l.cache.Delete(key)
+		return
+	}
+	maxAge := *response.MaxAge
+	data, err := json.Marshal(cachedResponse{
+		Body:     response.Body,
+		MaxAge:   maxAge,
+		StoredAt: time.Now().Unix(),
+	})
+	if err != nil {
+		log.Printf("failed to marshal cached response for %s: %v", key, err)
+		return
+	}
+	log.Printf("Cache response for %v seconds for %s", maxAge, key)
+	l.cache.SetOwned(key, owner, data, time.Second*time.Duration(maxAge)+StaleWhileRevalidate, requestedAt)
+}
+
+/*
+invalidateCache removes the cached responses of the owner, and prevents
+caching the responses in flight. The requests in flight are forgotten, so
+the following requests are sent again.
+*/
+func (l *LnurlPayRouter) invalidateCache(owner string) {
+	l.cache.DeleteOwned(owner)
+	l.flights.forget(owner, &l.inflight)
+}
+
+// ownerFlights tracks the keys of the webhook requests in flight per owner.
+type ownerFlights struct {
+	mu   sync.Mutex
+	keys map[string]map[string]int
+}
+
+func (f *ownerFlights) add(owner string, key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.keys == nil {
+		f.keys = make(map[string]map[string]int)
+	}
+	if f.keys[owner] == nil {
+		f.keys[owner] = make(map[string]int)
+	}
+	f.keys[owner][key]++
+}
+
+// done removes the request, and the owner once it has no request in flight.
+func (f *ownerFlights) done(owner string, key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := f.keys[owner]
+	if keys[key]--; keys[key] <= 0 {
+		delete(keys, key)
+	}
+	if len(keys) == 0 {
+		delete(f.keys, owner)
+	}
+}
+
+func (f *ownerFlights) forget(owner string, group *singleflight.Group) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key := range f.keys[owner] {
+		group.Forget(key)
+	}
+}
+
+/*
+revalidate refreshes the cached response in the background, running the
+handler without the client. A single revalidation runs per key.
+*/
+func (l *LnurlPayRouter) revalidate(key string, next http.HandlerFunc, r *http.Request) {
+	if _, running := l.revalidating.LoadOrStore(key, true); running {
+		return
+	}
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.Header.Del("If-None-Match")
+	go func() {
+		defer l.revalidating.Delete(key)
+		next(&discardResponseWriter{header: make(http.Header)}, req)
+	}()
+}
+
+/*
+writeCacheableResponse writes the response with the caching headers for the
+payers and the CDNs: Cache-Control from the max-age set by the app, Age and
+ETag. A request with a matching If-None-Match gets a 304.
+*/
+func writeCacheableResponse(w http.ResponseWriter, r *http.Request, body []byte, maxAge *int64, age int64) {
+	if maxAge == nil || *maxAge <= 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(body)
+		return
+	}
+
+	tag := etag(body)
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d", *maxAge, int64(StaleWhileRevalidate.Seconds())))
+	w.Header().Set("Age", fmt.Sprintf("%d", age))
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// etag returns a strong entity tag of the body.
+func etag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// etagMatches returns whether the If-None-Match header matches the entity tag, weakly compared.
+func etagMatches(ifNoneMatch string, tag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// discardResponseWriter is the response writer of the background revalidations.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponseWriter) WriteHeader(int)             {}
@@ -0,0 +1,85 @@
+package lnurl
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/breez/breez-lnurl/cache"
+	"github.com/breez/breez-lnurl/persist"
+	lnurl "github.com/breez/breez-lnurl/persist/lnurl"
+	"github.com/gorilla/mux"
+	"gotest.tools/assert"
+)
+
+func TestCacheKey(t *testing.T) {
+	a := httptest.NewRequest("GET", "/lnurlpay/alice/hash?b=2&a=1", nil)
+	b := httptest.NewRequest("GET", "/lnurlpay/alice/hash?a=1&b=2", nil)
+	assert.Equal(t, cacheKey(a), cacheKey(b))
+	assert.Equal(t, cacheKey(httptest.NewRequest("GET", "/lnurlp/alice", nil)), "/lnurlp/alice")
+}
+
+func TestEtagMatches(t *testing.T) {
+	tag := etag([]byte("body"))
+	assert.Check(t, etagMatches(tag, tag))
+	assert.Check(t, etagMatches(`"other", W/`+tag, tag), "weak and listed tags should match")
+	assert.Check(t, etagMatches("*", tag))
+	assert.Check(t, !etagMatches(`"other"`, tag))
+	assert.Check(t, !etagMatches("", tag))
+}
+
+func TestPayHttpCaching(t *testing.T) {
+	store := persist.NewMemoryStore()
+	_, err := store.LnUrl.Set(context.Background(), lnurl.Webhook{Pubkey: "pubkey", Url: "http://webhook"})
+	assert.NilError(t, err)
+	webhookChannel := &blockingChannel{release: make(chan struct{})}
+	close(webhookChannel.release)
+	rootURL, _ := url.Parse("http://localhost")
+	lnurlPayRouter := &LnurlPayRouter{
+		store:   store,
+		cache:   cache.NewCache(time.Minute),
+		channel: webhookChannel,
+		rootURL: rootURL,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/lnurlp/{identifier}", lnurlPayRouter.cacheMiddleware(lnurlPayRouter.HandleLnurlPay))
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/lnurlp/pubkey", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	first := get("")
+	assert.Equal(t, first.Code, http.StatusOK)
+	assert.Equal(t, first.Header().Get("Cache-Control"), "public, max-age=60, stale-while-revalidate=60")
+	tag := first.Header().Get("ETag")
+	assert.Check(t, tag != "")
+
+	cached := get(tag)
+	assert.Equal(t, cached.Code, http.StatusNotModified)
+	assert.Equal(t, cached.Body.Len(), 0)
+	assert.Equal(t, webhookChannel.requests.Load(), int32(1), "cached response should not reach the webhook")
+
+	// A stale response is served, and refreshed in the background
+	data, _ := json.Marshal(cachedResponse{Body: []byte(`{"tag":"stale"}`), MaxAge: 60, StoredAt: time.Now().Add(-90 * time.Second).Unix()})
+	lnurlPayRouter.cache.Set("/lnurlp/pubkey", data, time.Minute)
+	stale := get("")
+	assert.Equal(t, stale.Body.String(), `{"tag":"stale"}`)
+	assert.Equal(t, stale.Header().Get("Age"), "90")
+	for i := 0; i < 100 && webhookChannel.requests.Load() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, webhookChannel.requests.Load(), int32(2), "stale response should be revalidated")
+	for i := 0; i < 100 && string(lnurlPayRouter.getCached("/lnurlp/pubkey").Body) == `{"tag":"stale"}`; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, get("").Body.String(), `{"tag":"payRequest"}`)
+}
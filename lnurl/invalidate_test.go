@@ -0,0 +1,182 @@
+package lnurl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/breez/breez-lnurl/cache"
+	"github.com/breez/breez-lnurl/dns"
+	"github.com/breez/breez-lnurl/persist"
+	"github.com/breez/lspd/lightning"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/gorilla/mux"
+	"github.com/tv42/zbase32"
+	"gotest.tools/assert"
+)
+
+func signMessage(privKey *secp256k1.PrivateKey, message string) string {
+	msg := append(lightning.SignedMsgPrefix, []byte(message)...)
+	first := sha256.Sum256(msg)
+	second := sha256.Sum256(first[:])
+	sig := ecdsa.SignCompact(privKey, second[:], true)
+	return zbase32.EncodeToString(sig)
+}
+
+func setupInvalidateRouter(t *testing.T, webhookChannel *blockingChannel) (*LnurlPayRouter, *mux.Router) {
+	store := persist.NewMemoryStore()
+	rootURL, _ := url.Parse("http://localhost")
+	lnurlPayRouter := &LnurlPayRouter{
+		store:   store,
+		dns:     dns.NewQueue(dns.NewNoDns(), nil, store),
+		cache:   cache.NewCache(time.Minute),
+		channel: webhookChannel,
+		rootURL: rootURL,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/lnurlpay/{pubkey}", lnurlPayRouter.Register).Methods("POST")
+	router.HandleFunc("/lnurlpay/{pubkey}", lnurlPayRouter.Unregister).Methods("DELETE")
+	router.HandleFunc("/lnurlpay/{pubkey}/cache/invalidate", lnurlPayRouter.InvalidateCache).Methods("POST")
+	router.HandleFunc("/lnurlp/{identifier}", lnurlPayRouter.cacheMiddleware(lnurlPayRouter.HandleLnurlPay)).Methods("GET")
+	return lnurlPayRouter, router
+}
+
+func serve(router *mux.Router, method string, path string, payload any) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(payload)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(body)))
+	return w
+}
+
+func TestPayInvalidateCacheSignature(t *testing.T) {
+	lnurlPayRouter, router := setupInvalidateRouter(t, &blockingChannel{release: make(chan struct{})})
+	privKey, err := secp256k1.GeneratePrivateKey()
+	assert.NilError(t, err, "failed to generate private key")
+	pubkey := hex.EncodeToString(privKey.PubKey().SerializeCompressed())
+	path := fmt.Sprintf("/lnurlpay/%v/cache/invalidate", pubkey)
+	key := "/lnurlp/" + pubkey
+	lnurlPayRouter.cache.SetOwned(key, pubkey, []byte("cached"), time.Minute, time.Now())
+
+	// The signature of an unregistration is not accepted
+	now := time.Now().Unix()
+	response := serve(router, "POST", path, InvalidateCacheRequest{
+		Time:      now,
+		Signature: signMessage(privKey, fmt.Sprintf("%v-%v", now, "http://webhook")),
+	})
+	assert.Equal(t, response.Code, http.StatusUnauthorized)
+	assert.Equal(t, string(lnurlPayRouter.cache.Get(key)), "cached")
+
+	// Nor the signature of another pubkey
+	otherKey, err := secp256k1.GeneratePrivateKey()
+	assert.NilError(t, err, "failed to generate private key")
+	response = serve(router, "POST", path, InvalidateCacheRequest{
+		Time:      now,
+		Signature: signMessage(otherKey, fmt.Sprintf("%v-cache-invalidate", now)),
+	})
+	assert.Equal(t, response.Code, http.StatusUnauthorized)
+	assert.Equal(t, string(lnurlPayRouter.cache.Get(key)), "cached")
+
+	response = serve(router, "POST", path, InvalidateCacheRequest{
+		Time:      now,
+		Signature: signMessage(privKey, fmt.Sprintf("%v-cache-invalidate", now)),
+	})
+	assert.Equal(t, response.Code, http.StatusOK)
+	assert.Check(t, lnurlPayRouter.cache.Get(key) == nil, "cached response should be removed")
+}
+
+func TestPayInvalidateCacheOnRegistration(t *testing.T) {
+	lnurlPayRouter, router := setupInvalidateRouter(t, &blockingChannel{release: make(chan struct{})})
+	privKey, err := secp256k1.GeneratePrivateKey()
+	assert.NilError(t, err, "failed to generate private key")
+	pubkey := hex.EncodeToString(privKey.PubKey().SerializeCompressed())
+	path := fmt.Sprintf("/lnurlpay/%v", pubkey)
+	key := "/lnurlp/" + pubkey
+	webhookUrl := "http://webhook"
+
+	lnurlPayRouter.cache.SetOwned(key, pubkey, []byte("cached"), time.Minute, time.Now())
+	now := time.Now().Unix()
+	response := serve(router, "POST", path, RegisterLnurlPayRequest{
+		Time:       now,
+		WebhookUrl: webhookUrl,
+		Signature:  signMessage(privKey, fmt.Sprintf("%v-%v", now, webhookUrl)),
+	})
+	assert.Equal(t, response.Code, http.StatusOK)
+	assert.Check(t, lnurlPayRouter.cache.Get(key) == nil, "registering should remove the cached response")
+
+	lnurlPayRouter.cache.SetOwned(key, pubkey, []byte("cached"), time.Minute, time.Now())
+	response = serve(router, "DELETE", path, UnregisterRecoverLnurlPayRequest{
+		Time:       now,
+		WebhookUrl: webhookUrl,
+		Signature:  signMessage(privKey, fmt.Sprintf("%v-%v", now, webhookUrl)),
+	})
+	assert.Equal(t, response.Code, http.StatusOK)
+	assert.Check(t, lnurlPayRouter.cache.Get(key) == nil, "unregistering should remove the cached response")
+}
+
+func TestPayInvalidateCacheInFlight(t *testing.T) {
+	webhookChannel := &blockingChannel{release: make(chan struct{})}
+	lnurlPayRouter, router := setupInvalidateRouter(t, webhookChannel)
+	privKey, err := secp256k1.GeneratePrivateKey()
+	assert.NilError(t, err, "failed to generate private key")
+	pubkey := hex.EncodeToString(privKey.PubKey().SerializeCompressed())
+	webhookUrl := "http://webhook"
+	now := time.Now().Unix()
+	response := serve(router, "POST", "/lnurlpay/"+pubkey, RegisterLnurlPayRequest{
+		Time:       now,
+		WebhookUrl: webhookUrl,
+		Signature:  signMessage(privKey, fmt.Sprintf("%v-%v", now, webhookUrl)),
+	})
+	assert.Equal(t, response.Code, http.StatusOK)
+
+	// The cache is invalidated while the webhook request is in flight
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/lnurlp/"+pubkey, nil))
+	}()
+	for webhookChannel.requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	lnurlPayRouter.invalidateCache(pubkey)
+
+	// The requests following the invalidation don't share the request in flight
+	second := make(chan struct{})
+	go func() {
+		defer close(second)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/lnurlp/"+pubkey, nil))
+	}()
+	for webhookChannel.requests.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(webhookChannel.release)
+	<-done
+	<-second
+
+	assert.Equal(t, webhookChannel.requests.Load(), int32(2))
+	assert.Check(t, lnurlPayRouter.getCached("/lnurlp/"+pubkey) != nil, "response requested after the invalidation should be cached")
+	lnurlPayRouter.invalidateCache(pubkey)
+
+	// A response requested before the invalidation is not written back
+	webhookChannel.release = make(chan struct{})
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/lnurlp/"+pubkey, nil))
+	}()
+	for webhookChannel.requests.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	lnurlPayRouter.invalidateCache(pubkey)
+	close(webhookChannel.release)
+	<-done
+	assert.Check(t, lnurlPayRouter.getCached("/lnurlp/"+pubkey) == nil, "stale response should not be cached")
+	assert.Equal(t, len(lnurlPayRouter.flights.keys), 0, "requests in flight should be pruned")
+}
@@ -1,6 +1,7 @@
 package lnurl
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"log"
@@ -23,20 +25,25 @@ import (
 	lnurl "github.com/breez/breez-lnurl/persist/lnurl"
 	"github.com/breez/lspd/lightning"
 	"github.com/gorilla/mux"
+	"golang.org/x/sync/singleflight"
 )
 
 type RegisterLnurlPayRequest struct {
-	Time       int64   `json:"time"`
-	WebhookUrl string  `json:"webhook_url"`
-	Username   *string `json:"username"`
-	Offer      *string `json:"offer"`
-	Signature  string  `json:"signature"`
+	Time                 int64   `json:"time"`
+	WebhookUrl           string  `json:"webhook_url"`
+	Username             *string `json:"username"`
+	Offer                *string `json:"offer"`
+	BitcoinAddress       *string `json:"bitcoin_address,omitempty"`
+	SilentPaymentAddress *string `json:"silent_payment_address,omitempty"`
+	LnurlFallback        bool    `json:"lnurl_fallback,omitempty"`
+	Signature            string  `json:"signature"`
 }
 
 type RegisterRecoverLnurlPayResponse struct {
 	Lnurl            string  `json:"lnurl"`
 	LightningAddress *string `json:"lightning_address,omitempty"`
 	BIP353Address    *string `json:"bip353_address,omitempty"`
+	DnsStatus        *string `json:"dns_status,omitempty"`
 }
 
 func (w *RegisterLnurlPayRequest) Verify(pubkey string) error {
@@ -61,6 +68,20 @@ func (w *RegisterLnurlPayRequest) Verify(pubkey string) error {
 				return fmt.Errorf("invalid offer %v", offer)
 			}
 			messageToVerify = fmt.Sprintf("%v-%v", messageToVerify, offer)
+			// Validate with the additional BIP-321 payment instructions if present
+			if w.hasPaymentInstructions() {
+				instructions := w.dnsPaymentInstructions(offer)
+				if err := instructions.Validate(); err != nil {
+					return err
+				}
+				messageToVerify = fmt.Sprintf(
+					"%v-%v-%v-%v",
+					messageToVerify,
+					lnurl.ValueOrEmpty(w.BitcoinAddress),
+					lnurl.ValueOrEmpty(w.SilentPaymentAddress),
+					w.LnurlFallback,
+				)
+			}
 		}
 	}
 	verifiedPubkey, err := lightning.VerifyMessage([]byte(messageToVerify), w.Signature)
@@ -73,6 +94,27 @@ func (w *RegisterLnurlPayRequest) Verify(pubkey string) error {
 	return nil
 }
 
+func (w *RegisterLnurlPayRequest) hasPaymentInstructions() bool {
+	return w.BitcoinAddress != nil || w.SilentPaymentAddress != nil || w.LnurlFallback
+}
+
+func (w *RegisterLnurlPayRequest) paymentInstructions() lnurl.PaymentInstructions {
+	return lnurl.PaymentInstructions{
+		BitcoinAddress:       w.BitcoinAddress,
+		SilentPaymentAddress: w.SilentPaymentAddress,
+		LnurlFallback:        w.LnurlFallback,
+	}
+}
+
+func (w *RegisterLnurlPayRequest) dnsPaymentInstructions(offer string) dns.PaymentInstructions {
+	return dns.PaymentInstructions{
+		Offer:                offer,
+		BitcoinAddress:       w.BitcoinAddress,
+		SilentPaymentAddress: w.SilentPaymentAddress,
+		LnurlFallback:        w.LnurlFallback,
+	}
+}
+
 type UnregisterRecoverLnurlPayRequest struct {
 	Time       int64  `json:"time"`
 	WebhookUrl string `json:"webhook_url"`
@@ -94,6 +136,27 @@ func (w *UnregisterRecoverLnurlPayRequest) Verify(pubkey string) error {
 	return nil
 }
 
+type InvalidateCacheRequest struct {
+	Time      int64  `json:"time"`
+	Signature string `json:"signature"`
+}
+
+// Verify checks the signature of "<time>-cache-invalidate", not accepted by the other endpoints.
+func (w *InvalidateCacheRequest) Verify(pubkey string) error {
+	if math.Abs(float64(time.Now().Unix()-w.Time)) > constant.ACCEPTABLE_TIME_DIFF {
+		return errors.New("invalid time")
+	}
+	messageToVerify := fmt.Sprintf("%v-cache-invalidate", w.Time)
+	verifiedPubkey, err := lightning.VerifyMessage([]byte(messageToVerify), w.Signature)
+	if err != nil {
+		return err
+	}
+	if pubkey != hex.EncodeToString(verifiedPubkey.SerializeCompressed()) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
 type LnurlPayStatus struct {
 	Status string `json:"status"`
 	Reason string `json:"reason"`
@@ -119,13 +182,19 @@ func NewLnurlPayOkResponse(reason string) LnurlPayStatus {
 
 type LnurlPayRouter struct {
 	store   *persist.Store
-	dns     dns.DnsService
+	dns     *dns.Queue
 	cache   cache.CacheService
 	channel channel.WebhookChannel
 	rootURL *url.URL
+	// The webhook requests in flight, shared by the concurrent requests for the same url
+	inflight singleflight.Group
+	// The cache keys being revalidated in the background
+	revalidating sync.Map
+	// The keys of the webhook requests in flight of each pubkey
+	flights ownerFlights
 }
 
-func RegisterLnurlPayRouter(router *mux.Router, rootURL *url.URL, store *persist.Store, dns dns.DnsService, cache cache.CacheService, channel channel.WebhookChannel) {
+func RegisterLnurlPayRouter(router *mux.Router, rootURL *url.URL, store *persist.Store, dns *dns.Queue, cache cache.CacheService, channel channel.WebhookChannel, limiter *RateLimiter) {
 	lnurlPayRouter := &LnurlPayRouter{
 		store:   store,
 		dns:     dns,
@@ -136,23 +205,12 @@ func RegisterLnurlPayRouter(router *mux.Router, rootURL *url.URL, store *persist
 	router.HandleFunc("/lnurlpay/{pubkey}", lnurlPayRouter.Register).Methods("POST")
 	router.HandleFunc("/lnurlpay/{pubkey}", lnurlPayRouter.Unregister).Methods("DELETE")
 	router.HandleFunc("/lnurlpay/{pubkey}/recover", lnurlPayRouter.Recover).Methods("POST")
-	router.HandleFunc("/.well-known/lnurlp/{identifier}", lnurlPayRouter.cacheMiddleware(lnurlPayRouter.HandleLnurlPay)).Methods("GET")
-	router.HandleFunc("/lnurlp/{identifier}", lnurlPayRouter.cacheMiddleware(lnurlPayRouter.HandleLnurlPay)).Methods("GET")
-	router.HandleFunc("/lnurlpay/{identifier}/invoice", lnurlPayRouter.HandleInvoice).Methods("GET")
-	router.HandleFunc("/lnurlpay/{identifier}/{payment_hash}", lnurlPayRouter.cacheMiddleware(lnurlPayRouter.HandleVerify)).Methods("GET")
-}
-
-func (s *LnurlPayRouter) cacheMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		url := r.URL.String()
-		if data := s.cache.Get(url); data != nil {
-			log.Printf("Cache hit for %s", url)
-			w.Header().Add("Content-Type", "application/json")
-			w.Write(data)
-			return
-		}
-		next(w, r)
-	})
+	router.HandleFunc("/lnurlpay/{pubkey}/cache/invalidate", lnurlPayRouter.InvalidateCache).Methods("POST")
+	// The cached responses don't reach the webhook, only the other requests are rate limited
+	router.HandleFunc("/.well-known/lnurlp/{identifier}", lnurlPayRouter.cacheMiddleware(limiter.wrap(lnurlPayRouter.HandleLnurlPay))).Methods("GET")
+	router.HandleFunc("/lnurlp/{identifier}", lnurlPayRouter.cacheMiddleware(limiter.wrap(lnurlPayRouter.HandleLnurlPay))).Methods("GET")
+	router.HandleFunc("/lnurlpay/{identifier}/invoice", limiter.wrap(lnurlPayRouter.HandleInvoice)).Methods("GET")
+	router.HandleFunc("/lnurlpay/{identifier}/{payment_hash}", lnurlPayRouter.cacheMiddleware(limiter.wrap(lnurlPayRouter.HandleVerify))).Methods("GET")
 }
 
 /*
@@ -185,7 +243,7 @@ func (s *LnurlPayRouter) Recover(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	lnurlUri := fmt.Sprintf("%v/lnurlp/%v", s.rootURL, pubkey)
-	body, err := marshalRegisterRecoverLnurlPayResponse(lnurlUri, webhook.Username, webhook.Offer, s.rootURL.Host)
+	body, err := marshalRegisterRecoverLnurlPayResponse(lnurlUri, webhook.Username, webhook.Offer, s.dnsStatus(r.Context(), webhook.Username), s.rootURL.Host)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -194,6 +252,36 @@ func (s *LnurlPayRouter) Recover(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
+/*
+InvalidateCache removes the cached responses of a given pubkey, under its
+pubkey and its username, once the app changed the responses it returns.
+*/
+func (s *LnurlPayRouter) InvalidateCache(w http.ResponseWriter, r *http.Request) {
+	var invalidateRequest InvalidateCacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&invalidateRequest); err != nil {
+		log.Printf("json.NewDecoder.Decode error: %v", err)
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	params := mux.Vars(r)
+	pubkey, ok := params["pubkey"]
+	if !ok {
+		http.Error(w, "invalid pubkey", http.StatusBadRequest)
+		return
+	}
+
+	if err := invalidateRequest.Verify(pubkey); err != nil {
+		log.Printf("failed to verify cache invalidation request: %v", err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	s.invalidateCache(pubkey)
+	log.Printf("cache invalidated: pubkey:%v\n", pubkey)
+	w.WriteHeader(http.StatusOK)
+}
+
 /*
 Register adds a registration for a given pubkey and a unique identifier.
 The key enables the caller to replace existing hook without deleting it.
@@ -219,11 +307,21 @@ func (s *LnurlPayRouter) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := s.channel.ValidateURL(r.Context(), addRequest.WebhookUrl); err != nil {
+		log.Printf("rejected webhook url %v: %v", addRequest.WebhookUrl, err)
+		http.Error(w, "invalid webhook url", http.StatusBadRequest)
+		return
+	}
+
 	// Get the last updated webhook for the pubkey to use it to check if the offer has changed
 	var lastOffer *string
+	var lastInstructions lnurl.PaymentInstructions
 	lastWebhook, _ := s.store.LnUrl.GetLastUpdated(r.Context(), pubkey)
 	if lastWebhook != nil && lastWebhook.Offer != nil {
 		lastOffer = lastWebhook.Offer
+		if lastDetails, _ := s.store.LnUrl.GetPubkeyDetails(r.Context(), pubkey); lastDetails != nil {
+			lastInstructions = lastDetails.PaymentInstructions
+		}
 	}
 
 	updatedWebhook, err := s.store.LnUrl.Set(r.Context(), lnurl.Webhook{
@@ -256,44 +354,57 @@ func (s *LnurlPayRouter) Register(w http.ResponseWriter, r *http.Request) {
 		shouldSetOffer := lastWebhook == nil || lastWebhook.Offer == nil
 		username := *addRequest.Username
 		offer := *addRequest.Offer
+		instructions := addRequest.paymentInstructions()
 
 		if lastWebhook != nil && lastWebhook.Username != nil && lastWebhook.Offer != nil {
-			// If the last webhook exists, we need to check if the username or offer has changed
+			// If the last webhook exists, we need to check if the username, offer or payment instructions have changed
 			lastUsername := *lastWebhook.Username
 			lastOffer := *lastWebhook.Offer
-			shouldSetOffer = username != lastUsername || offer != lastOffer
+			shouldSetOffer = username != lastUsername || offer != lastOffer || !instructions.Equal(lastInstructions)
 
-			if shouldSetOffer {
-				if err = s.dns.Remove(lastUsername); err != nil {
-					log.Printf("failed to remove DNS TXT record for %v: %v", lastUsername, err)
+			if username != lastUsername {
+				if err = s.dns.Remove(r.Context(), pubkey, lastUsername); err != nil {
+					log.Printf("failed to queue DNS TXT record removal for %v: %v", lastUsername, err)
 				}
 			}
 		}
 
 		if shouldSetOffer {
-			ttl, err := s.dns.Set(username, offer)
-			if err != nil {
-				log.Printf("failed to set DNS TXT record for %v, %v: %v", username, offer, err)
+			if _, err = s.store.LnUrl.SetPubkeyDetails(r.Context(), pubkey, username, &offer); err != nil {
+				log.Printf("failed to set offer for %v: %v", username, err)
+			} else {
+				updatedWebhook.Offer = &offer
+			}
+			// The offer is cleared once the registration expires
+			if err = s.store.LnUrl.SetWebhookOffer(r.Context(), pubkey, addRequest.WebhookUrl, &offer); err != nil {
+				log.Printf("failed to set the offer of the registration for %v: %v", username, err)
 			}
-			if ttl != 0 {
-				// Only set the offer if the DNS service returns a TTL
-				s.store.LnUrl.SetPubkeyDetails(r.Context(), pubkey, username, &offer)
+			if err = s.store.LnUrl.SetPaymentInstructions(r.Context(), pubkey, instructions); err != nil {
+				log.Printf("failed to set payment instructions for %v: %v", username, err)
+			}
+			// The DNS TXT record is published in the background
+			if err = s.dns.Set(r.Context(), pubkey, username, addRequest.dnsPaymentInstructions(offer)); err != nil {
+				log.Printf("failed to queue DNS TXT record for %v, %v: %v", username, offer, err)
 			}
 		}
 	} else if addRequest.Offer == nil {
 		// If the offer is not set, we need to remove the DNS TXT record
 		if lastWebhook != nil && lastWebhook.Username != nil && lastWebhook.Offer != nil {
 			lastUsername := *lastWebhook.Username
-			if err = s.dns.Remove(lastUsername); err != nil {
-				log.Printf("failed to remove DNS TXT record for %v: %v", lastUsername, err)
+			if err = s.dns.Remove(r.Context(), pubkey, lastUsername); err != nil {
+				log.Printf("failed to queue DNS TXT record removal for %v: %v", lastUsername, err)
 			}
 			s.store.LnUrl.SetPubkeyDetails(r.Context(), pubkey, lastUsername, nil)
+			s.store.LnUrl.SetWebhookOffer(r.Context(), pubkey, addRequest.WebhookUrl, nil)
 		}
 	}
 
+	// The cached responses may be outdated by the registration, and served under the previous username
+	s.invalidateCache(pubkey)
+
 	log.Printf("registration added: pubkey:%v\n", pubkey)
 	lnurlUri := fmt.Sprintf("%v/lnurlp/%v", s.rootURL, pubkey)
-	body, err := marshalRegisterRecoverLnurlPayResponse(lnurlUri, updatedWebhook.Username, updatedWebhook.Offer, s.rootURL.Host)
+	body, err := marshalRegisterRecoverLnurlPayResponse(lnurlUri, updatedWebhook.Username, updatedWebhook.Offer, s.dnsStatus(r.Context(), updatedWebhook.Username), s.rootURL.Host)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -349,12 +460,14 @@ func (s *LnurlPayRouter) Unregister(w http.ResponseWriter, r *http.Request) {
 	// Remove the DNS TXT record for this username/offer
 	if webhook.Username != nil {
 		username := *webhook.Username
-		if err = s.dns.Remove(username); err != nil {
-			log.Printf("failed to remove DNS TXT record for %v: %v", username, err)
+		if err = s.dns.Remove(r.Context(), pubkey, username); err != nil {
+			log.Printf("failed to queue DNS TXT record removal for %v: %v", username, err)
 		}
 		s.store.LnUrl.SetPubkeyDetails(r.Context(), pubkey, username, nil)
 	}
 
+	s.invalidateCache(pubkey)
+
 	log.Printf("registration removed: pubkey:%v url: %v\n", pubkey, removeRequest.WebhookUrl)
 	w.WriteHeader(http.StatusOK)
 }
@@ -389,7 +502,7 @@ func (l *LnurlPayRouter) HandleLnurlPay(w http.ResponseWriter, r *http.Request)
 		},
 	}
 
-	response, err := l.channel.SendRequest(r.Context(), webhook.Url, message, w)
+	response, err := l.sendCoalesced(r, webhook, message)
 	if r.Context().Err() != nil {
 		return
 	}
@@ -398,9 +511,7 @@ func (l *LnurlPayRouter) HandleLnurlPay(w http.ResponseWriter, r *http.Request)
 		writeJsonResponse(w, NewLnurlPayErrorResponse("unavailable"))
 		return
 	}
-	l.updateCache(r.URL.String(), response)
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(response.Body)
+	writeCacheableResponse(w, r, response.Body, response.MaxAge, 0)
 }
 
 /*
@@ -462,7 +573,7 @@ func (l *LnurlPayRouter) HandleInvoice(w http.ResponseWriter, r *http.Request) {
 		message.Data["verify_url"] = verifyURL
 	}
 
-	response, err := l.channel.SendRequest(r.Context(), webhook.Url, message, w)
+	response, err := l.channel.SendRequest(r.Context(), webhook.Pubkey, webhook.Url, message, w)
 	if r.Context().Err() != nil {
 		return
 	}
@@ -471,6 +582,8 @@ func (l *LnurlPayRouter) HandleInvoice(w http.ResponseWriter, r *http.Request) {
 		writeJsonResponse(w, NewLnurlPayErrorResponse("unavailable"))
 		return
 	}
+	// Every invoice is unique, it must not be reused
+	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Add("Content-Type", "application/json")
 	w.Write(response.Body)
 }
@@ -509,7 +622,7 @@ func (l *LnurlPayRouter) HandleVerify(w http.ResponseWriter, r *http.Request) {
 			"payment_hash": paymentHash,
 		},
 	}
-	response, err := l.channel.SendRequest(r.Context(), webhook.Url, message, w)
+	response, err := l.sendCoalesced(r, webhook, message)
 	if r.Context().Err() != nil {
 		return
 	}
@@ -518,13 +631,11 @@ func (l *LnurlPayRouter) HandleVerify(w http.ResponseWriter, r *http.Request) {
 		writeJsonResponse(w, NewLnurlPayErrorResponse("unavailable"))
 		return
 	}
-	l.updateCache(r.URL.String(), response)
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(response.Body)
+	writeCacheableResponse(w, r, response.Body, response.MaxAge, 0)
 }
 
 /* helper methods */
-func marshalRegisterRecoverLnurlPayResponse(lnurlUri string, username *string, offer *string, host string) ([]byte, error) {
+func marshalRegisterRecoverLnurlPayResponse(lnurlUri string, username *string, offer *string, dnsStatus *string, host string) ([]byte, error) {
 	lnurl, err := encodeLnurl(lnurlUri)
 	if err != nil {
 		return nil, err
@@ -541,17 +652,51 @@ func marshalRegisterRecoverLnurlPayResponse(lnurlUri string, username *string, o
 		Lnurl:            lnurl,
 		LightningAddress: lightningAddress,
 		BIP353Address:    bip353Address,
+		DnsStatus:        dnsStatus,
 	})
 }
 
-func (l *LnurlPayRouter) updateCache(url string, response *channel.CallbackResponse) {
-	if response.MaxAge != nil && *response.MaxAge > 0 {
-		maxAge := *response.MaxAge
-		log.Printf("Cache response for %v seconds for %s", maxAge, url)
-		ttl := time.Second * time.Duration(maxAge)
-		l.cache.Set(url, response.Body, ttl)
-	} else {
-		l.cache.Delete(url)
+func (s *LnurlPayRouter) dnsStatus(ctx context.Context, username *string) *string {
+	if username == nil {
+		return nil
+	}
+	status, err := s.dns.Status(ctx, *username)
+	if err != nil {
+		log.Printf("failed to get DNS status for %v: %v", *username, err)
+	}
+	return status
+}
+
+/*
+sendCoalesced sends the request to the webhook, sharing a single request in
+flight between the concurrent requests for the same url. The response is
+cached once, for all of them. The requests following a cache invalidation
+don't share the requests sent before it.
+*/
+func (l *LnurlPayRouter) sendCoalesced(r *http.Request, webhook *lnurl.Webhook, message channel.WebhookMessage) (*channel.CallbackResponse, error) {
+	key := cacheKey(r)
+	resultChan := l.inflight.DoChan(key, func() (interface{}, error) {
+		l.flights.add(webhook.Pubkey, key)
+		defer l.flights.done(webhook.Pubkey, key)
+		requestedAt := time.Now()
+		// Not canceled with the request starting it, the other requests still wait for the response
+		ctx := context.WithoutCancel(r.Context())
+		response, err := l.channel.SendRequest(ctx, webhook.Pubkey, webhook.Url, message, nil)
+		if err != nil {
+			return nil, err
+		}
+		l.updateCache(key, webhook.Pubkey, requestedAt, response)
+		return response, nil
+	})
+
+	select {
+	case result := <-resultChan:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.(*channel.CallbackResponse), nil
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
 	}
 }
 
@@ -0,0 +1,137 @@
+package lnurl
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	ratelimit "github.com/breez/breez-lnurl/persist/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+/*
+RateLimiter limits the public requests waking the user's device through the
+webhook, with a token bucket per identifier and per client ip. The client ip
+is read from the X-Forwarded-For header only behind the trusted proxies.
+*/
+type RateLimiter struct {
+	store           ratelimit.Store
+	identifierLimit ratelimit.Limit
+	ipLimit         ratelimit.Limit
+	trustedProxies  []*net.IPNet
+}
+
+/*
+NewRateLimiter creates a rate limiter. A limit with a zero rate is not
+enforced. The trusted proxies are ips or CIDR ranges.
+*/
+func NewRateLimiter(store ratelimit.Store, identifierLimit ratelimit.Limit, ipLimit ratelimit.Limit, trustedProxies []string) (*RateLimiter, error) {
+	var networks []*net.IPNet
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %v: %w", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+	return &RateLimiter{
+		store:           store,
+		identifierLimit: identifierLimit,
+		ipLimit:         ipLimit,
+		trustedProxies:  networks,
+	}, nil
+}
+
+// Middleware rejects the requests over the limits of their identifier or client ip.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var keys []string
+		var limits []ratelimit.Limit
+		// The ip first, so a client limited doesn't drain the bucket of the identifier
+		if ip := l.clientIP(r); ip != "" && l.ipLimit.Rate > 0 {
+			keys = append(keys, "ip:"+ip)
+			limits = append(limits, l.ipLimit)
+		}
+		if identifier, ok := mux.Vars(r)["identifier"]; ok && l.identifierLimit.Rate > 0 {
+			keys = append(keys, "identifier:"+strings.ToLower(identifier))
+			limits = append(limits, l.identifierLimit)
+		}
+
+		now := time.Now()
+		for i, key := range keys {
+			result, err := l.store.Take(r.Context(), key, limits[i], now)
+			if err != nil {
+				// Failing open, the limits are a protection not a guarantee
+				log.Printf("failed to check rate limit of %v: %v", key, err)
+				continue
+			}
+			if !result.Allowed {
+				log.Printf("Rate limited %v on %v", key, r.URL.Path)
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(math.Ceil(result.RetryAfter.Seconds()))))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(NewLnurlPayErrorResponse("rate limited, try again later"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *RateLimiter) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return l.Middleware(next).ServeHTTP
+}
+
+/*
+clientIP returns the ip of the client. Behind a trusted proxy, it is the
+last ip of the X-Forwarded-For header not of a trusted proxy, the earlier
+entries being set by the client.
+*/
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0 && l.trusted(ip); i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+	}
+	return ip.String()
+}
+
+func (l *RateLimiter) trusted(ip net.IP) bool {
+	for _, network := range l.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
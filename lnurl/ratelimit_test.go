@@ -0,0 +1,73 @@
+package lnurl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ratelimit "github.com/breez/breez-lnurl/persist/ratelimit"
+	"github.com/gorilla/mux"
+	"gotest.tools/assert"
+)
+
+func TestRateLimiterClientIP(t *testing.T) {
+	limiter, err := NewRateLimiter(ratelimit.NewMemoryStore(), ratelimit.Limit{}, ratelimit.Limit{}, []string{"10.0.0.0/8", "192.168.1.1"})
+	assert.NilError(t, err)
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"1.2.3.4:1000", nil, "1.2.3.4"},
+		{"1.2.3.4:1000", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"10.0.0.1:1000", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:1000", []string{"9.9.9.9, 5.6.7.8, 192.168.1.1"}, "5.6.7.8"},
+		{"10.0.0.1:1000", []string{"9.9.9.9", "5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:1000", []string{"garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:1000", nil, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/lnurlp/alice", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, header := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		assert.Equal(t, limiter.clientIP(r), test.expected, "remote %v forwarded %v", test.remoteAddr, test.forwarded)
+	}
+
+	_, err = NewRateLimiter(ratelimit.NewMemoryStore(), ratelimit.Limit{}, ratelimit.Limit{}, []string{"not an ip"})
+	assert.Check(t, err != nil, "invalid trusted proxy should fail")
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	limiter, err := NewRateLimiter(ratelimit.NewMemoryStore(), ratelimit.Limit{Rate: 0.001, Burst: 2}, ratelimit.Limit{Rate: 0.001, Burst: 3}, nil)
+	assert.NilError(t, err)
+	router := mux.NewRouter()
+	router.HandleFunc("/lnurlp/{identifier}", limiter.wrap(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(identifier string, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/lnurlp/"+identifier, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// Limited per identifier
+	assert.Equal(t, request("alice", "1.1.1.1:1").Code, http.StatusOK)
+	assert.Equal(t, request("alice", "2.2.2.2:1").Code, http.StatusOK)
+	limited := request("alice", "3.3.3.3:1")
+	assert.Equal(t, limited.Code, http.StatusTooManyRequests)
+	assert.Check(t, limited.Header().Get("Retry-After") != "")
+	var status LnurlPayStatus
+	assert.NilError(t, json.Unmarshal(limited.Body.Bytes(), &status))
+	assert.Equal(t, status.Status, "ERROR")
+
+	// Limited per ip, across identifiers
+	assert.Equal(t, request("bob", "4.4.4.4:1").Code, http.StatusOK)
+	assert.Equal(t, request("carol", "4.4.4.4:1").Code, http.StatusOK)
+	assert.Equal(t, request("dave", "4.4.4.4:1").Code, http.StatusOK)
+	assert.Equal(t, request("erin", "4.4.4.4:1").Code, http.StatusTooManyRequests)
+}
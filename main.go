@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/breez/breez-lnurl/cache"
+	"github.com/breez/breez-lnurl/channel"
 	"github.com/breez/breez-lnurl/dns"
+	"github.com/breez/breez-lnurl/lnurl"
+	"github.com/breez/breez-lnurl/nwc"
 	"github.com/breez/breez-lnurl/persist"
+	ratelimit "github.com/breez/breez-lnurl/persist/ratelimit"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 func main() {
@@ -23,16 +32,17 @@ func main() {
 		log.Fatalf("failed to parse external server URL %v", err)
 	}
 
-	dnsService := dns.NewNoDns()
-	if nameServer := os.Getenv("NAME_SERVER"); nameServer != "" {
-		dnsProtocol := os.Getenv("DNS_PROTOCOL")
-		tsigKey := os.Getenv("TSIG_KEY")
-		tsigSecret := os.Getenv("TSIG_SECRET")
-		if len(tsigKey) == 0 || len(tsigSecret) == 0 {
-			log.Fatalf("TSIG_KEY and TSIG_SECRET must be set when using DNS")
-		}
+	dnsService := createDnsService(externalURL)
+	if _, ok := dnsService.(*dns.NoDns); !ok {
+		// start the reconciler repairing drift between the stored offers and the zone
+		dryRun := os.Getenv("DNS_RECONCILE_DRY_RUN") == "true"
+		reconciler := dns.NewReconciler(dnsService, storage, externalURL, dryRun)
+		go reconciler.Start(context.Background())
+	}
 
-		dnsService = dns.NewDns(externalURL, nameServer, dnsProtocol, tsigKey, tsigSecret)
+	verifier, err := createVerifier(externalURL)
+	if err != nil {
+		log.Fatalf("failed to create DNSSEC verifier: %v", err)
 	}
 
 	internalURL, err := parseURLFromEnv("SERVER_INTERNAL_URL", "http://localhost:8080")
@@ -40,9 +50,80 @@ func main() {
 		log.Fatalf("failed to parse internal server URL %v", err)
 	}
 
-	cacheService := cache.NewCache(time.Minute)
+	relayAuth, err := createRelayAuth()
+	if err != nil {
+		log.Fatalf("failed to create NWC relay authentication: %v", err)
+	}
+
+	relayPolicy, err := createRelayPolicy()
+	if err != nil {
+		log.Fatalf("failed to create NWC relay policy: %v", err)
+	}
+
+	webhookClient, err := createWebhookClient()
+	if err != nil {
+		log.Fatalf("failed to create webhook client: %v", err)
+	}
+
+	rateLimiter, err := createRateLimiter(createRateLimitStore(storage))
+	if err != nil {
+		log.Fatalf("failed to create rate limiter: %v", err)
+	}
+
+	cacheService, err := createCache()
+	if err != nil {
+		log.Fatalf("failed to create cache: %v", err)
+	}
+
+	NewServer(internalURL, externalURL, storage, dnsService, verifier, relayAuth, relayPolicy, webhookClient, rateLimiter, cacheService, os.Getenv("ADMIN_TOKEN")).Serve()
+}
+
+func createDnsService(externalURL *url.URL) dns.DnsService {
+	switch provider := os.Getenv("DNS_PROVIDER"); provider {
+	case "powerdns":
+		apiURL := os.Getenv("POWERDNS_API_URL")
+		apiKey := os.Getenv("POWERDNS_API_KEY")
+		if len(apiURL) == 0 || len(apiKey) == 0 {
+			log.Fatalf("POWERDNS_API_URL and POWERDNS_API_KEY must be set when using PowerDNS")
+		}
+		return dns.NewPowerDns(externalURL, apiURL, os.Getenv("POWERDNS_SERVER_ID"), os.Getenv("POWERDNS_ZONE"), apiKey)
+	case "rest":
+		recordURL := os.Getenv("DNS_API_RECORD_URL")
+		listURL := os.Getenv("DNS_API_LIST_URL")
+		if len(recordURL) == 0 || len(listURL) == 0 {
+			log.Fatalf("DNS_API_RECORD_URL and DNS_API_LIST_URL must be set when using the DNS API")
+		}
+		return dns.NewRestDns(externalURL, recordURL, listURL, os.Getenv("DNS_API_TOKEN"))
+	case "", "rfc2136":
+		nameServer := os.Getenv("NAME_SERVER")
+		if nameServer == "" {
+			return dns.NewNoDns()
+		}
+		dnsProtocol := os.Getenv("DNS_PROTOCOL")
+		tsigKey := os.Getenv("TSIG_KEY")
+		tsigSecret := os.Getenv("TSIG_SECRET")
+		if len(tsigKey) == 0 || len(tsigSecret) == 0 {
+			log.Fatalf("TSIG_KEY and TSIG_SECRET must be set when using DNS")
+		}
+		return dns.NewDns(externalURL, nameServer, dnsProtocol, tsigKey, tsigSecret)
+	default:
+		log.Fatalf("unknown DNS_PROVIDER %v", provider)
+		return nil
+	}
+}
 
-	NewServer(internalURL, externalURL, storage, dnsService, cacheService).Serve()
+func createVerifier(externalURL *url.URL) (*dns.Verifier, error) {
+	resolver := os.Getenv("DNS_VERIFY_RESOLVER")
+	if resolver == "" {
+		return nil, nil
+	}
+	var trustAnchors []string
+	for _, anchor := range strings.Split(os.Getenv("DNS_VERIFY_TRUST_ANCHORS"), ";") {
+		if anchor = strings.TrimSpace(anchor); anchor != "" {
+			trustAnchors = append(trustAnchors, anchor)
+		}
+	}
+	return dns.NewVerifier(externalURL, resolver, trustAnchors)
 }
 
 func parseURLFromEnv(envKey string, defaultURL string) (*url.URL, error) {
@@ -52,3 +133,137 @@ func parseURLFromEnv(envKey string, defaultURL string) (*url.URL, error) {
 	}
 	return url.Parse(serverURLStr)
 }
+
+func createRelayAuth() (*nwc.RelayAuth, error) {
+	secretKey := os.Getenv("NWC_AUTH_SECRET_KEY")
+	if secretKey == "" {
+		return nil, nil
+	}
+	return nwc.NewRelayAuth(secretKey, splitEnv("NWC_AUTH_RELAYS"))
+}
+
+func createRelayPolicy() (*nwc.RelayPolicy, error) {
+	maxRelays := 0
+	if value := os.Getenv("NWC_MAX_RELAYS"); value != "" {
+		var err error
+		if maxRelays, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid NWC_MAX_RELAYS: %w", err)
+		}
+	}
+	return nwc.NewRelayPolicy(splitEnv("NWC_RELAY_ALLOW_LIST"), splitEnv("NWC_RELAY_DENY_LIST"), maxRelays), nil
+}
+
+func createWebhookClient() (*channel.WebhookClient, error) {
+	options := channel.DefaultWebhookClientOptions()
+	options.Egress = channel.NewEgressPolicy(os.Getenv("WEBHOOK_HTTPS_ONLY") == "true", splitEnv("WEBHOOK_ALLOW_HOSTS"))
+	options.ClientCertFile = os.Getenv("WEBHOOK_CLIENT_CERT")
+	options.ClientKeyFile = os.Getenv("WEBHOOK_CLIENT_KEY")
+	if value := os.Getenv("WEBHOOK_USER_AGENT"); value != "" {
+		options.UserAgent = value
+	}
+	if value := os.Getenv("WEBHOOK_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_TIMEOUT: %w", err)
+		}
+		options.RequestTimeout = timeout
+	}
+	if value := os.Getenv("WEBHOOK_MAX_CONNS_PER_HOST"); value != "" {
+		maxConns, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_MAX_CONNS_PER_HOST: %w", err)
+		}
+		options.MaxConnsPerHost = maxConns
+	}
+	if value := os.Getenv("WEBHOOK_MAX_RESPONSE_BYTES"); value != "" {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_MAX_RESPONSE_BYTES: %w", err)
+		}
+		options.MaxResponseBytes = maxBytes
+	}
+	return channel.NewWebhookClient(options)
+}
+
+/*
+createCache creates the cache of the lnurl responses, in process by default
+or shared between the instances through the database. The shared cache has
+its own connection pool, so the cache traffic doesn't wait on the store.
+*/
+func createCache() (cache.CacheService, error) {
+	switch backend := os.Getenv("CACHE_BACKEND"); backend {
+	case "postgres":
+		pool, err := pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
+		if err != nil {
+			return nil, fmt.Errorf("pgxpool.New(): %w", err)
+		}
+		pgCache := cache.NewPgCache(pool)
+		go pgCache.Start(context.Background())
+		return pgCache, nil
+	case "", "memory":
+		capacity := uint64(10000)
+		if value := os.Getenv("CACHE_CAPACITY"); value != "" {
+			var err error
+			if capacity, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid CACHE_CAPACITY: %w", err)
+			}
+		}
+		return cache.NewCacheWithCapacity(time.Minute, capacity), nil
+	default:
+		return nil, fmt.Errorf("unknown CACHE_BACKEND %v", backend)
+	}
+}
+
+/*
+createRateLimitStore returns the store of the rate limit buckets. They are kept
+in memory, unless shared between the instances through the database.
+*/
+func createRateLimitStore(storage *persist.Store) ratelimit.Store {
+	if os.Getenv("RATE_LIMIT_SHARED") == "true" {
+		return storage.RateLimit
+	}
+	store := ratelimit.NewMemoryStore()
+	go ratelimit.NewCleanupService(store).Start(context.Background())
+	return store
+}
+
+// createRateLimiter creates the rate limiter of the public lnurl endpoints.
+func createRateLimiter(store ratelimit.Store) (*lnurl.RateLimiter, error) {
+	identifierLimit, err := rateLimitFromEnv("RATE_LIMIT_IDENTIFIER", 30, 10)
+	if err != nil {
+		return nil, err
+	}
+	ipLimit, err := rateLimitFromEnv("RATE_LIMIT_IP", 60, 20)
+	if err != nil {
+		return nil, err
+	}
+	return lnurl.NewRateLimiter(store, identifierLimit, ipLimit, splitEnv("RATE_LIMIT_TRUSTED_PROXIES"))
+}
+
+// rateLimitFromEnv reads the limit from the <prefix>_PER_MINUTE and <prefix>_BURST environment variables.
+func rateLimitFromEnv(prefix string, perMinute float64, burst int) (ratelimit.Limit, error) {
+	if value := os.Getenv(prefix + "_PER_MINUTE"); value != "" {
+		var err error
+		if perMinute, err = strconv.ParseFloat(value, 64); err != nil {
+			return ratelimit.Limit{}, fmt.Errorf("invalid %v_PER_MINUTE: %w", prefix, err)
+		}
+	}
+	if value := os.Getenv(prefix + "_BURST"); value != "" {
+		var err error
+		if burst, err = strconv.Atoi(value); err != nil {
+			return ratelimit.Limit{}, fmt.Errorf("invalid %v_BURST: %w", prefix, err)
+		}
+	}
+	return ratelimit.Limit{Rate: perMinute / 60, Burst: burst}, nil
+}
+
+// splitEnv returns the non-empty values of the environment variable separated by ";".
+func splitEnv(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ";") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
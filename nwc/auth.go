@@ -0,0 +1,80 @@
+package nwc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+/*
+RelayAuth authenticates the server to the relays requiring NIP-42 AUTH with
+a server-held key. Only the relays opted in are authenticated to, so the
+server identity is not disclosed to the other relays.
+*/
+type RelayAuth struct {
+	secretKey nostr.SecretKey
+	relays    map[string]bool
+}
+
+func NewRelayAuth(secretKeyHex string, relays []string) (*RelayAuth, error) {
+	secretKey, err := nostr.SecretKeyFromHex(secretKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %w", err)
+	}
+	auth := &RelayAuth{
+		secretKey: secretKey,
+		relays:    make(map[string]bool),
+	}
+	for _, relay := range relays {
+		canonical, err := CanonicalRelayURL(relay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay %v: %w", relay, err)
+		}
+		auth.relays[canonical] = true
+	}
+	return auth, nil
+}
+
+// Enabled returns whether authenticating to the relay is enabled.
+func (a *RelayAuth) Enabled(url string) bool {
+	if a == nil {
+		return false
+	}
+	canonical, err := CanonicalRelayURL(url)
+	return err == nil && a.relays[canonical]
+}
+
+// Pubkey returns the pubkey the server authenticates with.
+func (a *RelayAuth) Pubkey() string {
+	return a.secretKey.Public().Hex()
+}
+
+/*
+authenticate signs the AUTH event requested by a relay refusing the
+subscription, if authenticating to the relay is enabled. The outcome is
+recorded in the health of the relay, by its canonical url.
+*/
+func (nm *NostrManager) authenticate(ctx context.Context, event *nostr.Event) error {
+	var url string
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "relay" {
+			url = tag[1]
+			break
+		}
+	}
+	if canonical, err := CanonicalRelayURL(url); err == nil {
+		url = canonical
+	}
+
+	var err error
+	if !nm.auth.Enabled(url) {
+		err = errors.New("relay requires authentication, not enabled for the relay")
+	} else {
+		err = event.Sign(nm.auth.secretKey)
+	}
+	nm.health.RecordAuth(url, err, time.Now())
+	return err
+}
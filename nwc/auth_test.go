@@ -0,0 +1,50 @@
+package nwc
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/breez/breez-lnurl/persist"
+	"gotest.tools/assert"
+)
+
+func TestRelayAuth(t *testing.T) {
+	secretKey := newSecretKey(t)
+	private := "wss://private.example.com"
+	public := "wss://public.example.com"
+	auth, err := NewRelayAuth(hex.EncodeToString(secretKey[:]), []string{"wss://Private.example.com:443/"})
+	assert.NilError(t, err, "failed to create relay auth")
+	_, err = NewRelayAuth(hex.EncodeToString(secretKey[:]), []string{"https://private.example.com"})
+	assert.Check(t, err != nil, "invalid relay should be refused")
+	assert.Check(t, auth.Enabled(private), "private relay should be opted in")
+	assert.Check(t, !auth.Enabled(public), "public relay is not opted in")
+	assert.Check(t, !(*RelayAuth)(nil).Enabled(private), "auth is disabled without a key")
+
+	manager := NewNostrManager(persist.NewMemoryStore(), auth, nil)
+	authEvent := func(relay string) *nostr.Event {
+		return &nostr.Event{
+			CreatedAt: nostr.Now(),
+			Kind:      nostr.KindClientAuthentication,
+			Tags:      nostr.Tags{{"relay", relay}, {"challenge", "challenge"}},
+		}
+	}
+	// The health is recorded under the canonical url of the relay tag
+	assert.NilError(t, manager.authenticate(context.Background(), authEvent("wss://PRIVATE.example.com/")), "failed to authenticate")
+	err = manager.authenticate(context.Background(), authEvent(public))
+	assert.Check(t, err != nil, "should not authenticate to a relay not opted in")
+
+	snapshot := manager.RelayHealth()
+	assert.Equal(t, len(snapshot), 2)
+	assert.Equal(t, snapshot[0].Url, private)
+	assert.Check(t, snapshot[0].Authenticated && snapshot[0].Healthy, "private relay should be authenticated")
+	assert.Equal(t, snapshot[1].Url, public)
+	assert.Check(t, snapshot[1].AuthRequired && !snapshot[1].Authenticated, "public relay should not be authenticated")
+	assert.Check(t, snapshot[1].LastAuthError != nil, "auth failure should be reported")
+
+	// A connected relay failing authentication stays unhealthy
+	assert.Check(t, !manager.health.RecordConnected(public, time.Now()), "relay should not recover")
+	assert.Check(t, manager.health.AllUnhealthy([]string{public}), "relay should be unhealthy")
+}
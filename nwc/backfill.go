@@ -0,0 +1,51 @@
+package nwc
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// The margin subtracted from the high-water mark when backfilling, covering
+// requests relayed late or created with a skewed clock.
+var BackfillOverlap time.Duration = time.Minute
+
+// The oldest requests backfilled, older requests would have expired anyway.
+var BackfillMaxAge time.Duration = 24 * time.Hour
+
+// The margin after which a request created in the future does not raise the high-water mark.
+var maxClockSkew time.Duration = time.Minute
+
+// backfillSince returns the since filter to resubscribe with, 0 if there is nothing to backfill.
+func backfillSince(highWaterMark int64) int64 {
+	if highWaterMark == 0 {
+		return 0
+	}
+	since := highWaterMark - int64(BackfillOverlap.Seconds())
+	if oldest := time.Now().Add(-BackfillMaxAge).Unix(); since < oldest {
+		since = oldest
+	}
+	return since
+}
+
+// raiseHighWaterMark records the created_at of a request received for the wallet.
+func (nm *NostrManager) raiseHighWaterMark(walletServicePubkey string, createdAt int64) {
+	if createdAt > time.Now().Add(maxClockSkew).Unix() {
+		return
+	}
+
+	nm.mu.Lock()
+	details, exists := nm.wallets[walletServicePubkey]
+	raised := exists && createdAt > details.HighWaterMark
+	if raised {
+		details.HighWaterMark = createdAt
+	}
+	nm.mu.Unlock()
+	if !raised {
+		return
+	}
+
+	if err := nm.store.Nwc.SetHighWaterMark(context.Background(), walletServicePubkey, createdAt); err != nil {
+		log.Printf("failed to set high-water mark of wallet pubkey %s: %v", walletServicePubkey, err)
+	}
+}
@@ -0,0 +1,125 @@
+package nwc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/breez/breez-lnurl/channel"
+	"github.com/breez/breez-lnurl/persist"
+	nwc "github.com/breez/breez-lnurl/persist/nwc"
+	"gotest.tools/assert"
+)
+
+// testHook counts the events forwarded to the webhook.
+type testHook struct {
+	mu       sync.Mutex
+	received map[string]int
+	server   *httptest.Server
+}
+
+func newTestHook(t *testing.T) *testHook {
+	hook := &testHook{received: make(map[string]int)}
+	hook.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message channel.WebhookMessage
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rawEvent, _ := message.Data["event"].(string)
+		var event relayEvent
+		json.Unmarshal([]byte(rawEvent), &event)
+		hook.mu.Lock()
+		hook.received[event.ID]++
+		hook.mu.Unlock()
+	}))
+	t.Cleanup(hook.server.Close)
+	return hook
+}
+
+func (h *testHook) count(eventId string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.received[eventId]
+}
+
+func newRequest(t *testing.T, secretKey nostr.SecretKey, walletServicePubkey string, createdAt int64) nostr.Event {
+	event := nostr.Event{
+		CreatedAt: nostr.Timestamp(createdAt),
+		Kind:      nostr.KindNWCWalletRequest,
+		Tags:      nostr.Tags{{"p", walletServicePubkey}},
+		Content:   "request",
+	}
+	assert.NilError(t, event.Sign(secretKey), "failed to sign event")
+	return event
+}
+
+func publishEvent(t *testing.T, relay *testRelay, event nostr.Event) {
+	raw, err := event.MarshalJSON()
+	assert.NilError(t, err, "failed to encode event")
+	relay.publish(raw)
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	relay := newTestRelay(t)
+	hook := newTestHook(t)
+	store := persist.NewMemoryStore()
+
+	walletServicePubkey := newSecretKey(t).Public().Hex()
+	appSecretKey := newSecretKey(t)
+	err := store.Nwc.Set(ctx, nwc.Webhook{
+		WalletServicePubkey: walletServicePubkey,
+		AppPubkey:           appSecretKey.Public().Hex(),
+		Url:                 hook.server.URL,
+		Relays:              []string{relay.url},
+	})
+	assert.NilError(t, err, "failed to set webhook")
+
+	manager := NewNostrManager(store, nil, nil)
+	assert.NilError(t, manager.Start(), "failed to start manager")
+	now := time.Now().Unix()
+	first := newRequest(t, appSecretKey, walletServicePubkey, now-10)
+	publishEvent(t, relay, first)
+	waitFor(t, func() bool {
+		forwarded, _ := store.Nwc.IsEventForwarded(ctx, first.ID.Hex())
+		return forwarded
+	}, "first request not forwarded")
+	manager.Stop()
+
+	// Requests sent while the manager is down
+	stale := newRequest(t, appSecretKey, walletServicePubkey, now-int64(time.Hour.Seconds()))
+	missed := newRequest(t, appSecretKey, walletServicePubkey, now-5)
+	publishEvent(t, relay, stale)
+	publishEvent(t, relay, missed)
+
+	manager = NewNostrManager(store, nil, nil)
+	assert.NilError(t, manager.Start(), "failed to restart manager")
+	defer manager.Stop()
+	waitFor(t, func() bool { return hook.count(missed.ID.Hex()) > 0 }, "missed request not backfilled")
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Equal(t, hook.count(first.ID.Hex()), 1)
+	assert.Equal(t, hook.count(missed.ID.Hex()), 1)
+	assert.Equal(t, hook.count(stale.ID.Hex()), 0)
+
+	subs, err := store.Nwc.GetSubscriptionDetails(ctx)
+	assert.NilError(t, err, "failed to get subscriptions")
+	assert.Equal(t, subs[walletServicePubkey].HighWaterMark, now-5)
+}
+
+func TestBackfillSince(t *testing.T) {
+	assert.Equal(t, backfillSince(0), int64(0))
+
+	now := time.Now().Unix()
+	assert.Equal(t, backfillSince(now), now-int64(BackfillOverlap.Seconds()))
+
+	// Requests older than the max age are not backfilled
+	since := backfillSince(now - int64(48*time.Hour.Seconds()))
+	assert.Assert(t, since >= now-int64(BackfillMaxAge.Seconds()))
+}
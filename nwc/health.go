@@ -0,0 +1,304 @@
+package nwc
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/breez/breez-lnurl/channel"
+)
+
+// The interval to check the connection of the subscribed relays.
+var RelayHealthCheckInterval time.Duration = 30 * time.Second
+
+// The delay before reconnecting to a failing relay, doubled on each consecutive error.
+var RelayReconnectBaseDelay time.Duration = 10 * time.Second
+var RelayReconnectMaxDelay time.Duration = 30 * time.Minute
+
+var relayMetrics = expvar.NewMap("nwc_relays")
+
+// RelayHealth is the connection state of a relay.
+type RelayHealth struct {
+	Url           string     `json:"url"`
+	Connected     bool       `json:"connected"`
+	Healthy       bool       `json:"healthy"`
+	LastEventAt   *time.Time `json:"lastEventAt,omitempty"`
+	LastCheckAt   *time.Time `json:"lastCheckAt,omitempty"`
+	LastError     *string    `json:"lastError,omitempty"`
+	ErrorCount    int        `json:"errorCount"`
+	TotalErrors   int        `json:"totalErrors"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+	// The NIP-42 authentication state, when requested by the relay
+	AuthRequired  bool       `json:"authRequired"`
+	Authenticated bool       `json:"authenticated"`
+	LastAuthAt    *time.Time `json:"lastAuthAt,omitempty"`
+	LastAuthError *string    `json:"lastAuthError,omitempty"`
+}
+
+/*
+RelayHealthTracker tracks the connection state of the relays. A relay is
+healthy until it fails, and healthy again once reconnected. A relay failing
+authentication stays unhealthy until authenticated.
+*/
+type RelayHealthTracker struct {
+	mu     sync.Mutex
+	relays map[string]*RelayHealth
+}
+
+func NewRelayHealthTracker() *RelayHealthTracker {
+	return &RelayHealthTracker{
+		relays: make(map[string]*RelayHealth),
+	}
+}
+
+func (t *RelayHealthTracker) get(url string) *RelayHealth {
+	health, exists := t.relays[url]
+	if !exists {
+		health = &RelayHealth{Url: url, Healthy: true}
+		t.relays[url] = health
+	}
+	return health
+}
+
+// RecordEvent records an event was received from the relay.
+func (t *RelayHealthTracker) RecordEvent(url string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(url).LastEventAt = &at
+}
+
+// RecordConnected records the relay is connected, returning true if it was unhealthy.
+func (t *RelayHealthTracker) RecordConnected(url string, at time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health := t.get(url)
+	wasHealthy := health.Healthy
+	health.Connected = true
+	health.Healthy = health.LastAuthError == nil
+	health.LastCheckAt = &at
+	health.LastError = nil
+	health.ErrorCount = 0
+	health.NextAttemptAt = nil
+	return !wasHealthy && health.Healthy
+}
+
+// RecordAuth records the outcome of authenticating to the relay.
+func (t *RelayHealthTracker) RecordAuth(url string, err error, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health := t.get(url)
+	health.AuthRequired = true
+	health.LastAuthAt = &at
+	if err != nil {
+		lastAuthError := err.Error()
+		health.Authenticated = false
+		health.LastAuthError = &lastAuthError
+		health.Healthy = false
+		relayMetrics.Add("auth_failures", 1)
+		return
+	}
+	health.Authenticated = true
+	health.LastAuthError = nil
+	health.Healthy = health.LastError == nil
+}
+
+// RecordError records the relay failed, postponing the next attempt with an exponential backoff.
+func (t *RelayHealthTracker) RecordError(url string, err error, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health := t.get(url)
+	lastError := err.Error()
+	health.Connected = false
+	health.Healthy = false
+	health.LastCheckAt = &at
+	health.LastError = &lastError
+	delay := RelayReconnectBaseDelay << health.ErrorCount
+	if delay < RelayReconnectBaseDelay || delay > RelayReconnectMaxDelay {
+		delay = RelayReconnectMaxDelay
+	}
+	nextAttemptAt := at.Add(delay)
+	health.NextAttemptAt = &nextAttemptAt
+	health.ErrorCount++
+	health.TotalErrors++
+	relayMetrics.Add("errors", 1)
+}
+
+// Due returns whether the relay should be checked, false while backing off.
+func (t *RelayHealthTracker) Due(url string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health := t.get(url)
+	return health.NextAttemptAt == nil || !health.NextAttemptAt.After(now)
+}
+
+// AllUnhealthy returns whether none of the relays is healthy.
+func (t *RelayHealthTracker) AllUnhealthy(urls []string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, url := range urls {
+		if t.get(url).Healthy {
+			return false
+		}
+	}
+	return len(urls) > 0
+}
+
+// Retain forgets the relays not in the given list.
+func (t *RelayHealthTracker) Retain(urls []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for url := range t.relays {
+		if !slices.Contains(urls, url) {
+			delete(t.relays, url)
+		}
+	}
+}
+
+// Snapshot returns the health of all the relays sorted by url, and updates the metrics.
+func (t *RelayHealthTracker) Snapshot() []RelayHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var healthy, unhealthy int64
+	snapshot := make([]RelayHealth, 0, len(t.relays))
+	for _, health := range t.relays {
+		if health.Healthy {
+			healthy++
+		} else {
+			unhealthy++
+		}
+		snapshot = append(snapshot, *health)
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Url < snapshot[j].Url
+	})
+
+	healthyMetric, unhealthyMetric := new(expvar.Int), new(expvar.Int)
+	healthyMetric.Set(healthy)
+	unhealthyMetric.Set(unhealthy)
+	relayMetrics.Set("healthy", healthyMetric)
+	relayMetrics.Set("unhealthy", unhealthyMetric)
+	return snapshot
+}
+
+// RelayHealth returns the health of the subscribed relays.
+func (nm *NostrManager) RelayHealth() []RelayHealth {
+	return nm.health.Snapshot()
+}
+
+// Periodically checks the subscribed relays until the context is done.
+func (nm *NostrManager) monitorRelays(ctx context.Context) {
+	notified := make(map[string]bool)
+	for {
+		select {
+		case <-time.After(RelayHealthCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+		nm.checkRelays(notified)
+	}
+}
+
+/*
+checkRelays reconnects the relays due for a check, resubscribes the shards
+of a recovered relay and notifies the apps once all their relays are
+unhealthy.
+*/
+func (nm *NostrManager) checkRelays(notified map[string]bool) {
+	nm.mu.RLock()
+	walletRelays := make(map[string][]string)
+	relaySet := make(map[string]bool)
+	for walletServicePubkey, details := range nm.wallets {
+		walletRelays[walletServicePubkey] = slices.Collect(maps.Keys(details.Relays))
+		for relay := range details.Relays {
+			relaySet[relay] = true
+		}
+	}
+	nm.mu.RUnlock()
+	relays := slices.Collect(maps.Keys(relaySet))
+	nm.health.Retain(relays)
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	var recoveredMu sync.Mutex
+	recovered := make(map[string]bool)
+	for _, url := range relays {
+		if !nm.health.Due(url, now) {
+			continue
+		}
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			relay, err := nm.pool.EnsureRelay(url)
+			if err == nil && !relay.IsConnected() {
+				err = errors.New("relay not connected")
+			}
+			if err != nil {
+				log.Printf("relay %s is unhealthy: %v", url, err)
+				nm.health.RecordError(url, err, now)
+				return
+			}
+			if nm.health.RecordConnected(url, now) {
+				log.Printf("relay %s recovered", url)
+				recoveredMu.Lock()
+				recovered[url] = true
+				recoveredMu.Unlock()
+			}
+		}(url)
+	}
+	wg.Wait()
+	nm.health.Snapshot()
+
+	for url := range recovered {
+		nm.resubscribeRelay(url)
+	}
+	for walletServicePubkey, relays := range walletRelays {
+		if !nm.health.AllUnhealthy(relays) {
+			delete(notified, walletServicePubkey)
+			continue
+		}
+		if !notified[walletServicePubkey] {
+			notified[walletServicePubkey] = true
+			go nm.notifyRelaysUnhealthy(walletServicePubkey, relays)
+		}
+	}
+	for walletServicePubkey := range notified {
+		if _, exists := walletRelays[walletServicePubkey]; !exists {
+			delete(notified, walletServicePubkey)
+		}
+	}
+}
+
+// notifyRelaysUnhealthy notifies the apps of the wallet that none of their relays is healthy.
+func (nm *NostrManager) notifyRelaysUnhealthy(walletServicePubkey string, relays []string) {
+	nm.mu.RLock()
+	var appPubkeys []string
+	if details, exists := nm.wallets[walletServicePubkey]; exists {
+		appPubkeys = slices.Collect(maps.Keys(details.AppPubkeys))
+	}
+	nm.mu.RUnlock()
+
+	for _, appPubkey := range appPubkeys {
+		webhook, err := nm.store.Nwc.Get(nm.ctx, walletServicePubkey, appPubkey)
+		if err != nil || webhook == nil {
+			log.Printf("failed to retrieve webhook of app %s: %v", appPubkey, err)
+			continue
+		}
+		err = nm.sendWebhook(nm.ctx, webhook.Url, channel.WebhookMessage{
+			Template: "nwc_relays_unhealthy",
+			Data: map[string]any{
+				"walletServicePubkey": walletServicePubkey,
+				"appPubkey":           appPubkey,
+				"relays":              relays,
+			},
+		})
+		if err != nil {
+			log.Printf("failed to notify app %s of unhealthy relays: %v", appPubkey, err)
+		}
+	}
+}
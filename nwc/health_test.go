@@ -0,0 +1,45 @@
+package nwc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestRelayHealthBackoff(t *testing.T) {
+	tracker := NewRelayHealthTracker()
+	now := time.Now()
+	relays := []string{"wss://relay1.example.com", "wss://relay2.example.com"}
+
+	assert.Check(t, tracker.Due(relays[0], now), "unchecked relay should be due")
+	assert.Check(t, !tracker.AllUnhealthy(relays), "unchecked relays should be healthy")
+
+	tracker.RecordError(relays[0], errors.New("connection refused"), now)
+	assert.Check(t, !tracker.Due(relays[0], now.Add(RelayReconnectBaseDelay-time.Second)), "relay should back off")
+	assert.Check(t, tracker.Due(relays[0], now.Add(RelayReconnectBaseDelay)), "relay should be due after the delay")
+
+	// The delay doubles on consecutive errors
+	tracker.RecordError(relays[0], errors.New("connection refused"), now)
+	assert.Check(t, !tracker.Due(relays[0], now.Add(RelayReconnectBaseDelay)), "relay should back off longer")
+	assert.Check(t, tracker.Due(relays[0], now.Add(2*RelayReconnectBaseDelay)), "relay should be due after the doubled delay")
+	assert.Check(t, !tracker.AllUnhealthy(relays), "second relay is still healthy")
+
+	tracker.RecordError(relays[1], errors.New("rate limited"), now)
+	assert.Check(t, tracker.AllUnhealthy(relays), "all relays should be unhealthy")
+
+	assert.Check(t, tracker.RecordConnected(relays[0], now), "relay should have recovered")
+	assert.Check(t, !tracker.RecordConnected(relays[0], now), "relay was already healthy")
+	assert.Check(t, !tracker.AllUnhealthy(relays), "first relay is healthy again")
+
+	snapshot := tracker.Snapshot()
+	assert.Equal(t, len(snapshot), 2)
+	assert.Equal(t, snapshot[0].Url, relays[0])
+	assert.Equal(t, snapshot[0].ErrorCount, 0)
+	assert.Equal(t, snapshot[0].TotalErrors, 2)
+	assert.Equal(t, snapshot[1].ErrorCount, 1)
+
+	tracker.Retain(relays[:1])
+	assert.Equal(t, len(tracker.Snapshot()), 1)
+}
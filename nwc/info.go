@@ -0,0 +1,76 @@
+package nwc
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// The interval to republish the hosted wallet info events to the relays.
+var InfoEventRepublishInterval time.Duration = 6 * time.Hour
+
+/*
+PublishInfoEvent publishes the stored info event of the wallet service to the
+given relays, or to all the relays of its subscription if none is given.
+*/
+func (nm *NostrManager) PublishInfoEvent(walletServicePubkey string, relays []string) {
+	if len(relays) == 0 {
+		nm.mu.RLock()
+		if details, exists := nm.wallets[walletServicePubkey]; exists {
+			relays = slices.Collect(maps.Keys(details.Relays))
+		}
+		nm.mu.RUnlock()
+	}
+	if len(relays) == 0 {
+		return
+	}
+
+	infoEvent, err := nm.store.Nwc.GetInfoEvent(nm.ctx, walletServicePubkey)
+	if err != nil {
+		log.Printf("failed to get info event for wallet pubkey %s: %v", walletServicePubkey, err)
+		return
+	}
+	if infoEvent == nil {
+		return
+	}
+	var event nostr.Event
+	if err := json.Unmarshal([]byte(infoEvent.Event), &event); err != nil {
+		log.Printf("failed to decode info event for wallet pubkey %s: %v", walletServicePubkey, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(nm.ctx, NotificationPublishTimeout)
+	defer cancel()
+	published := 0
+	for result := range nm.pool.PublishMany(ctx, relays, event) {
+		if result.Error != nil {
+			log.Printf("failed to publish info event for wallet pubkey %s to %s: %v", walletServicePubkey, result.RelayURL, result.Error)
+			continue
+		}
+		published++
+	}
+	log.Printf("Published info event for wallet pubkey %s to %d/%d relays", walletServicePubkey, published, len(relays))
+}
+
+// Periodically republishes the info events of all the subscriptions.
+func (nm *NostrManager) republishInfoEvents(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(InfoEventRepublishInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		nm.mu.RLock()
+		walletServicePubkeys := slices.Collect(maps.Keys(nm.wallets))
+		nm.mu.RUnlock()
+		for _, walletServicePubkey := range walletServicePubkeys {
+			nm.PublishInfoEvent(walletServicePubkey, nil)
+		}
+	}
+}
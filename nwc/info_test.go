@@ -0,0 +1,86 @@
+package nwc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/breez/breez-lnurl/persist"
+	nwc "github.com/breez/breez-lnurl/persist/nwc"
+	"gotest.tools/assert"
+)
+
+func newInfoEvent(t *testing.T, secretKey nostr.SecretKey, createdAt int64) nostr.Event {
+	event := nostr.Event{
+		CreatedAt: nostr.Timestamp(createdAt),
+		Kind:      nostr.KindNWCWalletInfo,
+		Content:   "pay_invoice get_balance",
+	}
+	assert.NilError(t, event.Sign(secretKey), "failed to sign event")
+	return event
+}
+
+// setInfoEvent stores the info event and the webhook of the wallet on the relays.
+func setInfoEvent(t *testing.T, store *persist.Store, secretKey nostr.SecretKey, relays ...*testRelay) {
+	ctx := context.Background()
+	infoEvent := newInfoEvent(t, secretKey, time.Now().Unix())
+	raw, err := infoEvent.MarshalJSON()
+	assert.NilError(t, err, "failed to encode event")
+	err = store.Nwc.SetInfoEvent(ctx, nwc.InfoEvent{
+		WalletServicePubkey: secretKey.Public().Hex(),
+		Event:               string(raw),
+		CreatedAt:           int64(infoEvent.CreatedAt),
+	})
+	assert.NilError(t, err, "failed to set info event")
+
+	var relayUrls []string
+	for _, relay := range relays {
+		relayUrls = append(relayUrls, relay.url)
+	}
+	err = store.Nwc.Set(ctx, nwc.Webhook{
+		WalletServicePubkey: secretKey.Public().Hex(),
+		AppPubkey:           newSecretKey(t).Public().Hex(),
+		Url:                 "http://example.com/webhook",
+		Relays:              relayUrls,
+	})
+	assert.NilError(t, err, "failed to set webhook")
+}
+
+func TestPublishInfoEventAddedRelays(t *testing.T) {
+	ctx := context.Background()
+	relays := []*testRelay{newTestRelay(t), newTestRelay(t)}
+	store := persist.NewMemoryStore()
+	walletSecretKey := newSecretKey(t)
+	setInfoEvent(t, store, walletSecretKey, relays[0])
+
+	manager := NewNostrManager(store, nil, nil)
+	assert.NilError(t, manager.Start(), "failed to start manager")
+	defer manager.Stop()
+
+	// Adding the relays leaves publishing the info event to the caller
+	added := manager.AddSubscription(ctx, walletSecretKey.Public().Hex(), newSecretKey(t).Public().Hex(), []string{relays[0].url, relays[1].url})
+	assert.DeepEqual(t, added, []string{relays[1].url})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, relays[1].count(int(nostr.KindNWCWalletInfo)), 0)
+
+	manager.PublishInfoEvent(walletSecretKey.Public().Hex(), added)
+	assert.Equal(t, relays[1].count(int(nostr.KindNWCWalletInfo)), 1)
+	assert.Equal(t, relays[0].count(int(nostr.KindNWCWalletInfo)), 0)
+}
+
+func TestRepublishInfoEvents(t *testing.T) {
+	defer func(interval time.Duration) { InfoEventRepublishInterval = interval }(InfoEventRepublishInterval)
+	InfoEventRepublishInterval = 50 * time.Millisecond
+
+	relay := newTestRelay(t)
+	store := persist.NewMemoryStore()
+	setInfoEvent(t, store, newSecretKey(t), relay)
+
+	manager := NewNostrManager(store, nil, nil)
+	assert.NilError(t, manager.Start(), "failed to start manager")
+	defer manager.Stop()
+	waitFor(t, func() bool {
+		return relay.count(int(nostr.KindNWCWalletInfo)) >= 2
+	}, "info event not republished")
+}
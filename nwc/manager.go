@@ -5,12 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"maps"
 	"slices"
-
-	"net/http"
-	"strings"
 	"sync"
+	"time"
 
 	"fiatjaf.com/nostr"
 	"github.com/breez/breez-lnurl/channel"
@@ -18,175 +15,205 @@ import (
 	nwc "github.com/breez/breez-lnurl/persist/nwc"
 )
 
-type Subscription struct {
-	ctx          context.Context
-	cancel       context.CancelFunc
-	eventChannel chan nostr.RelayEvent
-	details      *nwc.SubscriptionDetails
-}
+// The duration after which an event claimed but neither delivered nor failed can be claimed again.
+var EventClaimTimeout time.Duration = 2 * time.Minute
 
 type NostrManager struct {
-	pool      *nostr.Pool
-	ctx       context.Context
-	cancel    context.CancelFunc
-	mu        sync.RWMutex
-	isRunning bool
-	subs      map[string]*Subscription
-	store     *persist.Store
+	pool       *nostr.Pool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	mu         sync.RWMutex
+	isRunning  bool
+	wallets    map[string]*nwc.SubscriptionDetails
+	shards     *shardSet
+	dirty      map[*shard]bool
+	flushTimer *time.Timer
+	instanceId string
+	instances  []string
+	recent     map[string]bool
+	store      *persist.Store
+	health     *RelayHealthTracker
+	auth       *RelayAuth
+	client     *channel.WebhookClient
 }
 
-func NewNostrManager(store *persist.Store) *NostrManager {
+func NewNostrManager(store *persist.Store, auth *RelayAuth, client *channel.WebhookClient) *NostrManager {
+	if client == nil {
+		client = channel.NewDefaultWebhookClient()
+	}
 	return &NostrManager{
-		isRunning: false,
-		store:     store,
-		subs:      make(map[string]*Subscription),
+		isRunning:  false,
+		store:      store,
+		wallets:    make(map[string]*nwc.SubscriptionDetails),
+		shards:     newShardSet(),
+		dirty:      make(map[*shard]bool),
+		instanceId: newInstanceId(),
+		recent:     make(map[string]bool),
+		health:     NewRelayHealthTracker(),
+		auth:       auth,
+		client:     client,
 	}
 }
 
-func (nm *NostrManager) AddSubscription(walletServicePubkey string, appPubkey string, relays []string) {
+/*
+AddSubscription subscribes the wallet to the relays of the registration,
+returning the relays added to its subscription. The relays no longer stored
+for any app of the wallet, dropped by a re-registration, are unsubscribed.
+*/
+func (nm *NostrManager) AddSubscription(ctx context.Context, walletServicePubkey string, appPubkey string, relays []string) []string {
+	storedRelays, err := nm.store.Nwc.GetWalletRelays(ctx, walletServicePubkey)
+	if err != nil {
+		log.Printf("failed to get the relays of wallet %v: %v", walletServicePubkey, err)
+	}
+
 	nm.mu.Lock()
 	defer nm.mu.Unlock()
 
-	details := &nwc.SubscriptionDetails{
-		AppPubkeys: make(map[string]bool),
-		Relays:     make(map[string]bool),
+	// The instance owning the wallet picks it up on its next rebalance
+	if !nm.owns(walletServicePubkey) {
+		return nil
 	}
-	details.AppPubkeys[appPubkey] = true
-	for _, relay := range relays {
-		details.Relays[relay] = true
+	nm.recent[walletServicePubkey] = true
+
+	details, exists := nm.wallets[walletServicePubkey]
+	if !exists {
+		details = &nwc.SubscriptionDetails{
+			AppPubkeys: make(map[string]bool),
+			Relays:     make(map[string]bool),
+		}
+		nm.wallets[walletServicePubkey] = details
 	}
+	details.AppPubkeys[appPubkey] = true
 
-	sub, exists := nm.subs[walletServicePubkey]
-	if exists {
-		for appPubkey := range sub.details.AppPubkeys {
-			details.AppPubkeys[appPubkey] = true
+	var addedRelays []string
+	for _, relay := range relays {
+		if details.Relays[relay] {
+			continue
 		}
-		for relay := range sub.details.Relays {
-			details.Relays[relay] = true
+		details.Relays[relay] = true
+		addedRelays = append(addedRelays, relay)
+		if sh := nm.shards.add(walletServicePubkey, relay); sh != nil {
+			nm.markDirty(false, sh)
 		}
-		sub.cancel()
 	}
 
-	nm.addSubscriptionInner(walletServicePubkey, details)
-}
-
-func (nm *NostrManager) addSubscriptionInner(walletServicePubkey string, subDetails *nwc.SubscriptionDetails) {
-	filters := nostr.Filter{
-		Tags: nostr.TagMap{
-			"p": []string{walletServicePubkey},
-		},
-		Kinds: []nostr.Kind{nostr.KindNWCWalletRequest},
-	}
-	subCtx, subCancel := context.WithCancel(nm.ctx)
-	relays := slices.Collect(maps.Keys(subDetails.Relays))
-	eventChannel := nm.pool.SubscribeMany(subCtx, relays, filters, nostr.SubscriptionOptions{})
-	sub := Subscription{
-		ctx:          subCtx,
-		cancel:       subCancel,
-		eventChannel: eventChannel,
-		details:      subDetails,
+	// The relays are only dropped once known to be stored for none of the apps
+	if err == nil {
+		for relay := range details.Relays {
+			if !slices.Contains(relays, relay) && !slices.Contains(storedRelays, relay) {
+				nm.removeRelay(walletServicePubkey, relay)
+			}
+		}
 	}
-	nm.subs[walletServicePubkey] = &sub
-
-	log.Printf("Subscribed to %d relays for wallet pubkey %s", len(subDetails.Relays), walletServicePubkey)
-
-	go nm.forwardToNotify(&sub, walletServicePubkey)
+	return addedRelays
 }
 
 func (nm *NostrManager) RemoveSubscription(walletServicePubkey string, appPubkey string) {
 	nm.mu.Lock()
 	defer nm.mu.Unlock()
 
-	existingSub, exists := nm.subs[walletServicePubkey]
+	details, exists := nm.wallets[walletServicePubkey]
 	if !exists {
 		return
 	}
 
-	delete(existingSub.details.AppPubkeys, appPubkey)
-	if len(existingSub.details.AppPubkeys) == 0 {
-		nm.cancelSubscription(existingSub, walletServicePubkey)
+	// The events of the other apps keep being routed by the shards
+	delete(details.AppPubkeys, appPubkey)
+	if len(details.AppPubkeys) > 0 {
 		return
 	}
 
-	existingSub.cancel()
-	nm.addSubscriptionInner(walletServicePubkey, existingSub.details)
+	nm.dropWallet(walletServicePubkey)
+}
+
+// dropWallet unsubscribes the wallet, resubscribing the shards it was in. The caller must hold the lock.
+func (nm *NostrManager) dropWallet(walletServicePubkey string) {
+	delete(nm.wallets, walletServicePubkey)
+	changed, closed := nm.shards.remove(walletServicePubkey)
+	nm.closeShards(closed)
+	nm.markDirty(false, changed...)
+}
+
+// removeRelay unsubscribes the wallet from the relay, resubscribing its shard. The caller must hold the lock.
+func (nm *NostrManager) removeRelay(walletServicePubkey string, relay string) {
+	delete(nm.wallets[walletServicePubkey].Relays, relay)
+	changed, closed := nm.shards.removeRelay(walletServicePubkey, relay)
+	nm.closeShards(closed)
+	nm.markDirty(false, changed...)
 }
 
-func (nm *NostrManager) forwardToNotify(sub *Subscription, walletServicePubkey string) {
-	if sub == nil {
+// forwardToNotify forwards a request addressed to the wallet to the webhook of the app that sent it.
+func (nm *NostrManager) forwardToNotify(ctx context.Context, incomingEvent nostr.RelayEvent, walletServicePubkey string) {
+	// The shard may be resubscribed while the event is delivered, which must not abort the delivery
+	ctx = context.WithoutCancel(ctx)
+	eventId := incomingEvent.ID.Hex()
+	eventAuthor := incomingEvent.PubKey.Hex()
+
+	nm.mu.RLock()
+	subDetails, exists := nm.wallets[walletServicePubkey]
+	exists = exists && subDetails.AppPubkeys[eventAuthor]
+	nm.mu.RUnlock()
+	if !exists {
 		return
 	}
+	if !incomingEvent.VerifySignature() {
+		log.Printf("failed to verify signature for event %v", eventId)
+		return
+	}
+	log.Printf("got incoming event: %s", eventId)
+	nm.raiseHighWaterMark(walletServicePubkey, int64(incomingEvent.CreatedAt))
 
-	for {
-		select {
-		case incomingEvent := <-sub.eventChannel:
-			eventId := incomingEvent.ID.Hex()
-			eventAuthor := incomingEvent.PubKey.Hex()
+	// Keep the event for the app to pull it, even if the webhook is unreachable
+	nm.storePendingEvent(ctx, incomingEvent.Event, walletServicePubkey)
 
-			if _, exists := sub.details.AppPubkeys[eventAuthor]; !exists {
-				continue
-			}
-			if !incomingEvent.VerifySignature() {
-				log.Printf("failed to verify signature for event %v", eventId)
-				continue
-			}
-			log.Printf("got incoming event: %s", eventId)
+	webhook, err := nm.store.Nwc.Get(ctx, walletServicePubkey, eventAuthor)
+	if err != nil {
+		log.Printf("failed to retrieve webhook for event %v: %v", eventId, err)
+		return
+	}
+	if webhook == nil {
+		log.Printf("webhook not found for event %v. Skipping.", eventId)
+		return
+	}
 
-			// Check if event has already been forwarded (deduplication)
-			alreadyForwarded, err := nm.store.Nwc.IsEventForwarded(sub.ctx, eventId)
-			if err != nil {
-				log.Printf("failed to check if event %v was already forwarded: %s", eventId, err)
-				continue
-			}
-			if alreadyForwarded {
-				log.Printf("event %v already forwarded, skipping duplicate", eventId)
-				continue
-			}
+	// Claim the event (deduplication), the same event is received from several relays concurrently
+	details := nwc.WebhookDetails{
+		EventId:             eventId,
+		WalletServicePubkey: walletServicePubkey,
+		AppPubkey:           eventAuthor,
+		WebhookUrl:          webhook.Url,
+	}
+	claimed, err := nm.store.Nwc.ClaimEvent(ctx, details, time.Now().Add(-EventClaimTimeout))
+	if err != nil {
+		log.Printf("failed to claim event %v: %s", eventId, err)
+		return
+	}
+	if !claimed {
+		log.Printf("event %v already forwarded, skipping duplicate", eventId)
+		return
+	}
 
-			webhook, err := nm.store.Nwc.Get(sub.ctx, walletServicePubkey, eventAuthor)
-			if err != nil {
-				log.Printf("failed to retrieve webhook for event %v: %v", eventId, err)
-				continue
-			}
-			if webhook == nil {
-				log.Printf("webhook not found for event %v. Skipping.", eventId)
-				continue
-			}
+	go func(event nostr.RelayEvent, details nwc.WebhookDetails) {
+		log.Printf("forwarding event %s to notify service", eventId)
 
-			go func(url string, event nostr.RelayEvent, walletServicePk string) {
-				eventId := incomingEvent.ID.Hex()
-				appPubkey := incomingEvent.PubKey.Hex()
-
-				log.Printf("forwarding event %s to notify service", eventId)
-
-				eventJson, err := event.MarshalJSON()
-				if err != nil {
-					log.Printf("failed to json-encode event %s: %v", eventId, err)
-					return
-				}
-
-				err = nm.SendRequest(sub.ctx, url, string(eventJson), eventId)
-				if err != nil {
-					log.Printf("failed to send webhook message for event %v: %v", eventId, err)
-					return
-				}
-
-				err = nm.store.Nwc.Update(sub.ctx, nwc.WebhookDetails{
-					EventId:             eventId,
-					WalletServicePubkey: walletServicePk,
-					AppPubkey:           appPubkey,
-					WebhookUrl:          url,
-				})
-				if err != nil {
-					log.Printf("failed to update webhook details for event %v: %v", eventId, err)
-				}
-			}(webhook.Url, incomingEvent, walletServicePubkey)
-		case <-sub.ctx.Done():
-			return
-		case <-nm.ctx.Done():
+		eventJson, err := event.MarshalJSON()
+		if err == nil {
+			err = nm.SendRequest(ctx, details.WebhookUrl, string(eventJson), eventId)
+		}
+		if err != nil {
+			log.Printf("failed to send webhook message for event %v: %v", eventId, err)
+			// Release the claim so the event is forwarded when received again
+			if err := nm.store.Nwc.FailEvent(ctx, eventId); err != nil {
+				log.Printf("failed to release the claim of event %v: %v", eventId, err)
+			}
 			return
 		}
-	}
+
+		err = nm.store.Nwc.Update(ctx, details)
+		if err != nil {
+			log.Printf("failed to update webhook details for event %v: %v", eventId, err)
+		}
+	}(incomingEvent, details)
 }
 
 func (nm *NostrManager) SendRequest(ctx context.Context, url string, rawEvent string, eventId string) error {
@@ -196,28 +223,27 @@ func (nm *NostrManager) SendRequest(ctx context.Context, url string, rawEvent st
 			"event": rawEvent,
 		},
 	}
-	jsonBytes, err := json.Marshal(message)
-	if err != nil {
+	if err := nm.sendWebhook(ctx, url, message); err != nil {
 		return err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(jsonBytes)))
+	log.Printf("successfully forwarded event %s", eventId)
+	return nil
+}
+
+func (nm *NostrManager) sendWebhook(ctx context.Context, url string, message channel.WebhookMessage) error {
+	jsonBytes, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := nm.client.Post(ctx, url, jsonBytes)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
-
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		return fmt.Errorf("webhook returned status: %d", res.StatusCode)
 	}
-
-	log.Printf("successfully forwarded event %s", eventId)
 	return nil
 }
 
@@ -229,18 +255,48 @@ func (nm *NostrManager) Start() error {
 		return nil
 	}
 	nm.ctx, nm.cancel = context.WithCancel(context.Background())
-	nm.pool = nostr.NewPool(nostr.PoolOptions{})
+	nm.pool = nostr.NewPool(nostr.PoolOptions{
+		AuthRequiredHandler: nm.authenticate,
+	})
 	nm.isRunning = true
 
+	instances, err := nm.renewLease(nm.ctx)
+	if err != nil {
+		return err
+	}
+	nm.instances = instances
+
 	activeSubscriptions, err := nm.store.Nwc.GetSubscriptionDetails(nm.ctx)
 	if err != nil {
 		return err
 	}
 
+	clear(nm.wallets)
 	for walletServicePubkey, subDetails := range activeSubscriptions {
-		nm.addSubscriptionInner(walletServicePubkey, &subDetails)
+		if nm.owns(walletServicePubkey) {
+			nm.wallets[walletServicePubkey] = &subDetails
+		}
 	}
 
+	// Rebuild the shards from scratch, backfilling the requests missed while stopped
+	nm.shards = newShardSet()
+	clear(nm.dirty)
+	for walletServicePubkey, details := range nm.wallets {
+		for relay := range details.Relays {
+			nm.shards.add(walletServicePubkey, relay)
+		}
+	}
+	shards := nm.shards.all()
+	for _, sh := range shards {
+		nm.subscribeShard(sh, nm.shardSince(sh, true))
+	}
+	log.Printf("Instance %s subscribed %d wallet pubkeys in %d shards", nm.instanceId, len(nm.wallets), len(shards))
+
+	go nm.resumeNotifications()
+	go nm.republishInfoEvents(nm.ctx)
+	go nm.monitorRelays(nm.ctx)
+	go nm.syncOwnership(nm.ctx)
+
 	log.Printf("Started Nostr manager")
 	return nil
 }
@@ -252,19 +308,21 @@ func (nm *NostrManager) Stop() {
 	if !nm.isRunning {
 		return
 	}
-	for walletServicePubkey, sub := range nm.subs {
-		nm.cancelSubscription(sub, walletServicePubkey)
+	nm.closeShards(nm.shards.all())
+	if nm.flushTimer != nil {
+		nm.flushTimer.Stop()
+		nm.flushTimer = nil
 	}
 
 	if nm.cancel != nil {
 		nm.cancel()
 	}
 
+	// Hand the wallets over to the other instances without waiting for the lease to expire
+	if err := nm.store.Nwc.DeleteInstanceLease(context.Background(), nm.instanceId); err != nil {
+		log.Printf("failed to release the lease of instance %s: %v", nm.instanceId, err)
+	}
+
 	nm.isRunning = false
 	log.Printf("Stopped Nostr manager")
 }
-
-func (nm *NostrManager) cancelSubscription(s *Subscription, walletServicePubkey string) {
-	s.cancel()
-	delete(nm.subs, walletServicePubkey)
-}
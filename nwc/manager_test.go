@@ -0,0 +1,105 @@
+package nwc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/breez/breez-lnurl/persist"
+	nwc "github.com/breez/breez-lnurl/persist/nwc"
+	"gotest.tools/assert"
+)
+
+func TestForwardDuringResubscription(t *testing.T) {
+	defer func(delay time.Duration) { ShardResubscribeDelay = delay }(ShardResubscribeDelay)
+	ShardResubscribeDelay = 50 * time.Millisecond
+
+	ctx := context.Background()
+	relays := []*testRelay{newTestRelay(t), newTestRelay(t)}
+	store := persist.NewMemoryStore()
+
+	// The webhook holds the delivery until the shards are resubscribed
+	var received atomic.Int32
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		<-release
+	}))
+	defer hook.Close()
+	defer close(release)
+
+	walletServicePubkey := newSecretKey(t).Public().Hex()
+	appSecretKey := newSecretKey(t)
+	err := store.Nwc.Set(ctx, nwc.Webhook{
+		WalletServicePubkey: walletServicePubkey,
+		AppPubkey:           appSecretKey.Public().Hex(),
+		Url:                 hook.URL,
+		Relays:              []string{relays[0].url, relays[1].url},
+	})
+	assert.NilError(t, err, "failed to set webhook")
+
+	manager := NewNostrManager(store, nil, nil)
+	assert.NilError(t, manager.Start(), "failed to start manager")
+	defer manager.Stop()
+	waitFor(t, func() bool {
+		return relays[0].subscriptions() >= 1 && relays[1].subscriptions() >= 1
+	}, "shards not subscribed")
+
+	request := newRequest(t, appSecretKey, walletServicePubkey, time.Now().Unix())
+	publishEvent(t, relays[0], request)
+	publishEvent(t, relays[1], request)
+	waitFor(t, func() bool { return received.Load() > 0 }, "request not forwarded")
+
+	// Another wallet landing in the same shards resubscribes them while the delivery is running
+	otherWallet := newSecretKey(t).Public().Hex()
+	manager.AddSubscription(ctx, otherWallet, appSecretKey.Public().Hex(), []string{relays[0].url, relays[1].url})
+	waitFor(t, func() bool {
+		return relays[0].subscriptions() >= 2 && relays[1].subscriptions() >= 2
+	}, "shards not resubscribed")
+	release <- struct{}{}
+
+	waitFor(t, func() bool {
+		forwarded, _ := store.Nwc.IsEventForwarded(ctx, request.ID.Hex())
+		return forwarded
+	}, "request not marked as forwarded")
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, received.Load(), int32(1))
+}
+
+func TestReRegistrationDropsRelays(t *testing.T) {
+	ctx := context.Background()
+	store := persist.NewMemoryStore()
+	manager := NewNostrManager(store, nil, nil)
+	walletServicePubkey := strings.Repeat("01", 32)
+	firstApp, secondApp := strings.Repeat("02", 32), strings.Repeat("03", 32)
+	register := func(appPubkey string, relays []string) {
+		err := store.Nwc.Set(ctx, nwc.Webhook{
+			WalletServicePubkey: walletServicePubkey,
+			AppPubkey:           appPubkey,
+			Url:                 "http://example.com/webhook",
+			Relays:              relays,
+		})
+		assert.NilError(t, err, "failed to set webhook")
+		manager.AddSubscription(ctx, walletServicePubkey, appPubkey, relays)
+	}
+
+	register(firstApp, []string{"wss://a.example.com", "wss://b.example.com"})
+	register(secondApp, []string{"wss://b.example.com", "wss://c.example.com"})
+	assert.Equal(t, len(manager.wallets[walletServicePubkey].Relays), 3)
+
+	// The relay still used by the other app is kept
+	register(firstApp, []string{"wss://c.example.com"})
+	assert.DeepEqual(t, manager.wallets[walletServicePubkey].Relays, map[string]bool{
+		"wss://b.example.com": true,
+		"wss://c.example.com": true,
+	})
+	_, subscribed := manager.shards.wallets[walletServicePubkey]["wss://a.example.com"]
+	assert.Check(t, !subscribed, "dropped relay should be unsubscribed")
+	_, exists := manager.shards.relays["wss://a.example.com"]
+	assert.Check(t, !exists, "empty relay should be dropped")
+	assert.Equal(t, len(manager.shards.wallets[walletServicePubkey]), 2)
+}
@@ -0,0 +1,125 @@
+package nwc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr"
+	nwc "github.com/breez/breez-lnurl/persist/nwc"
+)
+
+// The NIP-47 wallet notification kinds, encrypted with NIP-04 and NIP-44.
+const (
+	KindNWCNotificationNip04 nostr.Kind = 23196
+	KindNWCNotification      nostr.Kind = 23197
+)
+
+// The number of attempts to publish a notification to the relays that did not accept it yet.
+var NotificationMaxAttempts int = 5
+
+// The delay before retrying to publish a notification, doubled on each attempt.
+var NotificationRetryBaseDelay time.Duration = 5 * time.Second
+
+// The time to wait for the relays to accept a notification on each attempt.
+var NotificationPublishTimeout time.Duration = 30 * time.Second
+
+func isNotificationKind(kind nostr.Kind) bool {
+	return kind == KindNWCNotificationNip04 || kind == KindNWCNotification
+}
+
+/*
+PublishNotification stores the notification and publishes it in the background
+to its relays. Returns the stored notification if it was already submitted.
+*/
+func (nm *NostrManager) PublishNotification(ctx context.Context, notification nwc.Notification, event nostr.Event) (*nwc.Notification, error) {
+	notification.Status = nwc.NotificationStatusPending
+	added, err := nm.store.Nwc.AddNotification(ctx, notification)
+	if err != nil {
+		return nil, err
+	}
+	if !added {
+		return nm.store.Nwc.GetNotification(ctx, notification.EventId)
+	}
+
+	go nm.publishNotification(notification, event)
+	return &notification, nil
+}
+
+// Resumes publishing the notifications left pending by a previous run.
+func (nm *NostrManager) resumeNotifications() {
+	notifications, err := nm.store.Nwc.GetPendingNotifications(nm.ctx)
+	if err != nil {
+		log.Printf("failed to get pending notifications: %v", err)
+		return
+	}
+	for _, notification := range notifications {
+		var event nostr.Event
+		if err := json.Unmarshal([]byte(notification.Event), &event); err != nil {
+			log.Printf("failed to decode notification %v: %v", notification.EventId, err)
+			continue
+		}
+		go nm.publishNotification(notification, event)
+	}
+}
+
+/*
+publishNotification publishes the event to the relays that did not accept it
+yet, retrying with a backoff. The notification is published once accepted by
+any relay, and failed if no relay accepted it after all attempts.
+*/
+func (nm *NostrManager) publishNotification(notification nwc.Notification, event nostr.Event) {
+	for notification.Attempts < NotificationMaxAttempts {
+		var remaining []string
+		for _, relay := range notification.Relays {
+			if !slices.Contains(notification.PublishedRelays, relay) {
+				remaining = append(remaining, relay)
+			}
+		}
+		if len(remaining) == 0 {
+			break
+		}
+
+		if notification.Attempts > 0 {
+			select {
+			case <-time.After(NotificationRetryBaseDelay << (notification.Attempts - 1)):
+			case <-nm.ctx.Done():
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(nm.ctx, NotificationPublishTimeout)
+		var errs []string
+		for result := range nm.pool.PublishMany(ctx, remaining, event) {
+			if result.Error != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", result.RelayURL, result.Error))
+				continue
+			}
+			notification.PublishedRelays = append(notification.PublishedRelays, result.RelayURL)
+		}
+		cancel()
+
+		notification.Attempts++
+		notification.LastError = nil
+		if len(errs) > 0 {
+			lastError := strings.Join(errs, "; ")
+			notification.LastError = &lastError
+			log.Printf("failed to publish notification %v (attempt %v): %v", notification.EventId, notification.Attempts, lastError)
+		}
+		if len(notification.PublishedRelays) > 0 {
+			notification.Status = nwc.NotificationStatusPublished
+		} else if notification.Attempts >= NotificationMaxAttempts {
+			notification.Status = nwc.NotificationStatusFailed
+		}
+		if err := nm.store.Nwc.UpdateNotification(nm.ctx, notification); err != nil {
+			log.Printf("failed to update notification %v: %v", notification.EventId, err)
+		}
+	}
+
+	log.Printf("notification %v %v to %d/%d relays", notification.EventId, notification.Status,
+		len(notification.PublishedRelays), len(notification.Relays))
+}
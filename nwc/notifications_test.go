@@ -0,0 +1,119 @@
+package nwc
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/breez/breez-lnurl/persist"
+	nwc "github.com/breez/breez-lnurl/persist/nwc"
+	"gotest.tools/assert"
+)
+
+func newSecretKey(t *testing.T) nostr.SecretKey {
+	var secretKey nostr.SecretKey
+	_, err := rand.Read(secretKey[:])
+	assert.NilError(t, err, "failed to generate key")
+	return secretKey
+}
+
+func waitFor(t *testing.T, condition func() bool, message string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newNotificationEvent(t *testing.T, secretKey nostr.SecretKey, appPubkey string, kind nostr.Kind) nostr.Event {
+	event := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      kind,
+		Tags:      nostr.Tags{{"p", appPubkey}},
+		Content:   "notification",
+	}
+	assert.NilError(t, event.Sign(secretKey), "failed to sign event")
+	return event
+}
+
+func TestResumeNotifications(t *testing.T) {
+	ctx := context.Background()
+	relay := newTestRelay(t)
+	store := persist.NewMemoryStore()
+	walletSecretKey := newSecretKey(t)
+	appPubkey := newSecretKey(t).Public().Hex()
+	event := newNotificationEvent(t, walletSecretKey, appPubkey, KindNWCNotification)
+	raw, err := event.MarshalJSON()
+	assert.NilError(t, err, "failed to encode event")
+
+	// The notification was left pending by the previous run
+	_, err = store.Nwc.AddNotification(ctx, nwc.Notification{
+		EventId:             event.ID.Hex(),
+		WalletServicePubkey: walletSecretKey.Public().Hex(),
+		AppPubkey:           appPubkey,
+		Event:               string(raw),
+		Relays:              []string{relay.url},
+		Status:              nwc.NotificationStatusPending,
+	})
+	assert.NilError(t, err, "failed to add notification")
+
+	manager := NewNostrManager(store, nil, nil)
+	assert.NilError(t, manager.Start(), "failed to start manager")
+	defer manager.Stop()
+	waitFor(t, func() bool {
+		notification, _ := store.Nwc.GetNotification(ctx, event.ID.Hex())
+		return notification != nil && notification.Status == nwc.NotificationStatusPublished
+	}, "notification not resumed")
+	notification, err := store.Nwc.GetNotification(ctx, event.ID.Hex())
+	assert.NilError(t, err, "failed to get notification")
+	assert.DeepEqual(t, notification.PublishedRelays, []string{relay.url})
+	assert.Equal(t, relay.count(int(KindNWCNotification)), 1)
+}
+
+func TestPublishNotificationFailed(t *testing.T) {
+	defer func(attempts int, delay, timeout time.Duration) {
+		NotificationMaxAttempts, NotificationRetryBaseDelay, NotificationPublishTimeout = attempts, delay, timeout
+	}(NotificationMaxAttempts, NotificationRetryBaseDelay, NotificationPublishTimeout)
+	NotificationMaxAttempts = 2
+	NotificationRetryBaseDelay = 10 * time.Millisecond
+	NotificationPublishTimeout = 500 * time.Millisecond
+
+	ctx := context.Background()
+	store := persist.NewMemoryStore()
+	manager := NewNostrManager(store, nil, nil)
+	assert.NilError(t, manager.Start(), "failed to start manager")
+	defer manager.Stop()
+
+	walletSecretKey := newSecretKey(t)
+	appPubkey := newSecretKey(t).Public().Hex()
+	event := newNotificationEvent(t, walletSecretKey, appPubkey, KindNWCNotificationNip04)
+	notification, err := manager.PublishNotification(ctx, nwc.Notification{
+		EventId:             event.ID.Hex(),
+		WalletServicePubkey: walletSecretKey.Public().Hex(),
+		AppPubkey:           appPubkey,
+		Event:               "{}",
+		Relays:              []string{"ws://127.0.0.1:1"},
+	}, event)
+	assert.NilError(t, err, "failed to publish notification")
+	assert.Equal(t, notification.Status, nwc.NotificationStatusPending)
+
+	// No relay accepts the notification after all the attempts
+	waitFor(t, func() bool {
+		notification, _ := store.Nwc.GetNotification(ctx, event.ID.Hex())
+		return notification != nil && notification.Status == nwc.NotificationStatusFailed
+	}, "notification not failed")
+	notification, err = store.Nwc.GetNotification(ctx, event.ID.Hex())
+	assert.NilError(t, err, "failed to get notification")
+	assert.Equal(t, notification.Attempts, NotificationMaxAttempts)
+	assert.Check(t, notification.LastError != nil, "last error should be recorded")
+	assert.Equal(t, len(notification.PublishedRelays), 0)
+
+	// Submitting the notification again returns its status
+	notification, err = manager.PublishNotification(ctx, nwc.Notification{EventId: event.ID.Hex()}, event)
+	assert.NilError(t, err, "failed to publish notification")
+	assert.Equal(t, notification.Status, nwc.NotificationStatusFailed)
+}
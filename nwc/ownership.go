@@ -0,0 +1,159 @@
+package nwc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+// The interval to renew the lease of the instance and rebalance the wallets
+// between the instances. Kept below BackfillOverlap, so the requests sent to
+// a wallet registered through another instance are caught up.
+var InstanceSyncInterval time.Duration = 15 * time.Second
+
+// The duration after which an instance not renewing its lease is considered gone.
+var InstanceLeaseDuration time.Duration = 45 * time.Second
+
+// newInstanceId returns a unique id for the instance, prefixed with the hostname for debugging.
+func newInstanceId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "instance"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
+
+/*
+ownerOf returns the instance owning the wallet using rendezvous hashing, so
+an instance joining or leaving only moves its own share of the wallets.
+*/
+func ownerOf(instances []string, walletServicePubkey string) string {
+	var owner string
+	var highest uint64
+	for _, instance := range instances {
+		hash := sha256.Sum256([]byte(instance + "/" + walletServicePubkey))
+		if score := binary.BigEndian.Uint64(hash[:8]); owner == "" || score > highest {
+			owner = instance
+			highest = score
+		}
+	}
+	return owner
+}
+
+// owns returns whether the wallet is owned by this instance. The caller must hold the lock.
+func (nm *NostrManager) owns(walletServicePubkey string) bool {
+	return len(nm.instances) == 0 || ownerOf(nm.instances, walletServicePubkey) == nm.instanceId
+}
+
+// renewLease renews the lease of the instance and returns the instances alive.
+func (nm *NostrManager) renewLease(ctx context.Context) ([]string, error) {
+	if err := nm.store.Nwc.RenewInstanceLease(ctx, nm.instanceId, InstanceLeaseDuration); err != nil {
+		return nil, err
+	}
+	return nm.store.Nwc.GetInstances(ctx)
+}
+
+// Periodically rebalances the wallets between the instances until the context is done.
+func (nm *NostrManager) syncOwnership(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(InstanceSyncInterval):
+		case <-ctx.Done():
+			return
+		}
+		if err := nm.rebalance(ctx); err != nil {
+			log.Printf("failed to rebalance the wallets of instance %s: %v", nm.instanceId, err)
+		}
+	}
+}
+
+/*
+rebalance renews the lease of the instance and reconciles the subscribed
+wallets with the stored subscriptions it owns. The wallets handed over to
+another instance are dropped, and the wallets taken over are subscribed
+with a backfill of the requests missed during the handoff. The relays no
+longer stored for a wallet are unsubscribed.
+*/
+func (nm *NostrManager) rebalance(ctx context.Context) error {
+	instances, err := nm.renewLease(ctx)
+	if err != nil {
+		return err
+	}
+	activeSubscriptions, err := nm.store.Nwc.GetSubscriptionDetails(ctx)
+	if err != nil {
+		return err
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if !nm.isRunning {
+		return nil
+	}
+	if !slices.Equal(instances, nm.instances) {
+		log.Printf("NWC instances changed: %v", instances)
+	}
+	nm.instances = instances
+
+	// The wallets added since the subscriptions were read are kept
+	recent := nm.recent
+	nm.recent = make(map[string]bool)
+
+	var dropped, taken int
+	for walletServicePubkey := range nm.wallets {
+		_, stored := activeSubscriptions[walletServicePubkey]
+		if (!stored && !recent[walletServicePubkey]) || !nm.owns(walletServicePubkey) {
+			nm.dropWallet(walletServicePubkey)
+			dropped++
+		}
+	}
+
+	for walletServicePubkey, storedDetails := range activeSubscriptions {
+		if !nm.owns(walletServicePubkey) {
+			continue
+		}
+		details, exists := nm.wallets[walletServicePubkey]
+		if !exists {
+			nm.wallets[walletServicePubkey] = &storedDetails
+			for relay := range storedDetails.Relays {
+				if sh := nm.shards.add(walletServicePubkey, relay); sh != nil {
+					nm.markDirty(true, sh)
+				}
+			}
+			taken++
+			continue
+		}
+
+		// Pick up the changes registered through the other instances
+		if !recent[walletServicePubkey] {
+			details.AppPubkeys = storedDetails.AppPubkeys
+			for relay := range details.Relays {
+				if !storedDetails.Relays[relay] {
+					nm.removeRelay(walletServicePubkey, relay)
+				}
+			}
+		}
+		details.HighWaterMark = max(details.HighWaterMark, storedDetails.HighWaterMark)
+		for relay := range storedDetails.Relays {
+			if details.Relays[relay] {
+				continue
+			}
+			details.Relays[relay] = true
+			if sh := nm.shards.add(walletServicePubkey, relay); sh != nil {
+				nm.markDirty(false, sh)
+			}
+		}
+	}
+
+	if dropped > 0 || taken > 0 {
+		log.Printf("Instance %s dropped %d and took over %d wallet pubkeys", nm.instanceId, dropped, taken)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package nwc
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/breez/breez-lnurl/persist"
+	nwc "github.com/breez/breez-lnurl/persist/nwc"
+	"gotest.tools/assert"
+)
+
+func TestOwnerOf(t *testing.T) {
+	instances := []string{"instance-a", "instance-b", "instance-c"}
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		wallet := fmt.Sprintf("wallet%d", i)
+		owners[wallet] = ownerOf(instances, wallet)
+		counts[owners[wallet]]++
+	}
+	for _, instance := range instances {
+		assert.Assert(t, counts[instance] > 800, "wallets should be spread evenly, %s owns %d", instance, counts[instance])
+	}
+
+	// Only the wallets of the leaving instance move
+	remaining := []string{"instance-a", "instance-c"}
+	for wallet, owner := range owners {
+		newOwner := ownerOf(remaining, wallet)
+		if owner != "instance-b" {
+			assert.Equal(t, newOwner, owner)
+		} else {
+			assert.Assert(t, newOwner != "instance-b")
+		}
+	}
+
+	// A joining instance only takes wallets over
+	joined := append(instances, "instance-d")
+	for wallet, owner := range owners {
+		if newOwner := ownerOf(joined, wallet); newOwner != owner {
+			assert.Equal(t, newOwner, "instance-d")
+		}
+	}
+
+	assert.Equal(t, ownerOf(nil, "wallet0"), "")
+}
+
+func TestRebalanceHandoff(t *testing.T) {
+	defer func(interval, delay time.Duration) {
+		InstanceSyncInterval, ShardResubscribeDelay = interval, delay
+	}(InstanceSyncInterval, ShardResubscribeDelay)
+	// The wallets are only rebalanced by the test, the changed shards being kept dirty
+	InstanceSyncInterval = time.Hour
+	ShardResubscribeDelay = time.Hour
+
+	ctx := context.Background()
+	relay := newTestRelay(t)
+	store := persist.NewMemoryStore()
+	appPubkey := strings.Repeat("02", 32)
+	highWaterMark := time.Now().Add(-10 * time.Minute).Unix()
+	var wallets []string
+	for i := 0; i < 20; i++ {
+		wallet := fmt.Sprintf("%064x", i+1)
+		err := store.Nwc.Set(ctx, nwc.Webhook{
+			WalletServicePubkey: wallet,
+			AppPubkey:           appPubkey,
+			Url:                 "http://example.com/webhook",
+			Relays:              []string{relay.url},
+		})
+		assert.NilError(t, err, "failed to set webhook")
+		assert.NilError(t, store.Nwc.SetHighWaterMark(ctx, wallet, highWaterMark), "failed to set high-water mark")
+		wallets = append(wallets, wallet)
+	}
+	owned := func(nm *NostrManager) []string {
+		nm.mu.RLock()
+		defer nm.mu.RUnlock()
+		return slices.Sorted(maps.Keys(nm.wallets))
+	}
+	subscribed := func(nm *NostrManager, wallet string, relay string) bool {
+		nm.mu.RLock()
+		defer nm.mu.RUnlock()
+		_, exists := nm.shards.wallets[wallet][relay]
+		return exists
+	}
+
+	first := NewNostrManager(store, nil, nil)
+	assert.NilError(t, first.Start(), "failed to start first manager")
+	defer first.Stop()
+	assert.DeepEqual(t, owned(first), wallets)
+
+	second := NewNostrManager(store, nil, nil)
+	assert.NilError(t, second.Start(), "failed to start second manager")
+	defer second.Stop()
+	instances := []string{first.instanceId, second.instanceId}
+	slices.Sort(instances)
+	ownedBy := func(instance string) []string {
+		return slices.DeleteFunc(slices.Clone(wallets), func(wallet string) bool {
+			return ownerOf(instances, wallet) != instance
+		})
+	}
+	handedOver := ownedBy(second.instanceId)
+	assert.Assert(t, len(handedOver) > 0, "second instance should own wallets")
+	assert.DeepEqual(t, owned(second), handedOver)
+
+	// The first instance drops the wallets handed over to the second one
+	assert.NilError(t, first.rebalance(ctx), "failed to rebalance")
+	assert.DeepEqual(t, owned(first), ownedBy(first.instanceId))
+	for _, wallet := range handedOver {
+		assert.Check(t, !subscribed(first, wallet, relay.url), "handed over wallet should be unsubscribed")
+	}
+
+	// The wallets of the stopped instance are taken over, backfilling the requests missed since their high-water mark
+	second.Stop()
+	assert.NilError(t, first.rebalance(ctx), "failed to rebalance")
+	assert.DeepEqual(t, owned(first), wallets)
+	first.mu.RLock()
+	for _, wallet := range handedOver {
+		sh := first.shards.wallets[wallet][relay.url]
+		assert.Check(t, sh != nil && first.dirty[sh], "taken over wallet should be backfilled")
+		if sh != nil {
+			assert.Check(t, first.shardSince(sh, first.dirty[sh]) == backfillSince(highWaterMark), "backfill should start from the high-water mark")
+		}
+	}
+	first.mu.RUnlock()
+
+	// The changes registered since the subscriptions were read are kept until the next rebalance
+	unstoredWallet := fmt.Sprintf("%064x", 100)
+	unstoredRelay := "wss://unstored.example.com"
+	first.AddSubscription(ctx, unstoredWallet, appPubkey, []string{relay.url})
+	first.AddSubscription(ctx, wallets[0], appPubkey, []string{relay.url, unstoredRelay})
+	assert.NilError(t, first.rebalance(ctx), "failed to rebalance")
+	assert.Check(t, slices.Contains(owned(first), unstoredWallet), "recent wallet should be kept")
+	assert.Check(t, subscribed(first, wallets[0], unstoredRelay), "recent relay should be kept")
+
+	assert.NilError(t, first.rebalance(ctx), "failed to rebalance")
+	assert.DeepEqual(t, owned(first), wallets)
+	assert.Check(t, !subscribed(first, wallets[0], unstoredRelay), "relay no longer stored should be unsubscribed")
+	assert.Check(t, subscribed(first, wallets[0], relay.url), "stored relay should be kept")
+}
@@ -0,0 +1,47 @@
+package nwc
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"fiatjaf.com/nostr"
+	nwc "github.com/breez/breez-lnurl/persist/nwc"
+)
+
+// The duration incoming requests are kept for the app to pull them.
+var PendingEventTTL time.Duration = time.Hour
+
+// The maximum number of events returned by a single pull.
+var PendingEventsLimit int = 100
+
+// storePendingEvent keeps the request until its expiration tag or the TTL, whichever is earlier.
+func (nm *NostrManager) storePendingEvent(ctx context.Context, event nostr.Event, walletServicePubkey string) {
+	expiresAt := time.Now().Add(PendingEventTTL)
+	if tag := event.Tags.Find("expiration"); len(tag) >= 2 {
+		if expiration, err := strconv.ParseInt(tag[1], 10, 64); err == nil && time.Unix(expiration, 0).Before(expiresAt) {
+			expiresAt = time.Unix(expiration, 0)
+		}
+	}
+	if !expiresAt.After(time.Now()) {
+		return
+	}
+
+	eventJson, err := event.MarshalJSON()
+	if err != nil {
+		log.Printf("failed to json-encode event %s: %v", event.ID.Hex(), err)
+		return
+	}
+	err = nm.store.Nwc.AddPendingEvent(ctx, nwc.PendingEvent{
+		EventId:             event.ID.Hex(),
+		WalletServicePubkey: walletServicePubkey,
+		AppPubkey:           event.PubKey.Hex(),
+		Event:               string(eventJson),
+		CreatedAt:           int64(event.CreatedAt),
+		ExpiresAt:           expiresAt,
+	})
+	if err != nil {
+		log.Printf("failed to store pending event %s: %v", event.ID.Hex(), err)
+	}
+}
@@ -0,0 +1,178 @@
+package nwc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/breez/breez-lnurl/channel"
+	"github.com/breez/breez-lnurl/constant"
+)
+
+var (
+	ErrTooManyRelays   = errors.New("too many relays")
+	ErrInvalidRelay    = errors.New("invalid relay url")
+	ErrRelayScheme     = errors.New("relay url scheme must be wss")
+	ErrPrivateRelay    = errors.New("relay host is a private address")
+	ErrRelayNotAllowed = errors.New("relay is not allowed")
+)
+
+/*
+RelayPolicy validates the relays registered for the webhooks. The relay urls
+are canonicalised, only public wss relays are accepted, and the allow and
+deny lists are matched against the relay host and its parent domains. An
+allowed host may be a private address, for relays run inside the network.
+The other hosts are resolved and rejected if any of their addresses is
+private. A host failing to resolve is accepted, like a relay temporarily
+down.
+*/
+type RelayPolicy struct {
+	allow     []string
+	deny      []string
+	maxRelays int
+	lookup    func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewRelayPolicy creates a policy. An empty allow list allows all the public relays.
+func NewRelayPolicy(allow []string, deny []string, maxRelays int) *RelayPolicy {
+	if maxRelays <= 0 {
+		maxRelays = constant.NWC_MAX_RELAYS_LENGTH
+	}
+	normalize := func(hosts []string) []string {
+		var normalized []string
+		for _, host := range hosts {
+			if host = strings.Trim(strings.ToLower(strings.TrimSpace(host)), "."); host != "" {
+				normalized = append(normalized, host)
+			}
+		}
+		return normalized
+	}
+	return &RelayPolicy{
+		allow:     normalize(allow),
+		deny:      normalize(deny),
+		maxRelays: maxRelays,
+		lookup:    net.DefaultResolver.LookupIPAddr,
+	}
+}
+
+// DefaultRelayPolicy accepts the public wss relays, up to the default max relays per webhook.
+func DefaultRelayPolicy() *RelayPolicy {
+	return NewRelayPolicy(nil, nil, 0)
+}
+
+/*
+Apply returns the canonical urls of the relays, without duplicates and in
+the given order, or an error for the first relay rejected.
+*/
+func (p *RelayPolicy) Apply(ctx context.Context, relays []string) ([]string, error) {
+	var canonical []string
+	seen := make(map[string]bool)
+	for _, relay := range relays {
+		relayUrl, err := p.Check(ctx, relay)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, relay)
+		}
+		if seen[relayUrl] {
+			continue
+		}
+		seen[relayUrl] = true
+		canonical = append(canonical, relayUrl)
+	}
+	if len(canonical) > p.maxRelays {
+		return nil, fmt.Errorf("%w: %d > %d", ErrTooManyRelays, len(canonical), p.maxRelays)
+	}
+	return canonical, nil
+}
+
+// Check returns the canonical url of the relay, or an error if the relay is rejected.
+func (p *RelayPolicy) Check(ctx context.Context, relay string) (string, error) {
+	relayUrl, err := CanonicalRelayURL(relay)
+	if err != nil {
+		return "", err
+	}
+	parsed, _ := url.Parse(relayUrl)
+	host := parsed.Hostname()
+	if matchesHost(p.deny, host) {
+		return "", ErrRelayNotAllowed
+	}
+	allowed := matchesHost(p.allow, host)
+	if len(p.allow) > 0 && !allowed {
+		return "", ErrRelayNotAllowed
+	}
+	if !allowed && (isPrivateHost(host) || p.resolvesToPrivate(ctx, host)) {
+		return "", ErrPrivateRelay
+	}
+	return relayUrl, nil
+}
+
+/*
+CanonicalRelayURL returns the canonical form of a relay url: lowercase
+scheme and host, no default port and no trailing slash. Urls with
+credentials, a query or a fragment are rejected.
+*/
+func CanonicalRelayURL(relay string) (string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(relay))
+	if err != nil || parsed.Host == "" || parsed.Opaque != "" {
+		return "", ErrInvalidRelay
+	}
+	if parsed.User != nil || parsed.RawQuery != "" || parsed.Fragment != "" || parsed.ForceQuery {
+		return "", ErrInvalidRelay
+	}
+	if strings.ToLower(parsed.Scheme) != "wss" {
+		return "", ErrRelayScheme
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	if host == "" {
+		return "", ErrInvalidRelay
+	}
+	switch port := parsed.Port(); {
+	case port != "" && port != "443":
+		host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		host = "[" + host + "]"
+	}
+	return "wss://" + host + strings.TrimRight(parsed.EscapedPath(), "/"), nil
+}
+
+// matchesHost returns whether the host is one of the hosts or a subdomain of one of them.
+func matchesHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateHost returns whether the host is a local name or a non-public ip address.
+func isPrivateHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".local") || strings.HasSuffix(host, ".internal") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return channel.IsPrivateIP(ip)
+}
+
+// resolvesToPrivate returns whether any of the addresses the host name resolves to is not public.
+func (p *RelayPolicy) resolvesToPrivate(ctx context.Context, host string) bool {
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	addrs, err := p.lookup(ctx, host)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if channel.IsPrivateIP(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
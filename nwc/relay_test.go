@@ -0,0 +1,195 @@
+package nwc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coder/websocket"
+)
+
+type relayFilter struct {
+	Kinds []int    `json:"kinds"`
+	Since *int64   `json:"since"`
+	P     []string `json:"#p"`
+}
+
+type relayEvent struct {
+	ID        string     `json:"id"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+}
+
+func (f relayFilter) matches(event relayEvent) bool {
+	if len(f.Kinds) > 0 && !slices.Contains(f.Kinds, event.Kind) {
+		return false
+	}
+	if f.Since != nil && event.CreatedAt < *f.Since {
+		return false
+	}
+	if len(f.P) > 0 && !slices.ContainsFunc(event.Tags, func(tag []string) bool {
+		return len(tag) >= 2 && tag[0] == "p" && slices.Contains(f.P, tag[1])
+	}) {
+		return false
+	}
+	return true
+}
+
+type relayConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+	subs map[string][]relayFilter
+}
+
+func (c *relayConn) send(message ...any) {
+	data, _ := json.Marshal(message)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write(context.Background(), websocket.MessageText, data)
+}
+
+/*
+testRelay is a minimal in-process NIP-01 relay storing all the events and
+serving the REQ and EVENT messages.
+*/
+type testRelay struct {
+	mu     sync.Mutex
+	events []json.RawMessage
+	reqs   int
+	conns  map[*relayConn]bool
+	server *httptest.Server
+	url    string
+}
+
+func newTestRelay(t *testing.T) *testRelay {
+	relay := &testRelay{conns: make(map[*relayConn]bool)}
+	relay.server = httptest.NewServer(http.HandlerFunc(relay.serve))
+	relay.url = strings.Replace(relay.server.URL, "http://", "ws://", 1)
+	t.Cleanup(relay.server.Close)
+	return relay
+}
+
+func (r *testRelay) serve(w http.ResponseWriter, req *http.Request) {
+	conn, err := websocket.Accept(w, req, nil)
+	if err != nil {
+		return
+	}
+	c := &relayConn{conn: conn, subs: make(map[string][]relayFilter)}
+	r.mu.Lock()
+	r.conns[c] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, c)
+		r.mu.Unlock()
+		conn.CloseNow()
+	}()
+
+	for {
+		_, data, err := conn.Read(context.Background())
+		if err != nil {
+			return
+		}
+		var message []json.RawMessage
+		if err := json.Unmarshal(data, &message); err != nil || len(message) < 2 {
+			continue
+		}
+		var messageType, subId string
+		json.Unmarshal(message[0], &messageType)
+		switch messageType {
+		case "REQ":
+			json.Unmarshal(message[1], &subId)
+			var filters []relayFilter
+			for _, raw := range message[2:] {
+				var filter relayFilter
+				json.Unmarshal(raw, &filter)
+				filters = append(filters, filter)
+			}
+			r.mu.Lock()
+			r.reqs++
+			c.mu.Lock()
+			c.subs[subId] = filters
+			c.mu.Unlock()
+			stored := slices.Clone(r.events)
+			r.mu.Unlock()
+			for _, raw := range stored {
+				if matchesAny(filters, raw) {
+					c.send("EVENT", subId, raw)
+				}
+			}
+			c.send("EOSE", subId)
+		case "CLOSE":
+			json.Unmarshal(message[1], &subId)
+			c.mu.Lock()
+			delete(c.subs, subId)
+			c.mu.Unlock()
+		case "EVENT":
+			var event relayEvent
+			json.Unmarshal(message[1], &event)
+			r.publish(message[1])
+			c.send("OK", event.ID, true, "")
+		}
+	}
+}
+
+// subscriptions returns the number of REQ messages received.
+func (r *testRelay) subscriptions() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reqs
+}
+
+// count returns the number of events of the kind received.
+func (r *testRelay) count(kind int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for _, raw := range r.events {
+		var event relayEvent
+		if json.Unmarshal(raw, &event) == nil && event.Kind == kind {
+			count++
+		}
+	}
+	return count
+}
+
+// publish stores the event and sends it to the matching subscriptions.
+func (r *testRelay) publish(raw json.RawMessage) {
+	r.mu.Lock()
+	r.events = append(r.events, raw)
+	conns := make([]*relayConn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		var subIds []string
+		for subId, filters := range c.subs {
+			if matchesAny(filters, raw) {
+				subIds = append(subIds, subId)
+			}
+		}
+		c.mu.Unlock()
+		for _, subId := range subIds {
+			c.send("EVENT", subId, raw)
+		}
+	}
+}
+
+func matchesAny(filters []relayFilter, raw json.RawMessage) bool {
+	var event relayEvent
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return false
+	}
+	return slices.ContainsFunc(filters, func(filter relayFilter) bool {
+		return filter.matches(event)
+	})
+}
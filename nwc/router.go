@@ -3,11 +3,18 @@ package nwc
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
+	"fiatjaf.com/nostr"
+	"github.com/breez/breez-lnurl/channel"
+	"github.com/breez/breez-lnurl/constant"
 	"github.com/breez/breez-lnurl/persist"
 	nwc "github.com/breez/breez-lnurl/persist/nwc"
 	"github.com/breez/lspd/lightning"
@@ -17,30 +24,47 @@ import (
 type NostrEventsRouter struct {
 	store   *persist.Store
 	manager *NostrManager
+	policy  *RelayPolicy
+	webhook *channel.WebhookClient
 	rootURL *url.URL
 }
 
-func RegisterNostrEventsRouter(router *mux.Router, rootURL *url.URL, store *persist.Store, cleanupService *nwc.CleanupService) {
+func RegisterNostrEventsRouter(router *mux.Router, adminRouter *mux.Router, rootURL *url.URL, store *persist.Store, cleanupService *nwc.CleanupService, relayAuth *RelayAuth, relayPolicy *RelayPolicy, webhookClient *channel.WebhookClient) {
+	if webhookClient == nil {
+		webhookClient = channel.NewDefaultWebhookClient()
+	}
+	if relayPolicy == nil {
+		relayPolicy = DefaultRelayPolicy()
+	}
 	NostrEventsRouter := &NostrEventsRouter{
 		store:   store,
-		manager: NewNostrManager(store),
+		manager: NewNostrManager(store, relayAuth, webhookClient),
+		policy:  relayPolicy,
+		webhook: webhookClient,
 		rootURL: rootURL,
 	}
 	NostrEventsRouter.manager.Start()
 	router.HandleFunc("/nwc/{pubkey}", NostrEventsRouter.Register).Methods("POST")
 	router.HandleFunc("/nwc/{pubkey}", NostrEventsRouter.Unregister).Methods("DELETE")
+	router.HandleFunc("/nwc/{pubkey}/notifications", NostrEventsRouter.PublishNotification).Methods("POST")
+	router.HandleFunc("/nwc/{pubkey}/events", NostrEventsRouter.GetPendingEvents).Methods("GET")
+	adminRouter.HandleFunc("/nwc/relays", NostrEventsRouter.RelayHealth).Methods("GET")
 }
 
 type RegisterNostrEventsRequest struct {
-	WebhookUrl          string   `json:"webhookUrl"`
-	WalletServicePubkey string   `json:"walletServicePubkey"`
-	AppPubkey           string   `json:"appPubkey"`
-	Relays              []string `json:"relays"`
-	Signature           string   `json:"signature"`
+	WebhookUrl          string       `json:"webhookUrl"`
+	WalletServicePubkey string       `json:"walletServicePubkey"`
+	AppPubkey           string       `json:"appPubkey"`
+	Relays              []string     `json:"relays"`
+	InfoEvent           *nostr.Event `json:"infoEvent,omitempty"`
+	Signature           string       `json:"signature"`
 }
 
 func (w *RegisterNostrEventsRequest) Verify(pubkey string) error {
 	messageToVerify := fmt.Sprintf("%v-%v-%v-%v", w.WebhookUrl, w.WalletServicePubkey, w.AppPubkey, w.Relays)
+	if w.InfoEvent != nil {
+		messageToVerify = fmt.Sprintf("%v-%v", messageToVerify, w.InfoEvent.ID.Hex())
+	}
 	verifiedPubkey, err := lightning.VerifyMessage([]byte(messageToVerify), w.Signature)
 	if err != nil {
 		return err
@@ -75,7 +99,33 @@ func (s *NostrEventsRouter) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := s.store.Nwc.Set(r.Context(), nwc.Webhook{
+	if err := s.webhook.ValidateURL(r.Context(), registerRequest.WebhookUrl); err != nil {
+		log.Printf("rejected webhook url %v: %v", registerRequest.WebhookUrl, err)
+		http.Error(w, "invalid webhook url", http.StatusBadRequest)
+		return
+	}
+
+	// The canonical relays are stored and subscribed to, the signature covers the relays as sent
+	relays, err := s.policy.Apply(r.Context(), registerRequest.Relays)
+	if err != nil {
+		log.Printf("rejected the relays of registration request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	registerRequest.Relays = relays
+
+	if infoEvent := registerRequest.InfoEvent; infoEvent != nil {
+		if infoEvent.Kind != nostr.KindNWCWalletInfo {
+			http.Error(w, "invalid info event kind", http.StatusBadRequest)
+			return
+		}
+		if infoEvent.PubKey.Hex() != registerRequest.WalletServicePubkey || !infoEvent.CheckID() || !infoEvent.VerifySignature() {
+			http.Error(w, "invalid info event signature", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = s.store.Nwc.Set(r.Context(), nwc.Webhook{
 		WalletServicePubkey: registerRequest.WalletServicePubkey,
 		Url:                 registerRequest.WebhookUrl,
 		AppPubkey:           registerRequest.AppPubkey,
@@ -87,7 +137,34 @@ func (s *NostrEventsRouter) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.manager.AddSubscription(registerRequest.WalletServicePubkey, registerRequest.AppPubkey, registerRequest.Relays)
+	if infoEvent := registerRequest.InfoEvent; infoEvent != nil {
+		rawEvent, err := infoEvent.MarshalJSON()
+		if err != nil {
+			log.Printf("failed to json-encode info event %v: %v", infoEvent.ID.Hex(), err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		err = s.store.Nwc.SetInfoEvent(r.Context(), nwc.InfoEvent{
+			WalletServicePubkey: registerRequest.WalletServicePubkey,
+			Event:               string(rawEvent),
+			CreatedAt:           int64(infoEvent.CreatedAt),
+		})
+		if err != nil {
+			log.Printf("failed to persist nwc info event: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The hosted info event is made available on the added relays, a new one on all the relays
+	publishRelays := s.manager.AddSubscription(r.Context(), registerRequest.WalletServicePubkey, registerRequest.AppPubkey, registerRequest.Relays)
+	if registerRequest.InfoEvent != nil {
+		// Published by the receiving instance, the wallet may be owned by another one
+		publishRelays = registerRequest.Relays
+	}
+	if len(publishRelays) > 0 {
+		go s.manager.PublishInfoEvent(registerRequest.WalletServicePubkey, publishRelays)
+	}
 
 	log.Printf("registration added: pubkey:%v\n", registerRequest.WalletServicePubkey)
 	w.Write([]byte("Pubkey registered successfully"))
@@ -145,3 +222,225 @@ func (s *NostrEventsRouter) Unregister(w http.ResponseWriter, r *http.Request) {
 	log.Printf("registration deleted: pubkey:%v\n", req.WalletServicePubkey)
 	w.Write([]byte("Pubkey unregistered successfully"))
 }
+
+type PublishNotificationRequest struct {
+	Time                int64       `json:"time"`
+	WalletServicePubkey string      `json:"walletServicePubkey"`
+	Event               nostr.Event `json:"event"`
+	Signature           string      `json:"signature"`
+}
+
+type PublishNotificationResponse struct {
+	EventId         string   `json:"eventId"`
+	Status          string   `json:"status"`
+	PublishedRelays []string `json:"publishedRelays"`
+}
+
+func (w *PublishNotificationRequest) Verify(pubkey string) error {
+	if math.Abs(float64(time.Now().Unix()-w.Time)) > constant.ACCEPTABLE_TIME_DIFF {
+		return errors.New("invalid time")
+	}
+	messageToVerify := fmt.Sprintf("%v-%v-%v", w.Time, w.WalletServicePubkey, w.Event.ID.Hex())
+	verifiedPubkey, err := lightning.VerifyMessage([]byte(messageToVerify), w.Signature)
+	if err != nil {
+		return err
+	}
+	if pubkey != hex.EncodeToString(verifiedPubkey.SerializeCompressed()) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+/*
+PublishNotification accepts a notification event signed by the wallet service
+and publishes it to the relays registered for the notified app. Submitting the
+same event again returns its publishing status.
+*/
+func (s *NostrEventsRouter) PublishNotification(w http.ResponseWriter, r *http.Request) {
+	var req PublishNotificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("json.NewDecoder.Decode error: %v", err)
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	params := mux.Vars(r)
+	pubkey, ok := params["pubkey"]
+	if !ok {
+		http.Error(w, "invalid pubkey", http.StatusBadRequest)
+		return
+	}
+
+	if err := req.Verify(pubkey); err != nil {
+		log.Printf("failed to verify notification request: %v", err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := req.Event
+	if !isNotificationKind(event.Kind) {
+		http.Error(w, "invalid event kind", http.StatusBadRequest)
+		return
+	}
+	if event.PubKey.Hex() != req.WalletServicePubkey || !event.CheckID() || !event.VerifySignature() {
+		http.Error(w, "invalid event signature", http.StatusBadRequest)
+		return
+	}
+	pTag := event.Tags.Find("p")
+	if len(pTag) < 2 {
+		http.Error(w, "missing event p tag", http.StatusBadRequest)
+		return
+	}
+	appPubkey := pTag[1]
+
+	webhook, err := s.store.Nwc.Get(r.Context(), req.WalletServicePubkey, appPubkey)
+	if err != nil || webhook == nil || len(webhook.Relays) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rawEvent, err := event.MarshalJSON()
+	if err != nil {
+		log.Printf("failed to json-encode event %v: %v", event.ID.Hex(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	notification, err := s.manager.PublishNotification(r.Context(), nwc.Notification{
+		EventId:             event.ID.Hex(),
+		WalletServicePubkey: req.WalletServicePubkey,
+		AppPubkey:           appPubkey,
+		Event:               string(rawEvent),
+		Relays:              webhook.Relays,
+	}, event)
+	if err != nil || notification == nil {
+		log.Printf("failed to publish notification %v: %v", event.ID.Hex(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(PublishNotificationResponse{
+		EventId:         notification.EventId,
+		Status:          notification.Status,
+		PublishedRelays: notification.PublishedRelays,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(body)
+}
+
+type GetPendingEventsRequest struct {
+	Time                int64
+	WalletServicePubkey string
+	Since               int64
+	After               string
+	Signature           string
+}
+
+type GetPendingEventsResponse struct {
+	Events []json.RawMessage `json:"events"`
+}
+
+func (w *GetPendingEventsRequest) Verify(pubkey string) error {
+	if math.Abs(float64(time.Now().Unix()-w.Time)) > constant.ACCEPTABLE_TIME_DIFF {
+		return errors.New("invalid time")
+	}
+	messageToVerify := fmt.Sprintf("%v-%v-%v", w.Time, w.WalletServicePubkey, w.Since)
+	if w.After != "" {
+		messageToVerify = fmt.Sprintf("%v-%v", messageToVerify, w.After)
+	}
+	verifiedPubkey, err := lightning.VerifyMessage([]byte(messageToVerify), w.Signature)
+	if err != nil {
+		return err
+	}
+	if pubkey != hex.EncodeToString(verifiedPubkey.SerializeCompressed()) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+/*
+GetPendingEvents returns the unexpired wallet requests the app sent to the
+wallet service since the given time, so the app can drain them without
+connecting to the relays. Only an app registered for the wallet service is
+served. The following pages are fetched after the created_at and the id of
+the last event returned, the events created in the same second being ordered
+by id.
+*/
+func (s *NostrEventsRouter) GetPendingEvents(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	pubkey, ok := params["pubkey"]
+	if !ok {
+		http.Error(w, "invalid pubkey", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	requestTime, err := strconv.ParseInt(query.Get("time"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid time", http.StatusBadRequest)
+		return
+	}
+	var since int64
+	if sinceParam := query.Get("since"); sinceParam != "" {
+		if since, err = strconv.ParseInt(sinceParam, 10, 64); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	req := GetPendingEventsRequest{
+		Time:                requestTime,
+		WalletServicePubkey: query.Get("walletServicePubkey"),
+		Since:               since,
+		After:               query.Get("after"),
+		Signature:           query.Get("signature"),
+	}
+	if err := req.Verify(pubkey); err != nil {
+		log.Printf("failed to verify pending events request: %v", err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	// Only an app registered for the wallet pulls the requests, and only its own
+	webhook, err := s.store.Nwc.Get(r.Context(), req.WalletServicePubkey, pubkey)
+	if err != nil || webhook == nil {
+		log.Printf("pending events requested by unregistered app %v for %v: %v", pubkey, req.WalletServicePubkey, err)
+		http.Error(w, "app not registered", http.StatusForbidden)
+		return
+	}
+
+	pendingEvents, err := s.store.Nwc.GetPendingEvents(r.Context(), req.WalletServicePubkey, webhook.AppPubkey, req.Since, req.After, PendingEventsLimit)
+	if err != nil {
+		log.Printf("failed to get pending events for %v: %v", req.WalletServicePubkey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	events := make([]json.RawMessage, 0, len(pendingEvents))
+	for _, event := range pendingEvents {
+		events = append(events, json.RawMessage(event.Event))
+	}
+
+	body, err := json.Marshal(GetPendingEventsResponse{Events: events})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
+
+/*
+RelayHealth returns the connection state of the subscribed relays.
+*/
+func (s *NostrEventsRouter) RelayHealth(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(s.manager.RelayHealth())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,342 @@
+package nwc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"fiatjaf.com/nostr"
+	"github.com/breez/breez-lnurl/channel"
+	"github.com/breez/breez-lnurl/persist"
+	nwc "github.com/breez/breez-lnurl/persist/nwc"
+	"github.com/breez/lspd/lightning"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/gorilla/mux"
+	"github.com/tv42/zbase32"
+	"gotest.tools/assert"
+)
+
+// testRouter serves the nwc routes with a manager started on the store.
+type testRouter struct {
+	*NostrEventsRouter
+	router  *mux.Router
+	privKey *secp256k1.PrivateKey
+	pubkey  string
+}
+
+func newTestRouter(t *testing.T, store *persist.Store, policy *RelayPolicy) *testRouter {
+	if policy == nil {
+		policy = DefaultRelayPolicy()
+	}
+	rootURL, _ := url.Parse("http://localhost")
+	router := &NostrEventsRouter{
+		store:   store,
+		manager: NewNostrManager(store, nil, nil),
+		policy:  policy,
+		webhook: channel.NewDefaultWebhookClient(),
+		rootURL: rootURL,
+	}
+	assert.NilError(t, router.manager.Start(), "failed to start manager")
+	t.Cleanup(router.manager.Stop)
+
+	privKey, err := secp256k1.GeneratePrivateKey()
+	assert.NilError(t, err, "failed to generate private key")
+	muxRouter := mux.NewRouter()
+	muxRouter.HandleFunc("/nwc/{pubkey}", router.Register).Methods("POST")
+	muxRouter.HandleFunc("/nwc/{pubkey}", router.Unregister).Methods("DELETE")
+	muxRouter.HandleFunc("/nwc/{pubkey}/notifications", router.PublishNotification).Methods("POST")
+	muxRouter.HandleFunc("/nwc/{pubkey}/events", router.GetPendingEvents).Methods("GET")
+	return &testRouter{
+		NostrEventsRouter: router,
+		router:            muxRouter,
+		privKey:           privKey,
+		pubkey:            hex.EncodeToString(privKey.PubKey().SerializeCompressed()),
+	}
+}
+
+// sign signs the message with the key of the app, as verified by lightning.VerifyMessage.
+func (r *testRouter) sign(message string) string {
+	msg := append(lightning.SignedMsgPrefix, []byte(message)...)
+	first := sha256.Sum256(msg)
+	second := sha256.Sum256(first[:])
+	return zbase32.EncodeToString(ecdsa.SignCompact(r.privKey, second[:], true))
+}
+
+func (r *testRouter) serve(method string, path string, payload any) *httptest.ResponseRecorder {
+	var body []byte
+	if payload != nil {
+		body, _ = json.Marshal(payload)
+	}
+	w := httptest.NewRecorder()
+	r.router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(body)))
+	return w
+}
+
+// register registers the webhook of the app, signing the request.
+func (r *testRouter) register(request RegisterNostrEventsRequest) *httptest.ResponseRecorder {
+	message := fmt.Sprintf("%v-%v-%v-%v", request.WebhookUrl, request.WalletServicePubkey, request.AppPubkey, request.Relays)
+	if request.InfoEvent != nil {
+		message = fmt.Sprintf("%v-%v", message, request.InfoEvent.ID.Hex())
+	}
+	request.Signature = r.sign(message)
+	return r.serve("POST", "/nwc/"+r.pubkey, request)
+}
+
+func TestRegisterPrivateRelay(t *testing.T) {
+	ctx := context.Background()
+	store := persist.NewMemoryStore()
+	policy := DefaultRelayPolicy()
+	policy.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "relay.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+		case "rebound.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("10.0.0.5")}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	router := newTestRouter(t, store, policy)
+	walletServicePubkey := newSecretKey(t).Public().Hex()
+	appPubkey := newSecretKey(t).Public().Hex()
+
+	// A relay host resolving to a private address is rejected
+	response := router.register(RegisterNostrEventsRequest{
+		WebhookUrl:          "http://93.184.216.34/hook",
+		WalletServicePubkey: walletServicePubkey,
+		AppPubkey:           appPubkey,
+		Relays:              []string{"wss://relay.example.com", "wss://rebound.example.com"},
+	})
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+	webhook, _ := store.Nwc.Get(ctx, walletServicePubkey, appPubkey)
+	assert.Check(t, webhook == nil, "rejected registration should not be stored")
+
+	response = router.register(RegisterNostrEventsRequest{
+		WebhookUrl:          "http://93.184.216.34/hook",
+		WalletServicePubkey: walletServicePubkey,
+		AppPubkey:           appPubkey,
+		Relays:              []string{"wss://relay.example.com"},
+	})
+	assert.Equal(t, response.Code, http.StatusOK)
+	webhook, err := store.Nwc.Get(ctx, walletServicePubkey, appPubkey)
+	assert.NilError(t, err, "failed to get webhook")
+	assert.DeepEqual(t, webhook.Relays, []string{"wss://relay.example.com"})
+}
+
+func TestRegisterInfoEvent(t *testing.T) {
+	ctx := context.Background()
+	store := persist.NewMemoryStore()
+	policy := DefaultRelayPolicy()
+	policy.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+	}
+	router := newTestRouter(t, store, policy)
+	walletSecretKey := newSecretKey(t)
+	walletServicePubkey := walletSecretKey.Public().Hex()
+	infoEvent := newInfoEvent(t, walletSecretKey, time.Now().Unix())
+	request := RegisterNostrEventsRequest{
+		WebhookUrl:          "http://93.184.216.34/hook",
+		WalletServicePubkey: walletServicePubkey,
+		AppPubkey:           newSecretKey(t).Public().Hex(),
+		Relays:              []string{"wss://relay.example.com"},
+		InfoEvent:           &infoEvent,
+	}
+
+	// The signature must cover the id of the info event
+	unsigned := request
+	unsigned.Signature = router.sign(fmt.Sprintf("%v-%v-%v-%v", request.WebhookUrl, request.WalletServicePubkey, request.AppPubkey, request.Relays))
+	response := router.serve("POST", "/nwc/"+router.pubkey, unsigned)
+	assert.Equal(t, response.Code, http.StatusUnauthorized)
+	stored, err := store.Nwc.GetInfoEvent(ctx, walletServicePubkey)
+	assert.NilError(t, err, "failed to get info event")
+	assert.Check(t, stored == nil, "rejected info event should not be stored")
+
+	response = router.register(request)
+	assert.Equal(t, response.Code, http.StatusOK)
+	stored, err = store.Nwc.GetInfoEvent(ctx, walletServicePubkey)
+	assert.NilError(t, err, "failed to get info event")
+	assert.Equal(t, stored.CreatedAt, int64(infoEvent.CreatedAt))
+
+	// An older info event is accepted but does not replace the stored one
+	olderEvent := newInfoEvent(t, walletSecretKey, int64(infoEvent.CreatedAt)-60)
+	request.InfoEvent = &olderEvent
+	response = router.register(request)
+	assert.Equal(t, response.Code, http.StatusOK)
+	stored, err = store.Nwc.GetInfoEvent(ctx, walletServicePubkey)
+	assert.NilError(t, err, "failed to get info event")
+	assert.Equal(t, stored.CreatedAt, int64(infoEvent.CreatedAt))
+
+	// An info event signed by another key is rejected
+	otherEvent := newInfoEvent(t, newSecretKey(t), time.Now().Unix())
+	request.InfoEvent = &otherEvent
+	response = router.register(request)
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+}
+
+func TestGetPendingEvents(t *testing.T) {
+	defer func(limit int) { PendingEventsLimit = limit }(PendingEventsLimit)
+	PendingEventsLimit = 2
+
+	ctx := context.Background()
+	store := persist.NewMemoryStore()
+	router := newTestRouter(t, store, nil)
+	walletServicePubkey := newSecretKey(t).Public().Hex()
+	err := store.Nwc.Set(ctx, nwc.Webhook{
+		WalletServicePubkey: walletServicePubkey,
+		AppPubkey:           router.pubkey,
+		Url:                 "http://example.com/webhook",
+		Relays:              []string{"wss://relay.example.com"},
+	})
+	assert.NilError(t, err, "failed to set webhook")
+
+	// An app generating its own key is not registered for the wallet
+	unregisteredKey, err := secp256k1.GeneratePrivateKey()
+	assert.NilError(t, err, "failed to generate private key")
+	unregistered := *router
+	unregistered.privKey = unregisteredKey
+	unregistered.pubkey = hex.EncodeToString(unregisteredKey.PubKey().SerializeCompressed())
+
+	createdAt := time.Now().Unix() - 10
+	addEvent := func(eventId string, appPubkey string) {
+		err := store.Nwc.AddPendingEvent(ctx, nwc.PendingEvent{
+			EventId:             eventId,
+			WalletServicePubkey: walletServicePubkey,
+			AppPubkey:           appPubkey,
+			Event:               fmt.Sprintf(`{"id":"%s","created_at":%d}`, eventId, createdAt),
+			CreatedAt:           createdAt,
+			ExpiresAt:           time.Now().Add(time.Hour),
+		})
+		assert.NilError(t, err, "failed to add pending event")
+	}
+	var expected []string
+	for i := 0; i < 5; i++ {
+		eventId := fmt.Sprintf("%064x", i)
+		addEvent(eventId, router.pubkey)
+		expected = append(expected, eventId)
+	}
+	addEvent(fmt.Sprintf("%064x", 100), unregistered.pubkey)
+
+	getAs := func(app *testRouter, since int64, after string, signature string) *httptest.ResponseRecorder {
+		now := time.Now().Unix()
+		if signature == "" {
+			message := fmt.Sprintf("%v-%v-%v", now, walletServicePubkey, since)
+			if after != "" {
+				message = fmt.Sprintf("%v-%v", message, after)
+			}
+			signature = app.sign(message)
+		}
+		query := url.Values{
+			"walletServicePubkey": {walletServicePubkey},
+			"since":               {fmt.Sprint(since)},
+			"after":               {after},
+			"time":                {fmt.Sprint(now)},
+			"signature":           {signature},
+		}
+		return app.serve("GET", fmt.Sprintf("/nwc/%s/events?%s", app.pubkey, query.Encode()), nil)
+	}
+	get := func(since int64, after string, signature string) *httptest.ResponseRecorder {
+		return getAs(router, since, after, signature)
+	}
+
+	response := getAs(&unregistered, 0, "", "")
+	assert.Equal(t, response.Code, http.StatusForbidden)
+
+	// The signature must cover the cursor
+	response = get(0, expected[1], router.sign(fmt.Sprintf("%v-%v-%v", time.Now().Unix(), walletServicePubkey, 0)))
+	assert.Equal(t, response.Code, http.StatusUnauthorized)
+
+	// The events sharing a second are paged through on their id, without the events of the other apps
+	var received []string
+	var since int64
+	var after string
+	for {
+		response := get(since, after, "")
+		assert.Equal(t, response.Code, http.StatusOK)
+		var body struct {
+			Events []struct {
+				Id        string `json:"id"`
+				CreatedAt int64  `json:"created_at"`
+			} `json:"events"`
+		}
+		assert.NilError(t, json.Unmarshal(response.Body.Bytes(), &body), "failed to decode response")
+		if len(body.Events) == 0 {
+			break
+		}
+		assert.Assert(t, len(body.Events) <= PendingEventsLimit, "page should be limited")
+		for _, event := range body.Events {
+			received = append(received, event.Id)
+		}
+		last := body.Events[len(body.Events)-1]
+		since, after = last.CreatedAt, last.Id
+		assert.Assert(t, len(received) <= len(expected), "events should not be returned twice")
+	}
+	assert.DeepEqual(t, received, expected)
+}
+
+func TestPublishNotificationValidation(t *testing.T) {
+	ctx := context.Background()
+	store := persist.NewMemoryStore()
+	router := newTestRouter(t, store, nil)
+	walletSecretKey := newSecretKey(t)
+	walletServicePubkey := walletSecretKey.Public().Hex()
+	appPubkey := newSecretKey(t).Public().Hex()
+	err := store.Nwc.Set(ctx, nwc.Webhook{
+		WalletServicePubkey: walletServicePubkey,
+		AppPubkey:           appPubkey,
+		Url:                 "http://example.com/webhook",
+		Relays:              []string{"ws://127.0.0.1:1"},
+	})
+	assert.NilError(t, err, "failed to set webhook")
+	publish := func(event nostr.Event, signature string) *httptest.ResponseRecorder {
+		now := time.Now().Unix()
+		if signature == "" {
+			signature = router.sign(fmt.Sprintf("%v-%v-%v", now, walletServicePubkey, event.ID.Hex()))
+		}
+		return router.serve("POST", "/nwc/"+router.pubkey+"/notifications", PublishNotificationRequest{
+			Time:                now,
+			WalletServicePubkey: walletServicePubkey,
+			Event:               event,
+			Signature:           signature,
+		})
+	}
+
+	// The request must be signed over the event id
+	event := newNotificationEvent(t, walletSecretKey, appPubkey, KindNWCNotification)
+	response := publish(event, router.sign(fmt.Sprintf("%v-%v", time.Now().Unix(), walletServicePubkey)))
+	assert.Equal(t, response.Code, http.StatusUnauthorized)
+
+	// Only the notification kinds are published
+	response = publish(newNotificationEvent(t, walletSecretKey, appPubkey, nostr.KindNWCWalletRequest), "")
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+
+	// The event must be signed by the wallet service
+	response = publish(newNotificationEvent(t, newSecretKey(t), appPubkey, KindNWCNotification), "")
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+	tampered := event
+	tampered.Content = "tampered"
+	response = publish(tampered, "")
+	assert.Equal(t, response.Code, http.StatusBadRequest)
+
+	// The notified app must be registered
+	response = publish(newNotificationEvent(t, walletSecretKey, newSecretKey(t).Public().Hex(), KindNWCNotification), "")
+	assert.Equal(t, response.Code, http.StatusNotFound)
+
+	response = publish(event, "")
+	assert.Equal(t, response.Code, http.StatusAccepted)
+	var body PublishNotificationResponse
+	assert.NilError(t, json.Unmarshal(response.Body.Bytes(), &body), "failed to decode response")
+	assert.Equal(t, body.EventId, event.ID.Hex())
+	assert.Equal(t, body.Status, nwc.NotificationStatusPending)
+	stored, err := store.Nwc.GetNotification(ctx, event.ID.Hex())
+	assert.NilError(t, err, "failed to get notification")
+	assert.DeepEqual(t, stored.Relays, []string{"ws://127.0.0.1:1"})
+}
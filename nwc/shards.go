@@ -0,0 +1,268 @@
+package nwc
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"fiatjaf.com/nostr"
+)
+
+// The maximum number of wallet pubkeys in the filter of a single relay subscription.
+var MaxPubkeysPerShard int = 250
+
+// The delay batching the changes to the shards before resubscribing them.
+var ShardResubscribeDelay time.Duration = time.Second
+
+// shard is a single subscription on a relay, filtering on the p tags of its wallets.
+type shard struct {
+	relay   string
+	wallets map[string]bool
+	cancel  context.CancelFunc
+}
+
+/*
+shardSet assigns the wallet pubkeys to the shards of their relays. Adding or
+removing a wallet only changes one shard per relay, so the other
+subscriptions are left running.
+*/
+type shardSet struct {
+	relays  map[string][]*shard
+	wallets map[string]map[string]*shard
+}
+
+func newShardSet() *shardSet {
+	return &shardSet{
+		relays:  make(map[string][]*shard),
+		wallets: make(map[string]map[string]*shard),
+	}
+}
+
+// add assigns the wallet to a shard of the relay, returning the changed shard or nil if already assigned.
+func (s *shardSet) add(walletServicePubkey string, relay string) *shard {
+	if _, exists := s.wallets[walletServicePubkey][relay]; exists {
+		return nil
+	}
+
+	// Fill the fullest shard with room, keeping the number of subscriptions low
+	var target *shard
+	for _, sh := range s.relays[relay] {
+		if len(sh.wallets) < MaxPubkeysPerShard && (target == nil || len(sh.wallets) > len(target.wallets)) {
+			target = sh
+		}
+	}
+	if target == nil {
+		target = &shard{relay: relay, wallets: make(map[string]bool)}
+		s.relays[relay] = append(s.relays[relay], target)
+	}
+	target.wallets[walletServicePubkey] = true
+	s.assign(walletServicePubkey, target)
+	return target
+}
+
+/*
+remove unassigns the wallet from its shards. It returns the shards to
+resubscribe and the shards to close, either emptied or merged into another
+shard of the same relay.
+*/
+func (s *shardSet) remove(walletServicePubkey string) (changed []*shard, closed []*shard) {
+	for relay := range s.wallets[walletServicePubkey] {
+		relayChanged, relayClosed := s.removeRelay(walletServicePubkey, relay)
+		changed = append(changed, relayChanged...)
+		closed = append(closed, relayClosed...)
+	}
+	return changed, closed
+}
+
+// removeRelay unassigns the wallet from the shard of the relay, returning the shards like remove.
+func (s *shardSet) removeRelay(walletServicePubkey string, relay string) (changed []*shard, closed []*shard) {
+	sh, exists := s.wallets[walletServicePubkey][relay]
+	if !exists {
+		return nil, nil
+	}
+	delete(s.wallets[walletServicePubkey], relay)
+	if len(s.wallets[walletServicePubkey]) == 0 {
+		delete(s.wallets, walletServicePubkey)
+	}
+
+	delete(sh.wallets, walletServicePubkey)
+	if len(sh.wallets) == 0 {
+		s.drop(sh)
+		return nil, []*shard{sh}
+	}
+	if target := s.mergeTarget(sh); target != nil {
+		for wallet := range sh.wallets {
+			target.wallets[wallet] = true
+			s.assign(wallet, target)
+		}
+		s.drop(sh)
+		return []*shard{target}, []*shard{sh}
+	}
+	return []*shard{sh}, nil
+}
+
+// mergeTarget returns a shard of the same relay able to absorb the given shard once it is a quarter full.
+func (s *shardSet) mergeTarget(sh *shard) *shard {
+	if len(sh.wallets) > MaxPubkeysPerShard/4 {
+		return nil
+	}
+	for _, other := range s.relays[sh.relay] {
+		if other != sh && len(other.wallets)+len(sh.wallets) <= MaxPubkeysPerShard {
+			return other
+		}
+	}
+	return nil
+}
+
+func (s *shardSet) assign(walletServicePubkey string, sh *shard) {
+	relays, exists := s.wallets[walletServicePubkey]
+	if !exists {
+		relays = make(map[string]*shard)
+		s.wallets[walletServicePubkey] = relays
+	}
+	relays[sh.relay] = sh
+}
+
+func (s *shardSet) drop(sh *shard) {
+	s.relays[sh.relay] = slices.DeleteFunc(s.relays[sh.relay], func(other *shard) bool {
+		return other == sh
+	})
+	if len(s.relays[sh.relay]) == 0 {
+		delete(s.relays, sh.relay)
+	}
+}
+
+// all returns the shards of all the relays.
+func (s *shardSet) all() []*shard {
+	var shards []*shard
+	for _, relayShards := range s.relays {
+		shards = append(shards, relayShards...)
+	}
+	return shards
+}
+
+/*
+shardSince returns the since filter of the shard. When backfilling, it covers
+the requests missed since the lowest high-water mark of its wallets,
+otherwise the shard was subscribed until now and only the overlap is needed.
+*/
+func (nm *NostrManager) shardSince(sh *shard, backfill bool) int64 {
+	since := time.Now().Add(-BackfillOverlap).Unix()
+	if !backfill {
+		return since
+	}
+	for walletServicePubkey := range sh.wallets {
+		details, exists := nm.wallets[walletServicePubkey]
+		if !exists {
+			continue
+		}
+		if walletSince := backfillSince(details.HighWaterMark); walletSince > 0 && walletSince < since {
+			since = walletSince
+		}
+	}
+	return since
+}
+
+// subscribeShard (re)starts the subscription of the shard. The caller must hold the lock.
+func (nm *NostrManager) subscribeShard(sh *shard, since int64) {
+	if sh.cancel != nil {
+		sh.cancel()
+	}
+	filters := nostr.Filter{
+		Tags: nostr.TagMap{
+			"p": slices.Sorted(maps.Keys(sh.wallets)),
+		},
+		Kinds: []nostr.Kind{nostr.KindNWCWalletRequest},
+		Since: nostr.Timestamp(since),
+	}
+	ctx, cancel := context.WithCancel(nm.ctx)
+	sh.cancel = cancel
+	eventChannel := nm.pool.SubscribeMany(ctx, []string{sh.relay}, filters, nostr.SubscriptionOptions{})
+	go nm.routeEvents(ctx, sh, eventChannel)
+}
+
+// closeShards stops the subscription of the shards. The caller must hold the lock.
+func (nm *NostrManager) closeShards(shards []*shard) {
+	for _, sh := range shards {
+		if sh.cancel != nil {
+			sh.cancel()
+		}
+		delete(nm.dirty, sh)
+	}
+}
+
+/*
+markDirty schedules the resubscription of the changed shards, backfilling
+the requests missed by their wallets if requested. The caller must hold the
+lock.
+*/
+func (nm *NostrManager) markDirty(backfill bool, shards ...*shard) {
+	for _, sh := range shards {
+		nm.dirty[sh] = nm.dirty[sh] || backfill
+	}
+	if len(nm.dirty) > 0 && nm.flushTimer == nil && nm.isRunning {
+		nm.flushTimer = time.AfterFunc(ShardResubscribeDelay, nm.flushShards)
+	}
+}
+
+// flushShards resubscribes the shards changed since the last flush.
+func (nm *NostrManager) flushShards() {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	nm.flushTimer = nil
+	if !nm.isRunning {
+		return
+	}
+	for sh, backfill := range nm.dirty {
+		nm.subscribeShard(sh, nm.shardSince(sh, backfill))
+	}
+	if len(nm.dirty) > 0 {
+		log.Printf("Resubscribed %d shards", len(nm.dirty))
+	}
+	clear(nm.dirty)
+}
+
+// resubscribeRelay restarts the shards of the relay, backfilling the requests missed while it was down.
+func (nm *NostrManager) resubscribeRelay(relay string) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if !nm.isRunning {
+		return
+	}
+	for _, sh := range nm.shards.relays[relay] {
+		nm.subscribeShard(sh, nm.shardSince(sh, true))
+		delete(nm.dirty, sh)
+	}
+}
+
+// routeEvents forwards the events received by the shard to the wallets they are addressed to.
+func (nm *NostrManager) routeEvents(ctx context.Context, sh *shard, eventChannel chan nostr.RelayEvent) {
+	for {
+		select {
+		case incomingEvent, ok := <-eventChannel:
+			if !ok {
+				return
+			}
+			if incomingEvent.Relay != nil {
+				nm.health.RecordEvent(incomingEvent.Relay.URL, time.Now())
+			}
+			for _, tag := range incomingEvent.Tags {
+				if len(tag) < 2 || tag[0] != "p" {
+					continue
+				}
+				nm.mu.RLock()
+				assigned := sh.wallets[tag[1]]
+				nm.mu.RUnlock()
+				if assigned {
+					nm.forwardToNotify(ctx, incomingEvent, tag[1])
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package nwc
+
+import (
+	"fmt"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestShardSet(t *testing.T) {
+	defaultMax := MaxPubkeysPerShard
+	MaxPubkeysPerShard = 4
+	defer func() { MaxPubkeysPerShard = defaultMax }()
+
+	relay := "wss://relay.example.com"
+	shards := newShardSet()
+	var wallets []string
+	for i := 0; i < 10; i++ {
+		wallet := fmt.Sprintf("wallet%d", i)
+		wallets = append(wallets, wallet)
+		assert.Assert(t, shards.add(wallet, relay) != nil, "wallet should be assigned")
+	}
+	assert.Assert(t, shards.add(wallets[0], relay) == nil, "wallet is already assigned")
+	assert.Equal(t, len(shards.relays[relay]), 3)
+	assert.Equal(t, len(shards.relays[relay][0].wallets), 4)
+	assert.Equal(t, len(shards.relays[relay][2].wallets), 2)
+
+	// The same wallet is sharded independently on another relay
+	other := "wss://other.example.com"
+	assert.Assert(t, shards.add(wallets[0], other) != nil, "wallet should be assigned to the other relay")
+	assert.Equal(t, len(shards.relays[other]), 1)
+
+	// Removing a wallet only changes its shards
+	changed, closed := shards.remove(wallets[0])
+	assert.Equal(t, len(changed), 1)
+	assert.Equal(t, changed[0], shards.relays[relay][0])
+	assert.Equal(t, len(closed), 1)
+	assert.Equal(t, closed[0].relay, other)
+	_, exists := shards.relays[other]
+	assert.Check(t, !exists, "empty relay should be dropped")
+
+	// An added wallet fills the fullest shard with room
+	sh := shards.add("wallet10", relay)
+	assert.Equal(t, sh, shards.relays[relay][0])
+
+	// A shard left a quarter full is merged into another one
+	target, last := shards.relays[relay][1], shards.relays[relay][2]
+	shards.remove(wallets[4])
+	changed, closed = shards.remove(wallets[8])
+	assert.Equal(t, len(closed), 1)
+	assert.Equal(t, closed[0], last)
+	assert.Equal(t, len(changed), 1)
+	assert.Equal(t, changed[0], target)
+	assert.Equal(t, len(shards.relays[relay]), 2)
+	assert.Equal(t, shards.wallets[wallets[9]][relay], target)
+	assert.Check(t, changed[0].wallets[wallets[9]], "merged wallet should be in the target shard")
+}
+
+func TestShardSetRemoveRelay(t *testing.T) {
+	shards := newShardSet()
+	relay, other := "wss://relay.example.com", "wss://other.example.com"
+	shards.add("wallet0", relay)
+	shards.add("wallet0", other)
+	shards.add("wallet1", relay)
+
+	// Only the shard of the removed relay changes
+	changed, closed := shards.removeRelay("wallet0", relay)
+	assert.Equal(t, len(changed), 1)
+	assert.Equal(t, len(closed), 0)
+	assert.Check(t, !changed[0].wallets["wallet0"], "wallet should be removed from the shard")
+	assert.Equal(t, shards.wallets["wallet0"][other], shards.relays[other][0])
+
+	changed, closed = shards.removeRelay("wallet0", other)
+	assert.Equal(t, len(changed), 0)
+	assert.Equal(t, len(closed), 1)
+	_, exists := shards.wallets["wallet0"]
+	assert.Check(t, !exists, "wallet without relays should be dropped")
+}
@@ -4,21 +4,25 @@ import (
 	"context"
 	lnurl "github.com/breez/breez-lnurl/persist/lnurl"
 	nwc "github.com/breez/breez-lnurl/persist/nwc"
+	ratelimit "github.com/breez/breez-lnurl/persist/ratelimit"
 )
 
 type CleanupService struct {
-	Lnurl *lnurl.CleanupService
-	Nwc   *nwc.CleanupService
+	Lnurl     *lnurl.CleanupService
+	Nwc       *nwc.CleanupService
+	RateLimit *ratelimit.CleanupService
 }
 
 func NewCleanupService(store *Store) *CleanupService {
 	return &CleanupService{
-		Lnurl: lnurl.NewCleanupService(store.LnUrl),
-		Nwc:   nwc.NewCleanupService(store.Nwc),
+		Lnurl:     lnurl.NewCleanupService(store.LnUrl),
+		Nwc:       nwc.NewCleanupService(store.Nwc),
+		RateLimit: ratelimit.NewCleanupService(store.RateLimit),
 	}
 }
 
 func (c *CleanupService) Start(ctx context.Context) {
 	go c.Lnurl.Start(ctx)
 	go c.Nwc.Start(ctx)
+	go c.RateLimit.Start(ctx)
 }
@@ -0,0 +1,130 @@
+package persist
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MemoryStore struct {
+	mu              sync.Mutex
+	updates         map[string]*Update
+	nextReconcileAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		updates: make(map[string]*Update),
+	}
+}
+
+func (m *MemoryStore) Enqueue(ctx context.Context, update Update) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	update.Username = strings.ToLower(update.Username)
+	update.Status = StatusPending
+	update.Attempts = 0
+	update.NextAttemptAt = time.Now()
+	update.LastError = nil
+	if existing, ok := m.updates[update.Username]; ok {
+		update.Version = existing.Version + 1
+	}
+	m.updates[update.Username] = &update
+	return nil
+}
+
+func (m *MemoryStore) Claim(ctx context.Context, now time.Time, lease time.Duration) (*Update, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var next *Update
+	for _, update := range m.updates {
+		if (update.Status != StatusPending && update.Status != StatusVerifying) || update.NextAttemptAt.After(now) {
+			continue
+		}
+		if next == nil || update.NextAttemptAt.Before(next.NextAttemptAt) {
+			next = update
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	next.NextAttemptAt = now.Add(lease)
+	claimed := *next
+	return &claimed, nil
+}
+
+func (m *MemoryStore) SetPublished(ctx context.Context, username string, version int64) error {
+	return m.setStatus(username, version, func(update *Update) {
+		update.Status = StatusPublished
+		update.LastError = nil
+	})
+}
+
+func (m *MemoryStore) SetVerifying(ctx context.Context, username string, version int64, nextAttemptAt time.Time) error {
+	return m.setStatus(username, version, func(update *Update) {
+		update.Status = StatusVerifying
+		update.Attempts = 0
+		update.NextAttemptAt = nextAttemptAt
+		update.LastError = nil
+	})
+}
+
+func (m *MemoryStore) SetVerified(ctx context.Context, username string, version int64) error {
+	return m.setStatus(username, version, func(update *Update) {
+		update.Status = StatusVerified
+		update.LastError = nil
+	})
+}
+
+func (m *MemoryStore) SetRetry(ctx context.Context, username string, version int64, nextAttemptAt time.Time, lastError string) error {
+	return m.setStatus(username, version, func(update *Update) {
+		update.Attempts++
+		update.NextAttemptAt = nextAttemptAt
+		update.LastError = &lastError
+	})
+}
+
+func (m *MemoryStore) SetFailed(ctx context.Context, username string, version int64, lastError string) error {
+	return m.setStatus(username, version, func(update *Update) {
+		update.Status = StatusFailed
+		update.Attempts++
+		update.LastError = &lastError
+	})
+}
+
+func (m *MemoryStore) Get(ctx context.Context, username string) (*Update, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	update, ok := m.updates[strings.ToLower(username)]
+	if !ok {
+		return nil, nil
+	}
+	found := *update
+	return &found, nil
+}
+
+func (m *MemoryStore) ClaimReconcile(ctx context.Context, now time.Time, interval time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.nextReconcileAt.After(now) {
+		return false, nil
+	}
+	m.nextReconcileAt = now.Add(interval)
+	return true, nil
+}
+
+func (m *MemoryStore) setStatus(username string, version int64, apply func(update *Update)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	update, ok := m.updates[strings.ToLower(username)]
+	if ok && update.Version == version {
+		apply(update)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package persist
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const updateColumns = `username, encode(pubkey, 'hex') pubkey, action, offer,
+	bitcoin_address, silent_payment_address, lnurl_fallback,
+	status, version, attempts, next_attempt_at, last_error`
+
+type PgStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgStore(pool *pgxpool.Pool) *PgStore {
+	return &PgStore{
+		pool,
+	}
+}
+
+func (s *PgStore) Enqueue(ctx context.Context, update Update) error {
+	pk, err := hex.DecodeString(update.Pubkey)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(
+		ctx,
+		`INSERT INTO public.dns_updates (username, pubkey, action, offer, bitcoin_address,
+		 silent_payment_address, lnurl_fallback, status, next_attempt_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW(), NOW())
+		 ON CONFLICT (username) DO UPDATE SET pubkey = EXCLUDED.pubkey, action = EXCLUDED.action,
+		 offer = EXCLUDED.offer, bitcoin_address = EXCLUDED.bitcoin_address,
+		 silent_payment_address = EXCLUDED.silent_payment_address, lnurl_fallback = EXCLUDED.lnurl_fallback,
+		 status = EXCLUDED.status, version = dns_updates.version + 1, attempts = 0,
+		 next_attempt_at = NOW(), last_error = NULL, updated_at = NOW()`,
+		strings.ToLower(update.Username),
+		pk,
+		update.Action,
+		update.Offer,
+		update.BitcoinAddress,
+		update.SilentPaymentAddress,
+		update.LnurlFallback,
+		StatusPending,
+	)
+	return err
+}
+
+func (s *PgStore) Claim(ctx context.Context, now time.Time, lease time.Duration) (*Update, error) {
+	rows, err := s.pool.Query(
+		ctx,
+		`UPDATE public.dns_updates SET next_attempt_at = to_timestamp($3)
+		 WHERE username = (
+		   SELECT username FROM public.dns_updates
+		   WHERE status IN ($1, $4) AND next_attempt_at <= to_timestamp($2)
+		   ORDER BY next_attempt_at LIMIT 1
+		   FOR UPDATE SKIP LOCKED)
+		 RETURNING `+updateColumns,
+		StatusPending,
+		now.Unix(),
+		now.Add(lease).Unix(),
+		StatusVerifying,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	update, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Update])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &update, nil
+}
+
+func (s *PgStore) SetPublished(ctx context.Context, username string, version int64) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`UPDATE public.dns_updates SET status = $3, last_error = NULL, updated_at = NOW()
+		 WHERE username = $1 AND version = $2`,
+		strings.ToLower(username),
+		version,
+		StatusPublished,
+	)
+	return err
+}
+
+func (s *PgStore) SetVerifying(ctx context.Context, username string, version int64, nextAttemptAt time.Time) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`UPDATE public.dns_updates SET status = $3, attempts = 0, next_attempt_at = to_timestamp($4),
+		 last_error = NULL, updated_at = NOW()
+		 WHERE username = $1 AND version = $2`,
+		strings.ToLower(username),
+		version,
+		StatusVerifying,
+		nextAttemptAt.Unix(),
+	)
+	return err
+}
+
+func (s *PgStore) SetVerified(ctx context.Context, username string, version int64) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`UPDATE public.dns_updates SET status = $3, last_error = NULL, updated_at = NOW()
+		 WHERE username = $1 AND version = $2`,
+		strings.ToLower(username),
+		version,
+		StatusVerified,
+	)
+	return err
+}
+
+func (s *PgStore) SetRetry(ctx context.Context, username string, version int64, nextAttemptAt time.Time, lastError string) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`UPDATE public.dns_updates SET attempts = attempts + 1, next_attempt_at = to_timestamp($3),
+		 last_error = $4, updated_at = NOW()
+		 WHERE username = $1 AND version = $2`,
+		strings.ToLower(username),
+		version,
+		nextAttemptAt.Unix(),
+		lastError,
+	)
+	return err
+}
+
+func (s *PgStore) SetFailed(ctx context.Context, username string, version int64, lastError string) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`UPDATE public.dns_updates SET status = $3, attempts = attempts + 1,
+		 last_error = $4, updated_at = NOW()
+		 WHERE username = $1 AND version = $2`,
+		strings.ToLower(username),
+		version,
+		StatusFailed,
+		lastError,
+	)
+	return err
+}
+
+func (s *PgStore) Get(ctx context.Context, username string) (*Update, error) {
+	rows, err := s.pool.Query(
+		ctx,
+		`SELECT `+updateColumns+`
+		 FROM public.dns_updates
+		 WHERE username = $1`,
+		strings.ToLower(username),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	update, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Update])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &update, nil
+}
+
+func (s *PgStore) ClaimReconcile(ctx context.Context, now time.Time, interval time.Duration) (bool, error) {
+	tag, err := s.pool.Exec(
+		ctx,
+		`UPDATE public.dns_reconcile SET next_run_at = to_timestamp($2)
+		 WHERE next_run_at <= to_timestamp($1)`,
+		now.Unix(),
+		now.Add(interval).Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,54 @@
+package persist
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	ActionSet    = "set"
+	ActionRemove = "remove"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusPublished = "published"
+	StatusVerifying = "verifying"
+	StatusVerified  = "verified"
+	StatusFailed    = "failed"
+)
+
+// Update is the latest requested DNS change of a username.
+type Update struct {
+	Username             string    `json:"username" db:"username"`
+	Pubkey               string    `json:"pubkey" db:"pubkey"`
+	Action               string    `json:"action" db:"action"`
+	Offer                *string   `json:"offer" db:"offer"`
+	BitcoinAddress       *string   `json:"bitcoin_address" db:"bitcoin_address"`
+	SilentPaymentAddress *string   `json:"silent_payment_address" db:"silent_payment_address"`
+	LnurlFallback        bool      `json:"lnurl_fallback" db:"lnurl_fallback"`
+	Status               string    `json:"status" db:"status"`
+	Version              int64     `json:"version" db:"version"`
+	Attempts             int       `json:"attempts" db:"attempts"`
+	NextAttemptAt        time.Time `json:"next_attempt_at" db:"next_attempt_at"`
+	LastError            *string   `json:"last_error" db:"last_error"`
+}
+
+type Store interface {
+	// Enqueue replaces any update of the username with a new pending update.
+	Enqueue(ctx context.Context, update Update) error
+	// Claim returns the next due pending or verifying update, postponing it by
+	// the lease duration so other workers skip it while it is processed.
+	Claim(ctx context.Context, now time.Time, lease time.Duration) (*Update, error)
+	// The following only apply if the update was not replaced since claimed.
+	SetPublished(ctx context.Context, username string, version int64) error
+	// SetVerifying marks the update as published, waiting for its DNSSEC verification.
+	SetVerifying(ctx context.Context, username string, version int64, nextAttemptAt time.Time) error
+	SetVerified(ctx context.Context, username string, version int64) error
+	SetRetry(ctx context.Context, username string, version int64, nextAttemptAt time.Time, lastError string) error
+	SetFailed(ctx context.Context, username string, version int64, lastError string) error
+	Get(ctx context.Context, username string) (*Update, error)
+	// ClaimReconcile claims the reconciliation of the zone when due, postponing
+	// the next one by the interval so only one instance reconciles at a time.
+	ClaimReconcile(ctx context.Context, now time.Time, interval time.Duration) (bool, error)
+}
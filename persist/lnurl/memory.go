@@ -6,12 +6,14 @@ import (
 )
 
 type MemoryStore struct {
-	webhooks []Webhook
+	webhooks     []Webhook
+	instructions map[string]PaymentInstructions
 }
 
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore {
-		webhooks: []Webhook{},
+		webhooks:     []Webhook{},
+		instructions: make(map[string]PaymentInstructions),
 	}
 }
 
@@ -49,6 +51,16 @@ func (m *MemoryStore) SetPubkeyDetails(ctx context.Context, pubkey string, usern
 	}, nil
 }
 
+func (m *MemoryStore) SetPaymentInstructions(ctx context.Context, pubkey string, instructions PaymentInstructions) error {
+	m.instructions[pubkey] = instructions
+	return nil
+}
+
+func (m *MemoryStore) SetWebhookOffer(ctx context.Context, pubkey, url string, offer *string) error {
+	// The registrations never expire in memory
+	return nil
+}
+
 func (m *MemoryStore) GetLastUpdated(ctx context.Context, identifier string) (*Webhook, error) {
 	for _, hook := range m.webhooks {
 		if hook.Compare(identifier) {
@@ -63,9 +75,10 @@ func (m *MemoryStore) GetPubkeyDetails(ctx context.Context, identifier string) (
 		if hook.Compare(identifier) {
 			if hook.Username != nil {
 				return &PubkeyDetails{
-					Pubkey:   hook.Pubkey,
-					Username: *hook.Username,
-					Offer:    hook.Offer,
+					Pubkey:              hook.Pubkey,
+					Username:            *hook.Username,
+					Offer:               hook.Offer,
+					PaymentInstructions: m.instructions[hook.Pubkey],
 				}, nil
 			}
 		}
@@ -73,6 +86,26 @@ func (m *MemoryStore) GetPubkeyDetails(ctx context.Context, identifier string) (
 	return nil, nil
 }
 
+func (m *MemoryStore) ListPubkeyDetails(ctx context.Context) ([]PubkeyDetails, error) {
+	var details []PubkeyDetails
+	seen := make(map[string]bool)
+	for _, hook := range m.webhooks {
+		if seen[hook.Pubkey] {
+			continue
+		}
+		seen[hook.Pubkey] = true
+		if hook.Username != nil && hook.Offer != nil {
+			details = append(details, PubkeyDetails{
+				Pubkey:              hook.Pubkey,
+				Username:            *hook.Username,
+				Offer:               hook.Offer,
+				PaymentInstructions: m.instructions[hook.Pubkey],
+			})
+		}
+	}
+	return details, nil
+}
+
 func (m *MemoryStore) Remove(ctx context.Context, pubkey, url string) error {
 	var hooks []Webhook
 	for _, hook := range m.webhooks {
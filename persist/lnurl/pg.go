@@ -84,6 +84,30 @@ func (s *PgStore) SetPubkeyDetails(ctx context.Context, pubkey string, username
 	}, nil
 }
 
+func (s *PgStore) SetPaymentInstructions(ctx context.Context, pubkey string, instructions PaymentInstructions) error {
+	pk, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return err
+	}
+	res, err := s.pool.Exec(
+		ctx,
+		`UPDATE public.pubkey_details
+		 SET bitcoin_address = $2, silent_payment_address = $3, lnurl_fallback = $4
+		 WHERE pubkey = $1`,
+		pk,
+		instructions.BitcoinAddress,
+		instructions.SilentPaymentAddress,
+		instructions.LnurlFallback,
+	)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return fmt.Errorf("failed to set payment instructions for pubkey: %v", pubkey)
+	}
+	return nil
+}
+
 func (s *PgStore) GetLastUpdated(ctx context.Context, identifier string) (*Webhook, error) {
 	pk := decodeIdentifier(identifier)
 
@@ -119,7 +143,8 @@ func (s *PgStore) GetPubkeyDetails(ctx context.Context, identifier string) (*Pub
 	// Get the pubkey usernames record by the identifier which can either a decoded pubkey or username.
 	rows, err := s.pool.Query(
 		ctx,
-		`SELECT encode(lpu.pubkey, 'hex') pubkey, lpu.username, lpu.offer 
+		`SELECT encode(lpu.pubkey, 'hex') pubkey, lpu.username, lpu.offer,
+		 lpu.bitcoin_address, lpu.silent_payment_address, lpu.lnurl_fallback
 		 FROM public.pubkey_details lpu
 		 WHERE lpu.pubkey = $1 OR lpu.username = $2
 		 LIMIT 1`,
@@ -141,6 +166,39 @@ func (s *PgStore) GetPubkeyDetails(ctx context.Context, identifier string) (*Pub
 	return &PubkeyDetailss[0], nil
 }
 
+// ListPubkeyDetails returns all the pubkey details with an offer set.
+func (s *PgStore) ListPubkeyDetails(ctx context.Context) ([]PubkeyDetails, error) {
+	rows, err := s.pool.Query(
+		ctx,
+		`SELECT encode(lpu.pubkey, 'hex') pubkey, lpu.username, lpu.offer,
+		 lpu.bitcoin_address, lpu.silent_payment_address, lpu.lnurl_fallback
+		 FROM public.pubkey_details lpu
+		 WHERE lpu.offer IS NOT NULL`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[PubkeyDetails])
+}
+
+func (s *PgStore) SetWebhookOffer(ctx context.Context, pubkey, url string, offer *string) error {
+	pk, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.pool.Exec(
+		ctx,
+		`UPDATE public.lnurl_webhooks SET offer = $3
+		 WHERE pubkey = $1 AND url = $2`,
+		pk,
+		url,
+		offer,
+	)
+	return err
+}
+
 func (s *PgStore) Remove(ctx context.Context, pubkey, url string) error {
 	pk, err := hex.DecodeString(pubkey)
 	if err != nil {
@@ -162,14 +220,22 @@ func (s *PgStore) DeleteExpired(
 	ctx context.Context,
 	before time.Time,
 ) error {
-	beforeUnix := before.UnixMicro()
-	// Delete expired webhook urls
+	// Delete expired webhook urls. Like unregistering, the offer is cleared once the
+	// pubkey has no webhooks left, but only if it was published by an expired
+	// registration, not registered through the bolt12 endpoint. The DNS reconciler
+	// then removes the orphaned BIP353 records.
 	_, err := s.pool.Exec(
 		ctx,
-		`DELETE FROM public.lnurl_webhooks
-		 WHERE refreshed_at < $1`,
-		beforeUnix)
-
+		`WITH expired AS (
+		   DELETE FROM public.lnurl_webhooks
+		   WHERE refreshed_at < $1
+		   RETURNING pubkey, offer
+		 )
+		 UPDATE public.pubkey_details pd SET offer = NULL
+		 FROM expired e
+		 WHERE pd.pubkey = e.pubkey AND pd.offer = e.offer
+		 AND NOT EXISTS (SELECT 1 FROM public.lnurl_webhooks lw WHERE lw.pubkey = pd.pubkey AND lw.refreshed_at >= $1)`,
+		before.UnixMicro())
 	return err
 }
 
@@ -183,3 +183,36 @@ func TestPgStoreBolt12(t *testing.T) {
 	assert.Equal(t, res.Username, "differentbolt12user", "username should be differentbolt12user")
 	assert.Equal(t, *res.Offer, "lnoabcdefghijklmnopqrstuvwxyz1234567890", "offer should be lnoabcdefghijklmnopqrstuvwxyz1234567890")
 }
+
+func TestPgStoreDeleteExpiredOffers(t *testing.T) {
+	pgStore := newPgStore(t)
+	ctx := context.Background()
+
+	// An offer published by an lnurl registration
+	lnurlPubkey := "03a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	lnurlUser := "expiredlnurluser"
+	lnurlOffer := "lno1expiredlnurlofferabcdefghijklmnopqrstuvwxyz"
+	_, err := pgStore.Set(ctx, Webhook{Pubkey: lnurlPubkey, Url: "http://example.com/expired", Username: &lnurlUser})
+	assert.NilError(t, err, "failed to set webhook")
+	_, err = pgStore.SetPubkeyDetails(ctx, lnurlPubkey, lnurlUser, &lnurlOffer)
+	assert.NilError(t, err, "failed to set offer")
+	assert.NilError(t, pgStore.SetWebhookOffer(ctx, lnurlPubkey, "http://example.com/expired", &lnurlOffer), "failed to set webhook offer")
+
+	// An offer registered through the bolt12 endpoint by a pubkey with an lnurl registration
+	bolt12Pubkey := "03f0e1d2c3b4a5968778695a4b3c2d1e0ff0e1d2c3b4a5968778695a4b3c2d1e0f"
+	bolt12User := "expiredbolt12user"
+	bolt12Offer := "lno1keptbolt12offerabcdefghijklmnopqrstuvwxyz"
+	_, err = pgStore.Set(ctx, Webhook{Pubkey: bolt12Pubkey, Url: "http://example.com/expired", Username: &bolt12User})
+	assert.NilError(t, err, "failed to set webhook")
+	_, err = pgStore.SetPubkeyDetails(ctx, bolt12Pubkey, bolt12User, &bolt12Offer)
+	assert.NilError(t, err, "failed to set offer")
+
+	assert.NilError(t, pgStore.DeleteExpired(ctx, time.Now().Add(time.Second)), "failed to delete expired")
+
+	details, err := pgStore.GetPubkeyDetails(ctx, lnurlPubkey)
+	assert.NilError(t, err, "failed to get pubkey details")
+	assert.Check(t, details.Offer == nil, "offer of the expired registration should be cleared")
+	details, err = pgStore.GetPubkeyDetails(ctx, bolt12Pubkey)
+	assert.NilError(t, err, "failed to get pubkey details")
+	assert.Check(t, details.Offer != nil && *details.Offer == bolt12Offer, "bolt12 offer should be kept")
+}
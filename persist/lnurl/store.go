@@ -12,10 +12,38 @@ type Webhook struct {
 	Offer    *string `json:"offer" db:"offer"`
 }
 
+type PaymentInstructions struct {
+	BitcoinAddress       *string `json:"bitcoin_address" db:"bitcoin_address"`
+	SilentPaymentAddress *string `json:"silent_payment_address" db:"silent_payment_address"`
+	LnurlFallback        bool    `json:"lnurl_fallback" db:"lnurl_fallback"`
+}
+
 type PubkeyDetails struct {
 	Pubkey   string  `json:"pubkey" db:"pubkey"`
 	Username string  `json:"username" db:"username"`
 	Offer    *string `json:"offer" db:"offer"`
+	PaymentInstructions
+}
+
+func (p PaymentInstructions) Equal(other PaymentInstructions) bool {
+	return equalOptional(p.BitcoinAddress, other.BitcoinAddress) &&
+		equalOptional(p.SilentPaymentAddress, other.SilentPaymentAddress) &&
+		p.LnurlFallback == other.LnurlFallback
+}
+
+func equalOptional(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// ValueOrEmpty returns the value of an optional payment instruction, empty if unset.
+func ValueOrEmpty(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
 }
 
 func (w Webhook) Compare(identifier string) bool {
@@ -33,8 +61,12 @@ func (w Webhook) Compare(identifier string) bool {
 type Store interface {
 	Set(ctx context.Context, webhook Webhook) (*Webhook, error)
 	SetPubkeyDetails(ctx context.Context, pubkey string, username string, offer *string) (*PubkeyDetails, error)
+	SetPaymentInstructions(ctx context.Context, pubkey string, instructions PaymentInstructions) error
+	// SetWebhookOffer records the offer published by the registration of the webhook.
+	SetWebhookOffer(ctx context.Context, pubkey, url string, offer *string) error
 	GetLastUpdated(ctx context.Context, identifier string) (*Webhook, error)
 	GetPubkeyDetails(ctx context.Context, identifier string) (*PubkeyDetails, error)
+	ListPubkeyDetails(ctx context.Context) ([]PubkeyDetails, error)
 	Remove(ctx context.Context, pubkey, url string) error
 	DeleteExpired(ctx context.Context, before time.Time) error
 }
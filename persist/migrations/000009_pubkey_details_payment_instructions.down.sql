@@ -0,0 +1,3 @@
+ALTER TABLE public.pubkey_details DROP COLUMN lnurl_fallback;
+ALTER TABLE public.pubkey_details DROP COLUMN silent_payment_address;
+ALTER TABLE public.pubkey_details DROP COLUMN bitcoin_address;
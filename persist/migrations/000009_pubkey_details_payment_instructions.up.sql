@@ -0,0 +1,3 @@
+ALTER TABLE public.pubkey_details ADD COLUMN bitcoin_address varchar;
+ALTER TABLE public.pubkey_details ADD COLUMN silent_payment_address varchar;
+ALTER TABLE public.pubkey_details ADD COLUMN lnurl_fallback boolean NOT NULL DEFAULT false;
@@ -0,0 +1,18 @@
+-- Queue of BIP353 DNS record changes, holding the latest requested change per username
+CREATE TABLE public.dns_updates (
+  username varchar PRIMARY KEY,
+  pubkey bytea NOT NULL,
+  action varchar NOT NULL,
+  offer varchar,
+  bitcoin_address varchar,
+  silent_payment_address varchar,
+  lnurl_fallback boolean NOT NULL DEFAULT false,
+  status varchar NOT NULL,
+  version bigint NOT NULL DEFAULT 0,
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt_at timestamp without time zone NOT NULL,
+  last_error varchar,
+  updated_at timestamp without time zone NOT NULL
+);
+
+CREATE INDEX dns_updates_pending_idx ON public.dns_updates (next_attempt_at) WHERE status = 'pending';
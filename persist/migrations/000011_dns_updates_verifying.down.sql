@@ -0,0 +1,3 @@
+UPDATE public.dns_updates SET status = 'published' WHERE status IN ('verifying', 'verified');
+DROP INDEX public.dns_updates_pending_idx;
+CREATE INDEX dns_updates_pending_idx ON public.dns_updates (next_attempt_at) WHERE status = 'pending';
@@ -0,0 +1,3 @@
+-- Updates waiting for their DNSSEC verification are claimed as the pending ones
+DROP INDEX public.dns_updates_pending_idx;
+CREATE INDEX dns_updates_pending_idx ON public.dns_updates (next_attempt_at) WHERE status IN ('pending', 'verifying');
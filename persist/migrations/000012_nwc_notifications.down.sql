@@ -0,0 +1 @@
+DROP TABLE public.nwc_notifications;
@@ -0,0 +1,17 @@
+-- Pre-signed wallet notification events (kinds 23196/23197) published to the relays
+CREATE TABLE public.nwc_notifications (
+  event_id varchar(64) PRIMARY KEY,
+  wallet_service_pubkey bytea NOT NULL,
+  app_pubkey bytea NOT NULL,
+  event varchar NOT NULL,
+  relays varchar[] NOT NULL,
+  published_relays varchar[] NOT NULL DEFAULT '{}',
+  status varchar NOT NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  last_error varchar,
+  created_at timestamp NOT NULL DEFAULT NOW(),
+  updated_at timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX nwc_notifications_created_at_idx ON public.nwc_notifications (created_at);
+CREATE INDEX nwc_notifications_pending_idx ON public.nwc_notifications (status) WHERE status = 'pending';
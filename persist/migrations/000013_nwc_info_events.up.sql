@@ -0,0 +1,7 @@
+-- Wallet service info events (kind 13194) republished to the relays while the app is offline
+CREATE TABLE public.nwc_info_events (
+  wallet_service_pubkey bytea PRIMARY KEY,
+  event varchar NOT NULL,
+  created_at bigint NOT NULL,
+  updated_at timestamp NOT NULL DEFAULT NOW()
+);
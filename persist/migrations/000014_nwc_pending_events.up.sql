@@ -0,0 +1,12 @@
+-- Wallet request events (kind 23194) kept until expired for the app to pull
+CREATE TABLE public.nwc_pending_events (
+  event_id varchar(64) PRIMARY KEY,
+  wallet_service_pubkey bytea NOT NULL,
+  app_pubkey bytea NOT NULL,
+  event varchar NOT NULL,
+  created_at bigint NOT NULL,
+  expires_at timestamp NOT NULL
+);
+
+CREATE INDEX nwc_pending_events_wallet_service_pubkey_idx ON public.nwc_pending_events (wallet_service_pubkey, created_at);
+CREATE INDEX nwc_pending_events_expires_at_idx ON public.nwc_pending_events (expires_at);
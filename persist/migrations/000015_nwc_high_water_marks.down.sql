@@ -0,0 +1 @@
+DROP TABLE public.nwc_high_water_marks;
@@ -0,0 +1,6 @@
+-- The created_at of the latest request received per wallet service, to backfill missed requests from
+CREATE TABLE public.nwc_high_water_marks (
+  wallet_service_pubkey bytea PRIMARY KEY,
+  last_created_at bigint NOT NULL,
+  updated_at timestamp NOT NULL DEFAULT NOW()
+);
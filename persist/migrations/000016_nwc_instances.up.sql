@@ -0,0 +1,6 @@
+-- The server instances alive, partitioning the wallet services between them
+CREATE TABLE public.nwc_instances (
+  instance_id text PRIMARY KEY,
+  expires_at timestamp NOT NULL,
+  started_at timestamp NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1 @@
+ALTER TABLE public.nwc_forwarded_events DROP COLUMN status;
@@ -0,0 +1,4 @@
+-- The forwarding state of the events, claimed before sending the webhook so it is sent once.
+-- The events recorded so far were delivered.
+ALTER TABLE public.nwc_forwarded_events ADD COLUMN status varchar NOT NULL DEFAULT 'delivered';
+ALTER TABLE public.nwc_forwarded_events ALTER COLUMN status DROP DEFAULT;
@@ -0,0 +1,2 @@
+-- The original relay urls are not restored, the canonical urls are equivalent
+SELECT 1;
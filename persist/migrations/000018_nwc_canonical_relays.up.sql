@@ -0,0 +1,33 @@
+-- Canonicalise the stored relay urls: lowercase scheme and host, no default port and no trailing slash
+CREATE TEMPORARY TABLE nwc_relays_canonical AS
+SELECT id, canonical, MIN(id) OVER (PARTITION BY canonical) AS canonical_id
+FROM (
+  SELECT id,
+    regexp_replace(lower(substring(url FROM '^[a-zA-Z]+://[^/?#]*')), ':443$', '')
+      || rtrim(coalesce(substring(url FROM '^[a-zA-Z]+://[^/?#]*(.*)$'), ''), '/') AS canonical
+  FROM public.nwc_relays
+  WHERE url ~ '^[a-zA-Z]+://'
+) relays;
+
+-- Merge the relays with the same canonical url into the one with the lowest id
+INSERT INTO public.nwc_webhooks_relays (webhook_id, relay_id)
+SELECT wr.webhook_id, c.canonical_id
+FROM public.nwc_webhooks_relays wr
+JOIN nwc_relays_canonical c ON c.id = wr.relay_id
+WHERE c.id <> c.canonical_id
+ON CONFLICT DO NOTHING;
+
+DELETE FROM public.nwc_webhooks_relays wr
+USING nwc_relays_canonical c
+WHERE c.id = wr.relay_id AND c.id <> c.canonical_id;
+
+DELETE FROM public.nwc_relays r
+USING nwc_relays_canonical c
+WHERE c.id = r.id AND c.id <> c.canonical_id;
+
+UPDATE public.nwc_relays r
+SET url = c.canonical
+FROM nwc_relays_canonical c
+WHERE c.id = r.id AND r.url <> c.canonical;
+
+DROP TABLE nwc_relays_canonical;
@@ -0,0 +1 @@
+DROP INDEX public.nwc_webhooks_relays_relay_id_idx;
@@ -0,0 +1,27 @@
+-- The relay ids were assigned modulo 10 by the server, overwriting the url of existing relays.
+-- The ids are now assigned by the sequence, moved past the ids already used.
+SELECT setval(
+  pg_get_serial_sequence('public.nwc_relays', 'id'),
+  COALESCE((SELECT MAX(id) FROM public.nwc_relays), 0) + 1,
+  false
+);
+
+-- Ids were only reused once 10 relays were stored. The webhooks linked to these relays may
+-- point to an overwritten url, and the original urls are lost: drop the webhooks, their apps
+-- get a 404 when publishing and register again with their relays.
+DELETE FROM public.nwc_webhooks w
+WHERE (SELECT COUNT(*) FROM public.nwc_relays) >= 10
+AND EXISTS (
+  SELECT 1 FROM public.nwc_webhooks_relays wr
+  WHERE wr.webhook_id = w.id AND wr.relay_id < 10
+);
+
+-- Drop the relays left without any webhook.
+DELETE FROM public.nwc_relays r
+WHERE NOT EXISTS (
+  SELECT 1 FROM public.nwc_webhooks_relays wr
+  WHERE wr.relay_id = r.id
+);
+
+-- Index to find the relays no webhook references anymore
+CREATE INDEX nwc_webhooks_relays_relay_id_idx ON public.nwc_webhooks_relays (relay_id);
@@ -0,0 +1 @@
+DROP TABLE public.rate_limit_buckets;
@@ -0,0 +1,9 @@
+-- The token buckets of the rate limits shared between the instances. The
+-- buckets are transient, unlogged saves the WAL writes on every request.
+CREATE UNLOGGED TABLE public.rate_limit_buckets (
+  key text PRIMARY KEY,
+  tokens double precision NOT NULL,
+  allowed boolean NOT NULL,
+  updated_at timestamp NOT NULL
+);
+CREATE INDEX rate_limit_buckets_updated_at_idx ON public.rate_limit_buckets (updated_at);
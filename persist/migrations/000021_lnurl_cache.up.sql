@@ -0,0 +1,8 @@
+-- The lnurl responses cached for all the instances. The cache is transient,
+-- unlogged saves the WAL writes and is emptied after a crash.
+CREATE UNLOGGED TABLE public.lnurl_cache (
+  key text PRIMARY KEY,
+  data bytea NOT NULL,
+  expires_at timestamp NOT NULL
+);
+CREATE INDEX lnurl_cache_expires_at_idx ON public.lnurl_cache (expires_at);
@@ -0,0 +1,2 @@
+DROP INDEX public.lnurl_cache_owner_idx;
+ALTER TABLE public.lnurl_cache DROP COLUMN owner;
@@ -0,0 +1,3 @@
+-- The pubkey owning the cached entry, to invalidate all the entries of a pubkey and its username
+ALTER TABLE public.lnurl_cache ADD COLUMN owner text;
+CREATE INDEX lnurl_cache_owner_idx ON public.lnurl_cache (owner);
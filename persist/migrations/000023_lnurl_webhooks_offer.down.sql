@@ -0,0 +1 @@
+ALTER TABLE public.lnurl_webhooks DROP COLUMN offer;
@@ -0,0 +1,4 @@
+-- The offer published by the lnurl registration, only cleared from pubkey_details when the registration expires.
+-- The existing offers cannot be told apart from the ones registered through the bolt12 endpoint, so they are
+-- left NULL and kept on expiry until the lnurl registration is refreshed.
+ALTER TABLE public.lnurl_webhooks ADD COLUMN offer varchar;
@@ -0,0 +1,2 @@
+DROP INDEX public.nwc_pending_events_wallet_service_pubkey_idx;
+CREATE INDEX nwc_pending_events_wallet_service_pubkey_idx ON public.nwc_pending_events (wallet_service_pubkey, created_at);
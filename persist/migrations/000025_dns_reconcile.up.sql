@@ -0,0 +1,7 @@
+-- The next run of the BIP353 zone reconciliation, claimed by a single instance
+CREATE TABLE public.dns_reconcile (
+  id boolean PRIMARY KEY DEFAULT true CHECK (id),
+  next_run_at timestamp without time zone NOT NULL
+);
+
+INSERT INTO public.dns_reconcile (next_run_at) VALUES (NOW());
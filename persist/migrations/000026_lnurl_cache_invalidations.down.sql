@@ -0,0 +1 @@
+DROP TABLE public.lnurl_cache_invalidations;
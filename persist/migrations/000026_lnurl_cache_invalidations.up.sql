@@ -0,0 +1,7 @@
+-- The last invalidation of the cached entries of each owner, in unix microseconds. The responses
+-- requested before it are not cached, by any instance.
+CREATE UNLOGGED TABLE public.lnurl_cache_invalidations (
+  owner text PRIMARY KEY,
+  invalidated_at bigint NOT NULL
+);
+CREATE INDEX lnurl_cache_invalidations_invalidated_at_idx ON public.lnurl_cache_invalidations (invalidated_at);
@@ -20,6 +20,9 @@ var ExpiryDuration time.Duration = time.Hour * 24 * 30
 // The duration to keep forwarded events records (7 days)
 var ForwardedEventsRetentionDuration time.Duration = time.Hour * 24 * 7
 
+// The duration to keep published notifications records (7 days)
+var NotificationsRetentionDuration time.Duration = time.Hour * 24 * 7
+
 func NewCleanupService(store Store) *CleanupService {
 	return &CleanupService{
 		store:   store,
@@ -27,7 +30,7 @@ func NewCleanupService(store Store) *CleanupService {
 	}
 }
 
-// Periodically cleans up expired NWC uris and old forwarded events
+// Periodically cleans up expired NWC uris and pending events, old forwarded events and notifications
 func (c *CleanupService) Start(ctx context.Context) {
 	for {
 		// Cleanup expired webhooks
@@ -44,6 +47,19 @@ func (c *CleanupService) Start(ctx context.Context) {
 			log.Printf("Failed to remove old forwarded events before %v: %v", eventsBefore, err)
 		}
 
+		// Cleanup old notifications records
+		notificationsBefore := time.Now().Add(-NotificationsRetentionDuration)
+		err = c.store.DeleteOldNotifications(ctx, notificationsBefore)
+		if err != nil {
+			log.Printf("Failed to remove old notifications before %v: %v", notificationsBefore, err)
+		}
+
+		// Cleanup expired pending request events
+		err = c.store.DeleteExpiredPendingEvents(ctx, time.Now())
+		if err != nil {
+			log.Printf("Failed to remove expired pending events: %v", err)
+		}
+
 		select {
 		case <-time.After(CleanupInterval):
 			continue
@@ -1,24 +1,50 @@
 package persist
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"slices"
+	"sync"
 	"time"
 )
 
+type forwardedEvent struct {
+	status    string
+	claimedAt time.Time
+}
+
 type MemoryStore struct {
+	mu              sync.Mutex
 	webhooks        []Webhook
-	forwardedEvents map[string]bool // eventId -> forwarded
+	forwardedEvents map[string]forwardedEvent
+	notificationsMu sync.Mutex
+	notifications   map[string]Notification
+	infoEventsMu    sync.Mutex
+	infoEvents      map[string]InfoEvent
+	pendingMu       sync.Mutex
+	pendingEvents   map[string]PendingEvent
+	marksMu         sync.Mutex
+	highWaterMarks  map[string]int64
+	leasesMu        sync.Mutex
+	leases          map[string]time.Time
 }
 
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
 		webhooks:        []Webhook{},
-		forwardedEvents: make(map[string]bool),
+		forwardedEvents: make(map[string]forwardedEvent),
+		notifications:   make(map[string]Notification),
+		infoEvents:      make(map[string]InfoEvent),
+		pendingEvents:   make(map[string]PendingEvent),
+		highWaterMarks:  make(map[string]int64),
+		leases:          make(map[string]time.Time),
 	}
 }
 
 func (m *MemoryStore) Set(ctx context.Context, webhook Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for i, hook := range m.webhooks {
 		if hook.Compare(webhook.WalletServicePubkey, webhook.AppPubkey) {
 			m.webhooks[i] = webhook
@@ -30,6 +56,8 @@ func (m *MemoryStore) Set(ctx context.Context, webhook Webhook) error {
 }
 
 func (m *MemoryStore) Get(ctx context.Context, walletServicePubkey string, appPubkey string) (*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, hook := range m.webhooks {
 		if hook.Compare(walletServicePubkey, appPubkey) {
 			return &hook, nil
@@ -39,6 +67,8 @@ func (m *MemoryStore) Get(ctx context.Context, walletServicePubkey string, appPu
 }
 
 func (m *MemoryStore) Delete(ctx context.Context, walletServicePubkey string, appPubkey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for i, hook := range m.webhooks {
 		if hook.Compare(walletServicePubkey, appPubkey) {
 			m.webhooks = append(m.webhooks[:i], m.webhooks[i+1:]...)
@@ -48,8 +78,10 @@ func (m *MemoryStore) Delete(ctx context.Context, walletServicePubkey string, ap
 }
 
 func (m *MemoryStore) Update(ctx context.Context, details WebhookDetails) error {
-	m.forwardedEvents[details.EventId] = true
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	now := time.Now()
+	m.forwardedEvents[details.EventId] = forwardedEvent{status: EventStatusDelivered, claimedAt: now}
 	for i, hook := range m.webhooks {
 		if hook.Compare(details.WalletServicePubkey, details.AppPubkey) {
 			m.webhooks[i].LastUsedAt = &now
@@ -60,6 +92,8 @@ func (m *MemoryStore) Update(ctx context.Context, details WebhookDetails) error
 }
 
 func (m *MemoryStore) GetSubscriptionDetails(ctx context.Context) (map[string]SubscriptionDetails, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	subs := make(map[string]SubscriptionDetails)
 	for _, hook := range m.webhooks {
 		sub, ok := subs[hook.WalletServicePubkey]
@@ -75,10 +109,44 @@ func (m *MemoryStore) GetSubscriptionDetails(ctx context.Context) (map[string]Su
 		}
 		subs[hook.WalletServicePubkey] = sub
 	}
+	m.marksMu.Lock()
+	defer m.marksMu.Unlock()
+	for walletServicePubkey, sub := range subs {
+		sub.HighWaterMark = m.highWaterMarks[walletServicePubkey]
+		subs[walletServicePubkey] = sub
+	}
 	return subs, nil
 }
 
+func (m *MemoryStore) GetWalletRelays(ctx context.Context, walletServicePubkey string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var relays []string
+	for _, hook := range m.webhooks {
+		if hook.WalletServicePubkey != walletServicePubkey {
+			continue
+		}
+		for _, relay := range hook.Relays {
+			if !slices.Contains(relays, relay) {
+				relays = append(relays, relay)
+			}
+		}
+	}
+	return relays, nil
+}
+
+func (m *MemoryStore) SetHighWaterMark(ctx context.Context, walletServicePubkey string, createdAt int64) error {
+	m.marksMu.Lock()
+	defer m.marksMu.Unlock()
+	if createdAt > m.highWaterMarks[walletServicePubkey] {
+		m.highWaterMarks[walletServicePubkey] = createdAt
+	}
+	return nil
+}
+
 func (m *MemoryStore) GetRelays(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	relays := make(map[string]bool)
 	for _, hook := range m.webhooks {
 		for _, relay := range hook.Relays {
@@ -96,10 +164,179 @@ func (m *MemoryStore) DeleteExpired(ctx context.Context, before time.Time) error
 	return nil
 }
 
+func (m *MemoryStore) ClaimEvent(ctx context.Context, details WebhookDetails, staleBefore time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if event, exists := m.forwardedEvents[details.EventId]; exists {
+		stale := event.status == EventStatusClaimed && event.claimedAt.Before(staleBefore)
+		if event.status != EventStatusFailed && !stale {
+			return false, nil
+		}
+	}
+	m.forwardedEvents[details.EventId] = forwardedEvent{status: EventStatusClaimed, claimedAt: time.Now()}
+	return true, nil
+}
+
+func (m *MemoryStore) FailEvent(ctx context.Context, eventId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if event, exists := m.forwardedEvents[eventId]; exists && event.status == EventStatusClaimed {
+		event.status = EventStatusFailed
+		m.forwardedEvents[eventId] = event
+	}
+	return nil
+}
+
 func (m *MemoryStore) IsEventForwarded(ctx context.Context, eventId string) (bool, error) {
-	return m.forwardedEvents[eventId], nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.forwardedEvents[eventId].status == EventStatusDelivered, nil
 }
 func (m *MemoryStore) DeleteOldForwardedEvents(ctx context.Context, before time.Time) error {
 	// In-memory implementation doesn't need cleanup as it's temporary
 	return nil
 }
+
+func (m *MemoryStore) AddNotification(ctx context.Context, notification Notification) (bool, error) {
+	m.notificationsMu.Lock()
+	defer m.notificationsMu.Unlock()
+	if _, exists := m.notifications[notification.EventId]; exists {
+		return false, nil
+	}
+	notification.PublishedRelays = slices.Clone(notification.PublishedRelays)
+	m.notifications[notification.EventId] = notification
+	return true, nil
+}
+
+func (m *MemoryStore) UpdateNotification(ctx context.Context, notification Notification) error {
+	m.notificationsMu.Lock()
+	defer m.notificationsMu.Unlock()
+	if _, exists := m.notifications[notification.EventId]; exists {
+		notification.PublishedRelays = slices.Clone(notification.PublishedRelays)
+		m.notifications[notification.EventId] = notification
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetNotification(ctx context.Context, eventId string) (*Notification, error) {
+	m.notificationsMu.Lock()
+	defer m.notificationsMu.Unlock()
+	notification, exists := m.notifications[eventId]
+	if !exists {
+		return nil, nil
+	}
+	return &notification, nil
+}
+
+func (m *MemoryStore) GetPendingNotifications(ctx context.Context) ([]Notification, error) {
+	m.notificationsMu.Lock()
+	defer m.notificationsMu.Unlock()
+	var pending []Notification
+	for _, notification := range m.notifications {
+		if notification.Status == NotificationStatusPending {
+			pending = append(pending, notification)
+		}
+	}
+	return pending, nil
+}
+
+func (m *MemoryStore) DeleteOldNotifications(ctx context.Context, before time.Time) error {
+	// In-memory implementation doesn't need cleanup as it's temporary
+	return nil
+}
+
+func (m *MemoryStore) SetInfoEvent(ctx context.Context, infoEvent InfoEvent) error {
+	m.infoEventsMu.Lock()
+	defer m.infoEventsMu.Unlock()
+	existing, exists := m.infoEvents[infoEvent.WalletServicePubkey]
+	if !exists || existing.CreatedAt <= infoEvent.CreatedAt {
+		m.infoEvents[infoEvent.WalletServicePubkey] = infoEvent
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetInfoEvent(ctx context.Context, walletServicePubkey string) (*InfoEvent, error) {
+	m.infoEventsMu.Lock()
+	defer m.infoEventsMu.Unlock()
+	infoEvent, exists := m.infoEvents[walletServicePubkey]
+	if !exists {
+		return nil, nil
+	}
+	return &infoEvent, nil
+}
+
+func (m *MemoryStore) AddPendingEvent(ctx context.Context, event PendingEvent) error {
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	if _, exists := m.pendingEvents[event.EventId]; !exists {
+		m.pendingEvents[event.EventId] = event
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetPendingEvents(ctx context.Context, walletServicePubkey string, appPubkey string, since int64, afterEventId string, limit int) ([]PendingEvent, error) {
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	now := time.Now()
+	events := []PendingEvent{}
+	for _, event := range m.pendingEvents {
+		if event.WalletServicePubkey != walletServicePubkey || event.AppPubkey != appPubkey || !event.ExpiresAt.After(now) {
+			continue
+		}
+		if cmp.Or(cmp.Compare(event.CreatedAt, since), cmp.Compare(event.EventId, afterEventId)) > 0 {
+			events = append(events, event)
+		}
+	}
+	slices.SortFunc(events, func(a, b PendingEvent) int {
+		return cmp.Or(cmp.Compare(a.CreatedAt, b.CreatedAt), cmp.Compare(a.EventId, b.EventId))
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (m *MemoryStore) DeleteExpiredPendingEvents(ctx context.Context, before time.Time) error {
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	for eventId, event := range m.pendingEvents {
+		if event.ExpiresAt.Before(before) {
+			delete(m.pendingEvents, eventId)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) RenewInstanceLease(ctx context.Context, instanceId string, duration time.Duration) error {
+	m.leasesMu.Lock()
+	defer m.leasesMu.Unlock()
+	now := time.Now()
+	for id, expiresAt := range m.leases {
+		if !expiresAt.After(now) {
+			delete(m.leases, id)
+		}
+	}
+	m.leases[instanceId] = now.Add(duration)
+	return nil
+}
+
+func (m *MemoryStore) GetInstances(ctx context.Context) ([]string, error) {
+	m.leasesMu.Lock()
+	defer m.leasesMu.Unlock()
+	now := time.Now()
+	var instances []string
+	for id, expiresAt := range m.leases {
+		if expiresAt.After(now) {
+			instances = append(instances, id)
+		}
+	}
+	slices.Sort(instances)
+	return instances, nil
+}
+
+func (m *MemoryStore) DeleteInstanceLease(ctx context.Context, instanceId string) error {
+	m.leasesMu.Lock()
+	defer m.leasesMu.Unlock()
+	delete(m.leases, instanceId)
+	return nil
+}
@@ -5,9 +5,9 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 
-	"github.com/breez/breez-lnurl/constant"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -53,27 +53,24 @@ func (s *PgStore) Set(ctx context.Context, webhook Webhook) error {
 		return fmt.Errorf("failed to insert/update webhook: %w", err)
 	}
 
-	relays, err := getRelaysByUrl(ctx, tx)
-	if err != nil {
-		return err
-	}
-
-	for _, relayUrl := range webhook.Relays {
-		relayId, exists := relays[relayUrl]
-		if !exists {
-			relayId = len(relays) % constant.NWC_MAX_RELAYS_LENGTH
-			_, err = tx.Exec(
-				ctx,
-				`INSERT INTO public.nwc_relays (id, url)
-                 VALUES ($1, $2)
-                 ON CONFLICT (id) DO UPDATE SET url = EXCLUDED.url`,
-				relayId, relayUrl,
-			)
-			if err != nil {
-				return fmt.Errorf("failed to insert relay: %w", err)
-			}
-			relays[relayUrl] = relayId
+	// The relay rows are locked in order, avoiding deadlocks between concurrent registrations
+	relayUrls := slices.Clone(webhook.Relays)
+	slices.Sort(relayUrls)
+	relayIds := []int64{}
+	for _, relayUrl := range slices.Compact(relayUrls) {
+		var relayId int64
+		err = tx.QueryRow(
+			ctx,
+			`INSERT INTO public.nwc_relays (url)
+			 VALUES ($1)
+			 ON CONFLICT (url) DO UPDATE SET url = EXCLUDED.url
+			 RETURNING id`,
+			relayUrl,
+		).Scan(&relayId)
+		if err != nil {
+			return fmt.Errorf("failed to insert relay: %w", err)
 		}
+		relayIds = append(relayIds, relayId)
 
 		_, err = tx.Exec(
 			ctx,
@@ -87,6 +84,18 @@ func (s *PgStore) Set(ctx context.Context, webhook Webhook) error {
 		}
 	}
 
+	// The registration replaces the relays of the webhook
+	_, err = tx.Exec(
+		ctx,
+		`DELETE FROM public.nwc_webhooks_relays
+		 WHERE webhook_id = $1 AND NOT (relay_id = ANY($2))`,
+		webhookId,
+		relayIds,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to unlink webhook relays: %w", err)
+	}
+
 	return tx.Commit(ctx)
 }
 
@@ -180,9 +189,10 @@ func (s *PgStore) Update(ctx context.Context, details WebhookDetails) error {
 
 	_, err = tx.Exec(
 		ctx,
-		`INSERT INTO public.nwc_forwarded_events (event_id, wallet_service_pubkey, app_pubkey, webhook_url, forwarded_at)
-		 VALUES ($1, $2, $3, $4, NOW())
-		 ON CONFLICT (event_id) DO NOTHING`,
+		`INSERT INTO public.nwc_forwarded_events (event_id, wallet_service_pubkey, app_pubkey, webhook_url, status, forwarded_at)
+		 VALUES ($1, $2, $3, $4, 'delivered', NOW())
+		 ON CONFLICT (event_id) DO UPDATE
+		 SET status = 'delivered', forwarded_at = NOW()`,
 		details.EventId,
 		walletServicePubkeyBytes,
 		appPubkeyBytes,
@@ -222,10 +232,12 @@ func (s *PgStore) Delete(ctx context.Context, walletServicePubkey string, appPub
 func (s *PgStore) GetSubscriptionDetails(ctx context.Context) (map[string]SubscriptionDetails, error) {
 	rows, err := s.pool.Query(
 		ctx,
-		`SELECT encode(w.wallet_service_pubkey, 'hex'), encode(w.app_pubkey, 'hex'), nr.url
+		`SELECT encode(w.wallet_service_pubkey, 'hex'), encode(w.app_pubkey, 'hex'), nr.url,
+		 COALESCE(m.last_created_at, 0)
 		 FROM public.nwc_webhooks w
 		 LEFT JOIN public.nwc_webhooks_relays nwr ON w.id = nwr.webhook_id
-		 LEFT JOIN public.nwc_relays nr ON nwr.relay_id = nr.id`,
+		 LEFT JOIN public.nwc_relays nr ON nwr.relay_id = nr.id
+		 LEFT JOIN public.nwc_high_water_marks m ON w.wallet_service_pubkey = m.wallet_service_pubkey`,
 	)
 	if err != nil {
 		return nil, err
@@ -236,7 +248,8 @@ func (s *PgStore) GetSubscriptionDetails(ctx context.Context) (map[string]Subscr
 	for rows.Next() {
 		var walletServicePubkey, appPubkey string
 		var relayUrl *string
-		if err := rows.Scan(&walletServicePubkey, &appPubkey, &relayUrl); err != nil {
+		var highWaterMark int64
+		if err := rows.Scan(&walletServicePubkey, &appPubkey, &relayUrl, &highWaterMark); err != nil {
 			return nil, err
 		}
 		sub, ok := subs[walletServicePubkey]
@@ -247,6 +260,7 @@ func (s *PgStore) GetSubscriptionDetails(ctx context.Context) (map[string]Subscr
 			}
 		}
 		sub.AppPubkeys[appPubkey] = true
+		sub.HighWaterMark = highWaterMark
 		if relayUrl != nil {
 			sub.Relays[*relayUrl] = true
 		}
@@ -258,6 +272,39 @@ func (s *PgStore) GetSubscriptionDetails(ctx context.Context) (map[string]Subscr
 	return subs, nil
 }
 
+func (s *PgStore) GetWalletRelays(ctx context.Context, walletServicePubkey string) ([]string, error) {
+	walletServicePubkeyBytes, err := hex.DecodeString(walletServicePubkey)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.pool.Query(
+		ctx,
+		`SELECT DISTINCT nr.url
+		 FROM public.nwc_webhooks w
+		 JOIN public.nwc_webhooks_relays nwr ON w.id = nwr.webhook_id
+		 JOIN public.nwc_relays nr ON nwr.relay_id = nr.id
+		 WHERE w.wallet_service_pubkey = $1`,
+		walletServicePubkeyBytes,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var relays []string
+	for rows.Next() {
+		var relay string
+		if err := rows.Scan(&relay); err != nil {
+			return nil, err
+		}
+		relays = append(relays, relay)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return relays, nil
+}
+
 func (s *PgStore) GetRelays(ctx context.Context) ([]string, error) {
 	rows, err := s.pool.Query(ctx, `SELECT url FROM public.nwc_relays`)
 	if err != nil {
@@ -274,27 +321,63 @@ func (s *PgStore) DeleteExpired(ctx context.Context, before time.Time) error {
 		`DELETE FROM public.nwc_webhooks
 		 WHERE last_used_at < to_timestamp($1)`,
 		beforeUnix)
-	return err
-}
+	if err != nil {
+		return err
+	}
 
-func getRelaysByUrl(ctx context.Context, con pgx.Tx) (map[string]int, error) {
-	rows, err := con.Query(ctx, `SELECT id, url FROM public.nwc_relays`)
+	// Stop hosting the info events of wallet services without webhooks
+	_, err = s.pool.Exec(
+		ctx,
+		`DELETE FROM public.nwc_info_events ie
+		 WHERE NOT EXISTS (
+		   SELECT 1 FROM public.nwc_webhooks w
+		   WHERE w.wallet_service_pubkey = ie.wallet_service_pubkey)`,
+	)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	var id int
-	var url string
-	relays := make(map[string]int)
-	for rows.Next() {
-		err := rows.Scan(&id, &url)
-		if err != nil {
-			return nil, err
-		}
-		relays[url] = id
+	_, err = s.pool.Exec(
+		ctx,
+		`DELETE FROM public.nwc_high_water_marks m
+		 WHERE NOT EXISTS (
+		   SELECT 1 FROM public.nwc_webhooks w
+		   WHERE w.wallet_service_pubkey = m.wallet_service_pubkey)`,
+	)
+	if err != nil {
+		return err
 	}
-	return relays, nil
+
+	// Drop the relays no webhook references anymore, skipping the ones being registered
+	_, err = s.pool.Exec(
+		ctx,
+		`DELETE FROM public.nwc_relays
+		 WHERE id IN (
+		   SELECT r.id FROM public.nwc_relays r
+		   WHERE NOT EXISTS (
+		     SELECT 1 FROM public.nwc_webhooks_relays wr
+		     WHERE wr.relay_id = r.id)
+		   FOR UPDATE SKIP LOCKED)`,
+	)
+	return err
+}
+
+func (s *PgStore) SetHighWaterMark(ctx context.Context, walletServicePubkey string, createdAt int64) error {
+	walletServicePubkeyBytes, err := hex.DecodeString(walletServicePubkey)
+	if err != nil {
+		return fmt.Errorf("invalid wallet service pubkey: %w", err)
+	}
+	_, err = s.pool.Exec(
+		ctx,
+		`INSERT INTO public.nwc_high_water_marks (wallet_service_pubkey, last_created_at, updated_at)
+		 VALUES ($1, $2, NOW())
+		 ON CONFLICT (wallet_service_pubkey) DO UPDATE
+		 SET last_created_at = GREATEST(nwc_high_water_marks.last_created_at, EXCLUDED.last_created_at),
+		 updated_at = NOW()`,
+		walletServicePubkeyBytes,
+		createdAt,
+	)
+	return err
 }
 
 func rowsToArray(rows pgx.Rows) []string {
@@ -307,11 +390,58 @@ func rowsToArray(rows pgx.Rows) []string {
 	return arr
 }
 
+func (s *PgStore) ClaimEvent(ctx context.Context, details WebhookDetails, staleBefore time.Time) (bool, error) {
+	walletServicePubkeyBytes, err := hex.DecodeString(details.WalletServicePubkey)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode wallet service pubkey: %w", err)
+	}
+	appPubkeyBytes, err := hex.DecodeString(details.AppPubkey)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode app pubkey: %w", err)
+	}
+
+	// The conflicting row is locked, so only one of the concurrent claims succeeds
+	var eventId string
+	err = s.pool.QueryRow(
+		ctx,
+		`INSERT INTO public.nwc_forwarded_events (event_id, wallet_service_pubkey, app_pubkey, webhook_url, status, forwarded_at)
+		 VALUES ($1, $2, $3, $4, 'claimed', NOW())
+		 ON CONFLICT (event_id) DO UPDATE
+		 SET status = 'claimed', forwarded_at = NOW(), webhook_url = EXCLUDED.webhook_url
+		 WHERE nwc_forwarded_events.status = 'failed'
+		 OR (nwc_forwarded_events.status = 'claimed' AND nwc_forwarded_events.forwarded_at < to_timestamp($5))
+		 RETURNING event_id`,
+		details.EventId,
+		walletServicePubkeyBytes,
+		appPubkeyBytes,
+		details.WebhookUrl,
+		staleBefore.Unix(),
+	).Scan(&eventId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim event: %w", err)
+	}
+	return true, nil
+}
+
+func (s *PgStore) FailEvent(ctx context.Context, eventId string) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`UPDATE public.nwc_forwarded_events
+		 SET status = 'failed'
+		 WHERE event_id = $1 AND status = 'claimed'`,
+		eventId,
+	)
+	return err
+}
+
 func (s *PgStore) IsEventForwarded(ctx context.Context, eventId string) (bool, error) {
 	var exists bool
 	err := s.pool.QueryRow(
 		ctx,
-		`SELECT EXISTS(SELECT 1 FROM public.nwc_forwarded_events WHERE event_id = $1)`,
+		`SELECT EXISTS(SELECT 1 FROM public.nwc_forwarded_events WHERE event_id = $1 AND status = 'delivered')`,
 		eventId,
 	).Scan(&exists)
 
@@ -332,3 +462,250 @@ func (s *PgStore) DeleteOldForwardedEvents(ctx context.Context, before time.Time
 	)
 	return err
 }
+
+func (s *PgStore) AddNotification(ctx context.Context, notification Notification) (bool, error) {
+	walletServicePubkey, err := hex.DecodeString(notification.WalletServicePubkey)
+	if err != nil {
+		return false, fmt.Errorf("invalid wallet service pubkey: %w", err)
+	}
+	appPubkey, err := hex.DecodeString(notification.AppPubkey)
+	if err != nil {
+		return false, fmt.Errorf("invalid app pubkey: %w", err)
+	}
+
+	tag, err := s.pool.Exec(
+		ctx,
+		`INSERT INTO public.nwc_notifications (event_id, wallet_service_pubkey, app_pubkey, event,
+		 relays, published_relays, status, attempts, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW(), NOW())
+		 ON CONFLICT (event_id) DO NOTHING`,
+		notification.EventId,
+		walletServicePubkey,
+		appPubkey,
+		notification.Event,
+		notification.Relays,
+		nonNil(notification.PublishedRelays),
+		notification.Status,
+		notification.Attempts,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert notification: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s *PgStore) UpdateNotification(ctx context.Context, notification Notification) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`UPDATE public.nwc_notifications
+		 SET published_relays = $2, status = $3, attempts = $4, last_error = $5, updated_at = NOW()
+		 WHERE event_id = $1`,
+		notification.EventId,
+		nonNil(notification.PublishedRelays),
+		notification.Status,
+		notification.Attempts,
+		notification.LastError,
+	)
+	return err
+}
+
+func (s *PgStore) GetNotification(ctx context.Context, eventId string) (*Notification, error) {
+	notifications, err := s.queryNotifications(ctx, `WHERE event_id = $1`, eventId)
+	if err != nil || len(notifications) == 0 {
+		return nil, err
+	}
+	return &notifications[0], nil
+}
+
+func (s *PgStore) GetPendingNotifications(ctx context.Context) ([]Notification, error) {
+	return s.queryNotifications(ctx, `WHERE status = $1`, NotificationStatusPending)
+}
+
+func (s *PgStore) DeleteOldNotifications(ctx context.Context, before time.Time) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`DELETE FROM public.nwc_notifications
+		 WHERE created_at < to_timestamp($1)`,
+		before.Unix(),
+	)
+	return err
+}
+
+func (s *PgStore) queryNotifications(ctx context.Context, where string, args ...any) ([]Notification, error) {
+	rows, err := s.pool.Query(
+		ctx,
+		`SELECT event_id, encode(wallet_service_pubkey, 'hex') wallet_service_pubkey,
+		 encode(app_pubkey, 'hex') app_pubkey, event, relays, published_relays, status, attempts, last_error
+		 FROM public.nwc_notifications `+where,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Notification])
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func (s *PgStore) SetInfoEvent(ctx context.Context, infoEvent InfoEvent) error {
+	walletServicePubkey, err := hex.DecodeString(infoEvent.WalletServicePubkey)
+	if err != nil {
+		return fmt.Errorf("invalid wallet service pubkey: %w", err)
+	}
+	_, err = s.pool.Exec(
+		ctx,
+		`INSERT INTO public.nwc_info_events (wallet_service_pubkey, event, created_at, updated_at)
+		 VALUES ($1, $2, $3, NOW())
+		 ON CONFLICT (wallet_service_pubkey) DO UPDATE
+		 SET event = EXCLUDED.event, created_at = EXCLUDED.created_at, updated_at = NOW()
+		 WHERE nwc_info_events.created_at <= EXCLUDED.created_at`,
+		walletServicePubkey,
+		infoEvent.Event,
+		infoEvent.CreatedAt,
+	)
+	return err
+}
+
+func (s *PgStore) GetInfoEvent(ctx context.Context, walletServicePubkey string) (*InfoEvent, error) {
+	walletServicePubkeyBytes, err := hex.DecodeString(walletServicePubkey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wallet service pubkey: %w", err)
+	}
+	rows, err := s.pool.Query(
+		ctx,
+		`SELECT encode(wallet_service_pubkey, 'hex') wallet_service_pubkey, event, created_at
+		 FROM public.nwc_info_events
+		 WHERE wallet_service_pubkey = $1`,
+		walletServicePubkeyBytes,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	infoEvent, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[InfoEvent])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &infoEvent, nil
+}
+
+func (s *PgStore) AddPendingEvent(ctx context.Context, event PendingEvent) error {
+	walletServicePubkey, err := hex.DecodeString(event.WalletServicePubkey)
+	if err != nil {
+		return fmt.Errorf("invalid wallet service pubkey: %w", err)
+	}
+	appPubkey, err := hex.DecodeString(event.AppPubkey)
+	if err != nil {
+		return fmt.Errorf("invalid app pubkey: %w", err)
+	}
+	_, err = s.pool.Exec(
+		ctx,
+		`INSERT INTO public.nwc_pending_events (event_id, wallet_service_pubkey, app_pubkey, event, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, to_timestamp($6))
+		 ON CONFLICT (event_id) DO NOTHING`,
+		event.EventId,
+		walletServicePubkey,
+		appPubkey,
+		event.Event,
+		event.CreatedAt,
+		event.ExpiresAt.Unix(),
+	)
+	return err
+}
+
+func (s *PgStore) GetPendingEvents(ctx context.Context, walletServicePubkey string, appPubkey string, since int64, afterEventId string, limit int) ([]PendingEvent, error) {
+	walletServicePubkeyBytes, err := hex.DecodeString(walletServicePubkey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wallet service pubkey: %w", err)
+	}
+	appPubkeyBytes, err := hex.DecodeString(appPubkey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid app pubkey: %w", err)
+	}
+	rows, err := s.pool.Query(
+		ctx,
+		`SELECT event_id, encode(wallet_service_pubkey, 'hex') wallet_service_pubkey,
+		 encode(app_pubkey, 'hex') app_pubkey, event, created_at, expires_at
+		 FROM public.nwc_pending_events
+		 WHERE wallet_service_pubkey = $1 AND app_pubkey = $2 AND (created_at, event_id) > ($3, $4) AND expires_at > NOW()
+		 ORDER BY created_at, event_id
+		 LIMIT $5`,
+		walletServicePubkeyBytes,
+		appPubkeyBytes,
+		since,
+		afterEventId,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowToStructByName[PendingEvent])
+}
+
+func (s *PgStore) DeleteExpiredPendingEvents(ctx context.Context, before time.Time) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`DELETE FROM public.nwc_pending_events
+		 WHERE expires_at < to_timestamp($1)`,
+		before.Unix(),
+	)
+	return err
+}
+
+func (s *PgStore) RenewInstanceLease(ctx context.Context, instanceId string, duration time.Duration) error {
+	// The database clock is used for all the leases, avoiding the skew between the instances
+	_, err := s.pool.Exec(
+		ctx,
+		`DELETE FROM public.nwc_instances
+		 WHERE expires_at <= NOW()`,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.pool.Exec(
+		ctx,
+		`INSERT INTO public.nwc_instances (instance_id, expires_at)
+		 VALUES ($1, NOW() + make_interval(secs => $2))
+		 ON CONFLICT (instance_id) DO UPDATE
+		 SET expires_at = EXCLUDED.expires_at`,
+		instanceId,
+		duration.Seconds(),
+	)
+	return err
+}
+
+func (s *PgStore) GetInstances(ctx context.Context) ([]string, error) {
+	rows, err := s.pool.Query(
+		ctx,
+		`SELECT instance_id
+		 FROM public.nwc_instances
+		 WHERE expires_at > NOW()
+		 ORDER BY instance_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rowsToArray(rows), nil
+}
+
+func (s *PgStore) DeleteInstanceLease(ctx context.Context, instanceId string) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`DELETE FROM public.nwc_instances
+		 WHERE instance_id = $1`,
+		instanceId,
+	)
+	return err
+}
@@ -0,0 +1,42 @@
+package persist
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"gotest.tools/assert"
+)
+
+func newPgStore(t *testing.T) *PgStore {
+	databaseUrl := os.Getenv("DATABASE_URL")
+	pool, err := pgxpool.New(context.Background(), databaseUrl)
+	assert.NilError(t, err, "failed to connect to database")
+	t.Cleanup(pool.Close)
+	return NewPgStore(pool)
+}
+
+func TestPgStoreClaimEvent(t *testing.T) {
+	testClaimEvent(t, newPgStore(t))
+}
+
+func TestPgStoreManyRelays(t *testing.T) {
+	testManyRelays(t, newPgStore(t))
+}
+
+func TestPgStoreInstanceLeases(t *testing.T) {
+	testInstanceLeases(t, newPgStore(t))
+}
+
+func TestPgStoreInfoEvent(t *testing.T) {
+	testInfoEvent(t, newPgStore(t))
+}
+
+func TestPgStorePendingEvents(t *testing.T) {
+	testPendingEvents(t, newPgStore(t))
+}
+
+func TestPgStoreNotifications(t *testing.T) {
+	testNotifications(t, newPgStore(t))
+}
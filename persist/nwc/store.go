@@ -20,6 +20,8 @@ func (w Webhook) Compare(walletServicePubkey string, appPubkey string) bool {
 type SubscriptionDetails struct {
 	AppPubkeys map[string]bool
 	Relays     map[string]bool
+	// The created_at of the latest request received, to backfill from on resubscribe.
+	HighWaterMark int64
 }
 
 type WebhookDetails struct {
@@ -29,15 +31,91 @@ type WebhookDetails struct {
 	WebhookUrl          string
 }
 
+const (
+	EventStatusClaimed   = "claimed"
+	EventStatusDelivered = "delivered"
+	EventStatusFailed    = "failed"
+)
+
+const (
+	NotificationStatusPending   = "pending"
+	NotificationStatusPublished = "published"
+	NotificationStatusFailed    = "failed"
+)
+
+// Notification is a pre-signed wallet notification event published to the relays.
+type Notification struct {
+	EventId             string   `json:"eventId" db:"event_id"`
+	WalletServicePubkey string   `json:"walletServicePubkey" db:"wallet_service_pubkey"`
+	AppPubkey           string   `json:"appPubkey" db:"app_pubkey"`
+	Event               string   `json:"event" db:"event"`
+	Relays              []string `json:"relays" db:"relays"`
+	PublishedRelays     []string `json:"publishedRelays" db:"published_relays"`
+	Status              string   `json:"status" db:"status"`
+	Attempts            int      `json:"attempts" db:"attempts"`
+	LastError           *string  `json:"lastError" db:"last_error"`
+}
+
+// InfoEvent is the signed wallet service info event (kind 13194) hosted for the app.
+type InfoEvent struct {
+	WalletServicePubkey string `json:"walletServicePubkey" db:"wallet_service_pubkey"`
+	Event               string `json:"event" db:"event"`
+	CreatedAt           int64  `json:"createdAt" db:"created_at"`
+}
+
+// PendingEvent is a wallet request event (kind 23194) kept for the app to pull.
+type PendingEvent struct {
+	EventId             string    `json:"eventId" db:"event_id"`
+	WalletServicePubkey string    `json:"walletServicePubkey" db:"wallet_service_pubkey"`
+	AppPubkey           string    `json:"appPubkey" db:"app_pubkey"`
+	Event               string    `json:"event" db:"event"`
+	CreatedAt           int64     `json:"createdAt" db:"created_at"`
+	ExpiresAt           time.Time `json:"expiresAt" db:"expires_at"`
+}
+
 type Store interface {
 	Set(ctx context.Context, webhook Webhook) error
 	Get(ctx context.Context, walletServicePubkey string, appPubkey string) (*Webhook, error)
+	// Update marks the event as delivered and the webhook as used.
 	Update(ctx context.Context, details WebhookDetails) error
 	Delete(ctx context.Context, walletServicePubkey string, appPubkey string) error
 	GetSubscriptionDetails(ctx context.Context) (map[string]SubscriptionDetails, error)
 	GetRelays(ctx context.Context) ([]string, error)
+	// GetWalletRelays returns the relays of all the webhooks of the wallet service.
+	GetWalletRelays(ctx context.Context, walletServicePubkey string) ([]string, error)
+	// SetHighWaterMark raises the created_at of the latest request received by the wallet service.
+	SetHighWaterMark(ctx context.Context, walletServicePubkey string, createdAt int64) error
 	DeleteExpired(ctx context.Context, before time.Time) error
 	// Event deduplication methods
+	// ClaimEvent atomically claims the event for forwarding, returning false if it is delivered or
+	// claimed since staleBefore. Failed events can be claimed again.
+	ClaimEvent(ctx context.Context, details WebhookDetails, staleBefore time.Time) (bool, error)
+	// FailEvent releases the claim of an event the webhook failed to receive.
+	FailEvent(ctx context.Context, eventId string) error
+	// IsEventForwarded returns whether the event was delivered.
 	IsEventForwarded(ctx context.Context, eventId string) (bool, error)
 	DeleteOldForwardedEvents(ctx context.Context, before time.Time) error
+	// Notification publishing methods
+	// AddNotification stores a new notification, returning false if it already exists.
+	AddNotification(ctx context.Context, notification Notification) (bool, error)
+	UpdateNotification(ctx context.Context, notification Notification) error
+	GetNotification(ctx context.Context, eventId string) (*Notification, error)
+	GetPendingNotifications(ctx context.Context) ([]Notification, error)
+	DeleteOldNotifications(ctx context.Context, before time.Time) error
+	// Wallet info event methods
+	// SetInfoEvent stores the info event of the wallet service, unless a newer one is stored.
+	SetInfoEvent(ctx context.Context, infoEvent InfoEvent) error
+	GetInfoEvent(ctx context.Context, walletServicePubkey string) (*InfoEvent, error)
+	// Pending request events methods
+	AddPendingEvent(ctx context.Context, event PendingEvent) error
+	// GetPendingEvents returns the unexpired events sent by the app after the (created_at, event_id) cursor,
+	// ordered by both. An empty afterEventId returns the events created since the given time.
+	GetPendingEvents(ctx context.Context, walletServicePubkey string, appPubkey string, since int64, afterEventId string, limit int) ([]PendingEvent, error)
+	DeleteExpiredPendingEvents(ctx context.Context, before time.Time) error
+	// Instance lease methods, partitioning the wallet services across the server instances
+	// RenewInstanceLease keeps the instance alive for the given duration, dropping the expired leases.
+	RenewInstanceLease(ctx context.Context, instanceId string, duration time.Duration) error
+	// GetInstances returns the ids of the instances holding an unexpired lease, sorted.
+	GetInstances(ctx context.Context) ([]string, error)
+	DeleteInstanceLease(ctx context.Context, instanceId string) error
 }
@@ -0,0 +1,338 @@
+package persist
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func randomHex(t *testing.T) string {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	assert.NilError(t, err, "failed to generate random bytes")
+	return hex.EncodeToString(bytes)
+}
+
+// testClaimEvent checks a single one of the concurrent claims of an event succeeds.
+func testClaimEvent(t *testing.T, store Store) {
+	ctx := context.Background()
+	details := WebhookDetails{
+		EventId:             randomHex(t),
+		WalletServicePubkey: randomHex(t),
+		AppPubkey:           randomHex(t),
+		WebhookUrl:          "http://example.com",
+	}
+	staleBefore := time.Now().Add(-time.Minute)
+
+	claim := func() int32 {
+		var claims atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				claimed, err := store.ClaimEvent(ctx, details, staleBefore)
+				assert.Check(t, err == nil, "failed to claim event: %v", err)
+				if claimed {
+					claims.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		return claims.Load()
+	}
+
+	assert.Equal(t, claim(), int32(1))
+	forwarded, err := store.IsEventForwarded(ctx, details.EventId)
+	assert.NilError(t, err, "failed to check event")
+	assert.Check(t, !forwarded, "claimed event is not delivered yet")
+
+	// A failed event is claimed again
+	assert.NilError(t, store.FailEvent(ctx, details.EventId), "failed to fail event")
+	assert.Equal(t, claim(), int32(1))
+
+	// A stale claim is taken over
+	claimed, err := store.ClaimEvent(ctx, details, time.Now().Add(time.Minute))
+	assert.NilError(t, err, "failed to claim event")
+	assert.Check(t, claimed, "stale claim should be taken over")
+
+	// A delivered event is never claimed again
+	assert.NilError(t, store.Update(ctx, details), "failed to deliver event")
+	assert.Equal(t, claim(), int32(0))
+	assert.NilError(t, store.FailEvent(ctx, details.EventId), "failed to fail event")
+	forwarded, err = store.IsEventForwarded(ctx, details.EventId)
+	assert.NilError(t, err, "failed to check event")
+	assert.Check(t, forwarded, "delivered event should stay delivered")
+}
+
+// testManyRelays checks the relays of many webhooks sharing more relays than a webhook can register.
+func testManyRelays(t *testing.T, store Store) {
+	ctx := context.Background()
+	prefix := fmt.Sprintf("wss://%s-", randomHex(t)[:8])
+	relayUrl := func(i int) string {
+		return fmt.Sprintf("%s%d.example.com", prefix, i%25)
+	}
+	storedRelays := func() []string {
+		relays, err := store.GetRelays(ctx)
+		assert.NilError(t, err, "failed to get relays")
+		relays = slices.DeleteFunc(relays, func(relay string) bool {
+			return !strings.HasPrefix(relay, prefix)
+		})
+		slices.Sort(relays)
+		return relays
+	}
+
+	var webhooks []Webhook
+	for i := 0; i < 30; i++ {
+		webhook := Webhook{
+			WalletServicePubkey: randomHex(t),
+			AppPubkey:           randomHex(t),
+			Url:                 fmt.Sprintf("http://example.com/%d", i),
+			Relays:              []string{relayUrl(i), relayUrl(i + 7), relayUrl(i + 13)},
+		}
+		assert.NilError(t, store.Set(ctx, webhook), "failed to set webhook")
+		webhooks = append(webhooks, webhook)
+	}
+	assert.Equal(t, len(storedRelays()), 25)
+
+	for _, webhook := range webhooks {
+		stored, err := store.Get(ctx, webhook.WalletServicePubkey, webhook.AppPubkey)
+		assert.NilError(t, err, "failed to get webhook")
+		relays := slices.Sorted(slices.Values(stored.Relays))
+		assert.DeepEqual(t, relays, slices.Sorted(slices.Values(webhook.Relays)))
+	}
+
+	// Registering again replaces the relays of the webhook
+	webhooks[0].Relays = []string{relayUrl(24), prefix + "new.example.com"}
+	assert.NilError(t, store.Set(ctx, webhooks[0]), "failed to set webhook")
+	stored, err := store.Get(ctx, webhooks[0].WalletServicePubkey, webhooks[0].AppPubkey)
+	assert.NilError(t, err, "failed to get webhook")
+	assert.DeepEqual(t, slices.Sorted(slices.Values(stored.Relays)), slices.Sorted(slices.Values(webhooks[0].Relays)))
+	subs, err := store.GetSubscriptionDetails(ctx)
+	assert.NilError(t, err, "failed to get subscriptions")
+	assert.Equal(t, len(subs[webhooks[0].WalletServicePubkey].Relays), 2)
+	assert.Equal(t, len(subs[webhooks[1].WalletServicePubkey].Relays), 3)
+
+	// The relays of the wallet are those of all its apps
+	otherApp := webhooks[0]
+	otherApp.AppPubkey = randomHex(t)
+	otherApp.Relays = []string{relayUrl(24), relayUrl(3)}
+	assert.NilError(t, store.Set(ctx, otherApp), "failed to set webhook")
+	walletRelays, err := store.GetWalletRelays(ctx, webhooks[0].WalletServicePubkey)
+	assert.NilError(t, err, "failed to get wallet relays")
+	assert.DeepEqual(t, slices.Sorted(slices.Values(walletRelays)), []string{relayUrl(24), relayUrl(3), prefix + "new.example.com"})
+	assert.NilError(t, store.Delete(ctx, otherApp.WalletServicePubkey, otherApp.AppPubkey), "failed to delete webhook")
+
+	// The relays are dropped once no webhook references them
+	for _, webhook := range webhooks {
+		assert.NilError(t, store.Delete(ctx, webhook.WalletServicePubkey, webhook.AppPubkey), "failed to delete webhook")
+	}
+	assert.NilError(t, store.DeleteExpired(ctx, time.Now().Add(-time.Hour)), "failed to delete expired")
+	assert.Equal(t, len(storedRelays()), 0)
+}
+
+// testInstanceLeases checks the instances are listed until their lease expires or is deleted.
+func testInstanceLeases(t *testing.T, store Store) {
+	ctx := context.Background()
+	prefix := randomHex(t)[:8]
+	alive, expiring := prefix+"-a", prefix+"-b"
+	instances := func() []string {
+		instances, err := store.GetInstances(ctx)
+		assert.NilError(t, err, "failed to get instances")
+		return slices.DeleteFunc(instances, func(instance string) bool {
+			return !strings.HasPrefix(instance, prefix)
+		})
+	}
+
+	assert.NilError(t, store.RenewInstanceLease(ctx, expiring, 100*time.Millisecond), "failed to renew lease")
+	assert.NilError(t, store.RenewInstanceLease(ctx, alive, time.Hour), "failed to renew lease")
+	assert.DeepEqual(t, instances(), []string{alive, expiring})
+
+	time.Sleep(200 * time.Millisecond)
+	assert.DeepEqual(t, instances(), []string{alive})
+
+	// A renewal extends the lease of an expired instance coming back
+	assert.NilError(t, store.RenewInstanceLease(ctx, expiring, time.Hour), "failed to renew lease")
+	assert.DeepEqual(t, instances(), []string{alive, expiring})
+
+	assert.NilError(t, store.DeleteInstanceLease(ctx, alive), "failed to delete lease")
+	assert.NilError(t, store.DeleteInstanceLease(ctx, expiring), "failed to delete lease")
+	assert.Equal(t, len(instances()), 0)
+}
+
+// testInfoEvent checks the stored info event of a wallet is only replaced by a newer one.
+func testInfoEvent(t *testing.T, store Store) {
+	ctx := context.Background()
+	walletServicePubkey := randomHex(t)
+	stored, err := store.GetInfoEvent(ctx, walletServicePubkey)
+	assert.NilError(t, err, "failed to get info event")
+	assert.Check(t, stored == nil, "missing info event should be nil")
+
+	infoEvent := InfoEvent{WalletServicePubkey: walletServicePubkey, Event: `{"content":"first"}`, CreatedAt: 1000}
+	assert.NilError(t, store.SetInfoEvent(ctx, infoEvent), "failed to set info event")
+	older := InfoEvent{WalletServicePubkey: walletServicePubkey, Event: `{"content":"older"}`, CreatedAt: 999}
+	assert.NilError(t, store.SetInfoEvent(ctx, older), "failed to set info event")
+	stored, err = store.GetInfoEvent(ctx, walletServicePubkey)
+	assert.NilError(t, err, "failed to get info event")
+	assert.DeepEqual(t, *stored, infoEvent)
+
+	newer := InfoEvent{WalletServicePubkey: walletServicePubkey, Event: `{"content":"newer"}`, CreatedAt: 1001}
+	assert.NilError(t, store.SetInfoEvent(ctx, newer), "failed to set info event")
+	stored, err = store.GetInfoEvent(ctx, walletServicePubkey)
+	assert.NilError(t, err, "failed to get info event")
+	assert.DeepEqual(t, *stored, newer)
+}
+
+// testPendingEvents checks paging on the (created_at, event_id) cursor returns every event once.
+func testPendingEvents(t *testing.T, store Store) {
+	ctx := context.Background()
+	walletServicePubkey, appPubkey := randomHex(t), randomHex(t)
+	now := time.Now().Unix()
+	addEvent := func(walletServicePubkey string, appPubkey string, createdAt int64, expiresAt time.Time) PendingEvent {
+		event := PendingEvent{
+			EventId:             randomHex(t),
+			WalletServicePubkey: walletServicePubkey,
+			AppPubkey:           appPubkey,
+			Event:               "{}",
+			CreatedAt:           createdAt,
+			ExpiresAt:           expiresAt,
+		}
+		assert.NilError(t, store.AddPendingEvent(ctx, event), "failed to add pending event")
+		return event
+	}
+
+	// More events share a second than fit in a page
+	var expected []string
+	for i := 0; i < 5; i++ {
+		expected = append(expected, addEvent(walletServicePubkey, appPubkey, now-10, time.Now().Add(time.Hour)).EventId)
+	}
+	slices.Sort(expected)
+	later := addEvent(walletServicePubkey, appPubkey, now-5, time.Now().Add(time.Hour))
+	expected = append(expected, later.EventId)
+	addEvent(walletServicePubkey, appPubkey, now-5, time.Now().Add(-time.Minute))
+	addEvent(randomHex(t), appPubkey, now-5, time.Now().Add(time.Hour))
+	// The events of the other apps of the wallet are not returned
+	addEvent(walletServicePubkey, randomHex(t), now-10, time.Now().Add(time.Hour))
+
+	var received []string
+	var since int64
+	var after string
+	for {
+		events, err := store.GetPendingEvents(ctx, walletServicePubkey, appPubkey, since, after, 2)
+		assert.NilError(t, err, "failed to get pending events")
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			received = append(received, event.EventId)
+		}
+		last := events[len(events)-1]
+		since, after = last.CreatedAt, last.EventId
+	}
+	assert.DeepEqual(t, received, expected)
+
+	// Without a cursor id, the events created since the given time are returned
+	events, err := store.GetPendingEvents(ctx, walletServicePubkey, appPubkey, now-5, "", 10)
+	assert.NilError(t, err, "failed to get pending events")
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].EventId, later.EventId)
+}
+
+// testNotifications checks the pending notifications are listed until published or failed.
+func testNotifications(t *testing.T, store Store) {
+	ctx := context.Background()
+	newNotification := func() Notification {
+		notification := Notification{
+			EventId:             randomHex(t),
+			WalletServicePubkey: randomHex(t),
+			AppPubkey:           randomHex(t),
+			Event:               "{}",
+			Relays:              []string{"wss://a.example.com", "wss://b.example.com"},
+			Status:              NotificationStatusPending,
+		}
+		added, err := store.AddNotification(ctx, notification)
+		assert.NilError(t, err, "failed to add notification")
+		assert.Check(t, added, "new notification should be added")
+		return notification
+	}
+	pendingIds := func() []string {
+		pending, err := store.GetPendingNotifications(ctx)
+		assert.NilError(t, err, "failed to get pending notifications")
+		var eventIds []string
+		for _, notification := range pending {
+			eventIds = append(eventIds, notification.EventId)
+		}
+		return eventIds
+	}
+
+	published, failed := newNotification(), newNotification()
+	added, err := store.AddNotification(ctx, published)
+	assert.NilError(t, err, "failed to add notification")
+	assert.Check(t, !added, "submitted notification should not be added again")
+
+	// The pending notifications are resumed after a restart
+	assert.Check(t, slices.Contains(pendingIds(), published.EventId), "pending notification should be listed")
+	assert.Check(t, slices.Contains(pendingIds(), failed.EventId), "pending notification should be listed")
+
+	lastError := "wss://b.example.com: connection refused"
+	published.PublishedRelays = []string{"wss://a.example.com"}
+	published.Status = NotificationStatusPublished
+	published.Attempts = 1
+	published.LastError = &lastError
+	assert.NilError(t, store.UpdateNotification(ctx, published), "failed to update notification")
+	stored, err := store.GetNotification(ctx, published.EventId)
+	assert.NilError(t, err, "failed to get notification")
+	assert.Equal(t, stored.Status, NotificationStatusPublished)
+	assert.DeepEqual(t, stored.PublishedRelays, published.PublishedRelays)
+	assert.Equal(t, stored.Attempts, 1)
+	assert.Equal(t, *stored.LastError, lastError)
+
+	failed.Status = NotificationStatusFailed
+	failed.Attempts = 5
+	failed.LastError = &lastError
+	assert.NilError(t, store.UpdateNotification(ctx, failed), "failed to update notification")
+	stored, err = store.GetNotification(ctx, failed.EventId)
+	assert.NilError(t, err, "failed to get notification")
+	assert.Equal(t, stored.Status, NotificationStatusFailed)
+	assert.Equal(t, len(stored.PublishedRelays), 0)
+
+	assert.Check(t, !slices.Contains(pendingIds(), published.EventId), "published notification should not be resumed")
+	assert.Check(t, !slices.Contains(pendingIds(), failed.EventId), "failed notification should not be resumed")
+
+	stored, err = store.GetNotification(ctx, randomHex(t))
+	assert.NilError(t, err, "failed to get notification")
+	assert.Check(t, stored == nil, "missing notification should be nil")
+}
+
+func TestMemoryStoreClaimEvent(t *testing.T) {
+	testClaimEvent(t, NewMemoryStore())
+}
+
+func TestMemoryStoreManyRelays(t *testing.T) {
+	testManyRelays(t, NewMemoryStore())
+}
+
+func TestMemoryStoreInstanceLeases(t *testing.T) {
+	testInstanceLeases(t, NewMemoryStore())
+}
+
+func TestMemoryStoreInfoEvent(t *testing.T) {
+	testInfoEvent(t, NewMemoryStore())
+}
+
+func TestMemoryStorePendingEvents(t *testing.T) {
+	testPendingEvents(t, NewMemoryStore())
+}
+
+func TestMemoryStoreNotifications(t *testing.T) {
+	testNotifications(t, NewMemoryStore())
+}
@@ -0,0 +1,40 @@
+package persist
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+type CleanupService struct {
+	store Store
+}
+
+// The interval to clean the idle buckets.
+var CleanupInterval time.Duration = 10 * time.Minute
+
+// The duration after which an unused bucket is removed, refilled by then for the configured limits.
+var IdleDuration time.Duration = time.Hour
+
+func NewCleanupService(store Store) *CleanupService {
+	return &CleanupService{
+		store: store,
+	}
+}
+
+// Periodically cleans up the idle buckets.
+func (c *CleanupService) Start(ctx context.Context) {
+	for {
+		before := time.Now().Add(-IdleDuration)
+		err := c.store.DeleteIdle(ctx, before)
+		if err != nil {
+			log.Printf("Failed to remove rate limit buckets idle since %v: %v", before, err)
+		}
+		select {
+		case <-time.After(CleanupInterval):
+			continue
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package persist
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PgStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgStore(pool *pgxpool.Pool) *PgStore {
+	return &PgStore{
+		pool,
+	}
+}
+
+/*
+Take refills and takes a token from the bucket in a single upsert, so the
+instances sharing the database share the buckets. The tokens are only
+taken when available, a client retrying while limited is not penalised
+further.
+*/
+func (s *PgStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	var allowed bool
+	var tokens float64
+	err := s.pool.QueryRow(
+		ctx,
+		`INSERT INTO public.rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+		 VALUES ($1, $2::double precision - 1, $2 >= 1, $4)
+		 ON CONFLICT (key) DO UPDATE SET
+		   allowed = LEAST($2, b.tokens + GREATEST(0, EXTRACT(EPOCH FROM $4 - b.updated_at)::double precision) * $3) >= 1,
+		   tokens = LEAST($2, b.tokens + GREATEST(0, EXTRACT(EPOCH FROM $4 - b.updated_at)::double precision) * $3)
+		     - CASE WHEN LEAST($2, b.tokens + GREATEST(0, EXTRACT(EPOCH FROM $4 - b.updated_at)::double precision) * $3) >= 1 THEN 1 ELSE 0 END,
+		   updated_at = GREATEST(b.updated_at, $4)
+		 RETURNING allowed, tokens`,
+		key,
+		float64(limit.Burst),
+		limit.Rate,
+		now.UTC(),
+	).Scan(&allowed, &tokens)
+	if err != nil {
+		return Result{}, err
+	}
+	if !allowed {
+		return Result{Allowed: false, RetryAfter: retryAfter(tokens, limit)}, nil
+	}
+	return Result{Allowed: true}, nil
+}
+
+func (s *PgStore) DeleteIdle(ctx context.Context, before time.Time) error {
+	_, err := s.pool.Exec(
+		ctx,
+		`DELETE FROM public.rate_limit_buckets
+		 WHERE updated_at < $1`,
+		before.UTC(),
+	)
+	return err
+}
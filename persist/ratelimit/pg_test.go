@@ -0,0 +1,17 @@
+package persist
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"gotest.tools/assert"
+)
+
+func TestPgStoreTake(t *testing.T) {
+	pool, err := pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
+	assert.NilError(t, err, "failed to connect to database")
+	defer pool.Close()
+	testTake(t, NewPgStore(pool))
+}
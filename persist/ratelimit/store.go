@@ -0,0 +1,42 @@
+package persist
+
+import (
+	"context"
+	"time"
+)
+
+// Limit is a token bucket: refilled at Rate tokens per second, holding at most Burst tokens.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	Allowed bool
+	// The time until a token is available, when not allowed.
+	RetryAfter time.Duration
+}
+
+type Store interface {
+	// Take takes a token from the bucket of the key at the given time, creating a full bucket if none.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+	// DeleteIdle removes the buckets not used since the given time, refilled by now.
+	DeleteIdle(ctx context.Context, before time.Time) error
+}
+
+// refill returns the tokens of a bucket after the elapsed time, capped at the burst.
+func refill(tokens float64, elapsed time.Duration, limit Limit) float64 {
+	if elapsed > 0 {
+		tokens += elapsed.Seconds() * limit.Rate
+	}
+	return min(tokens, float64(limit.Burst))
+}
+
+// retryAfter returns the time until the bucket holds a token.
+func retryAfter(tokens float64, limit Limit) time.Duration {
+	if limit.Rate <= 0 {
+		return time.Duration(0)
+	}
+	return time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+}
@@ -0,0 +1,58 @@
+package persist
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// testTake checks the burst is allowed, then one token per refill interval.
+func testTake(t *testing.T, store Store) {
+	ctx := context.Background()
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	key := "test:" + hex.EncodeToString(suffix)
+	limit := Limit{Rate: 1, Burst: 3}
+	now := time.Now().Truncate(time.Second)
+
+	for i := 0; i < 3; i++ {
+		result, err := store.Take(ctx, key, limit, now)
+		assert.NilError(t, err)
+		assert.Check(t, result.Allowed, "request %d within the burst should be allowed", i)
+	}
+	result, err := store.Take(ctx, key, limit, now)
+	assert.NilError(t, err)
+	assert.Check(t, !result.Allowed, "request over the burst should be limited")
+	assert.Equal(t, result.RetryAfter, time.Second)
+
+	// Retrying while limited doesn't delay the refill
+	result, err = store.Take(ctx, key, limit, now.Add(500*time.Millisecond))
+	assert.NilError(t, err)
+	assert.Check(t, !result.Allowed, "request before the refill should be limited")
+	result, err = store.Take(ctx, key, limit, now.Add(time.Second))
+	assert.NilError(t, err)
+	assert.Check(t, result.Allowed, "request after the refill should be allowed")
+
+	// The bucket is refilled up to the burst only
+	for i := 0; i < 3; i++ {
+		result, err = store.Take(ctx, key, limit, now.Add(time.Hour))
+		assert.NilError(t, err)
+		assert.Check(t, result.Allowed, "request %d within the burst should be allowed", i)
+	}
+	result, err = store.Take(ctx, key, limit, now.Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Check(t, !result.Allowed, "request over the burst should be limited")
+
+	assert.NilError(t, store.DeleteIdle(ctx, now.Add(2*time.Hour)))
+	result, err = store.Take(ctx, key, limit, now.Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Check(t, result.Allowed, "deleted bucket should be full")
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	testTake(t, NewMemoryStore())
+}
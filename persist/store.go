@@ -5,19 +5,25 @@ import (
 	"fmt"
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	dns "github.com/breez/breez-lnurl/persist/dns"
 	lnurl "github.com/breez/breez-lnurl/persist/lnurl"
 	nwc "github.com/breez/breez-lnurl/persist/nwc"
+	ratelimit "github.com/breez/breez-lnurl/persist/ratelimit"
 )
 
 type Store struct {
-	LnUrl lnurl.Store
-	Nwc   nwc.Store
+	LnUrl     lnurl.Store
+	Nwc       nwc.Store
+	Dns       dns.Store
+	RateLimit ratelimit.Store
 }
 
 func NewMemoryStore() *Store {
 	return &Store{
-		LnUrl: lnurl.NewMemoryStore(),
-		Nwc:   nwc.NewMemoryStore(),
+		LnUrl:     lnurl.NewMemoryStore(),
+		Nwc:       nwc.NewMemoryStore(),
+		Dns:       dns.NewMemoryStore(),
+		RateLimit: ratelimit.NewMemoryStore(),
 	}
 }
 
@@ -27,8 +33,10 @@ func NewPgStore(databaseUrl string) (*Store, error) {
 		return nil, fmt.Errorf("pgConnect() error: %v", err)
 	}
 	return &Store{
-		LnUrl: lnurl.NewPgStore(pool),
-		Nwc:   nwc.NewPgStore(pool),
+		LnUrl:     lnurl.NewPgStore(pool),
+		Nwc:       nwc.NewPgStore(pool),
+		Dns:       dns.NewPgStore(pool),
+		RateLimit: ratelimit.NewPgStore(pool),
 	}, nil
 }
 
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"expvar"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -25,14 +27,14 @@ type Server struct {
 	rootHandler *mux.Router
 }
 
-func NewServer(internalURL *url.URL, externalURL *url.URL, storage *persist.Store, dns dns.DnsService, cache cache.CacheService) *Server {
+func NewServer(internalURL *url.URL, externalURL *url.URL, storage *persist.Store, dns dns.DnsService, verifier *dns.Verifier, relayAuth *nwc.RelayAuth, relayPolicy *nwc.RelayPolicy, webhookClient *channel.WebhookClient, rateLimiter *lnurl.RateLimiter, cache cache.CacheService, adminToken string) *Server {
 	server := &Server{
 		internalURL: internalURL,
 		externalURL: externalURL,
 		storage:     storage,
 		dns:         dns,
 		cache:       cache,
-		rootHandler: initRootHandler(externalURL, storage, dns, cache),
+		rootHandler: initRootHandler(externalURL, storage, dns, verifier, relayAuth, relayPolicy, webhookClient, rateLimiter, cache, adminToken),
 	}
 
 	return server
@@ -42,9 +44,13 @@ func (s *Server) Serve() error {
 	return http.ListenAndServe(s.internalURL.Host, s.rootHandler)
 }
 
-func initRootHandler(externalURL *url.URL, storage *persist.Store, dns dns.DnsService, cache cache.CacheService) *mux.Router {
+func initRootHandler(externalURL *url.URL, storage *persist.Store, dnsService dns.DnsService, verifier *dns.Verifier, relayAuth *nwc.RelayAuth, relayPolicy *nwc.RelayPolicy, webhookClient *channel.WebhookClient, rateLimiter *lnurl.RateLimiter, cache cache.CacheService, adminToken string) *mux.Router {
 	rootRouter := mux.NewRouter()
 
+	// Routes only available to the operators, authenticated with the admin token.
+	adminRouter := rootRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(adminAuthMiddleware(adminToken))
+
 	// start the cleanup service
 	cleanup := persist.NewCleanupService(storage)
 	cleanup.Start(context.Background())
@@ -52,16 +58,47 @@ func initRootHandler(externalURL *url.URL, storage *persist.Store, dns dns.DnsSe
 	// The channel that handles the request/response cycle from the node.
 	// This specific channel handles that by invoking the registered webhook to reach the node
 	// providing a callback URL to the node.
-	webhookChannel := channel.NewHttpCallbackChannel(rootRouter, fmt.Sprintf("%v/response", externalURL.String()))
+	httpChannel := channel.NewHttpCallbackChannel(rootRouter, fmt.Sprintf("%v/response", externalURL.String()), webhookClient)
+
+	// The apps in the foreground answer the requests on their socket, the others through the webhook.
+	socketChannel := channel.NewWebSocketChannel(rootRouter, httpChannel)
+
+	// The apps that cannot receive webhooks fetch their requests instead.
+	webhookChannel := channel.NewPollingChannel(rootRouter, httpChannel, socketChannel)
+
+	// The queue that publishes the BIP353 DNS changes in the background.
+	dnsQueue := dns.NewQueue(dnsService, verifier, storage)
+	go dnsQueue.Start(context.Background())
 
 	// Routes to handle lnurl pay protocol.
-	lnurl.RegisterLnurlPayRouter(rootRouter, externalURL, storage, dns, cache, webhookChannel)
+	lnurl.RegisterLnurlPayRouter(rootRouter, externalURL, storage, dnsQueue, cache, webhookChannel, rateLimiter)
 
 	// Routes to handle BOLT12 Offers.
-	bolt12.RegisterBolt12OfferRouter(rootRouter, externalURL, storage, dns)
+	bolt12.RegisterBolt12OfferRouter(rootRouter, externalURL, storage, dnsQueue)
 
 	// Routes to handle Nostr event subscriptions
-	nwc.RegisterNostrEventsRouter(rootRouter, externalURL, storage, cleanup.Nwc)
+	nwc.RegisterNostrEventsRouter(rootRouter, adminRouter, externalURL, storage, cleanup.Nwc, relayAuth, relayPolicy, webhookClient)
+
+	// Metrics exposed by the services.
+	adminRouter.Handle("/debug/vars", expvar.Handler()).Methods("GET")
 
 	return rootRouter
 }
+
+/*
+adminAuthMiddleware only lets through the requests with the admin token as
+bearer token. All requests are rejected if no admin token is configured.
+*/
+func adminAuthMiddleware(adminToken string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			expected := []byte("Bearer " + adminToken)
+			actual := []byte(r.Header.Get("Authorization"))
+			if adminToken == "" || subtle.ConstantTimeCompare(expected, actual) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 	"time"
@@ -29,8 +30,8 @@ import (
 
 type MockDns struct{}
 
-func (m *MockDns) Set(username, offer string) (uint32, error) {
-	log.Printf("Mock DNS implementation, setting username: %s, offer: %s", username, offer)
+func (m *MockDns) Set(username string, instructions dns.PaymentInstructions) (uint32, error) {
+	log.Printf("Mock DNS implementation, setting username: %s, offer: %s", username, instructions.Offer)
 	return 3600, nil
 }
 
@@ -39,6 +40,10 @@ func (m *MockDns) Remove(username string) error {
 	return nil
 }
 
+func (m *MockDns) List() (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
 const (
 	testFeature  = "testFeature"
 	testEndpoint = "testEndpoint"
@@ -55,7 +60,7 @@ func setupServer(storage *persist.Store, dns dns.DnsService, cache cache.CacheSe
 	if err != nil {
 		return "", fmt.Errorf("failed to parse server URL %v", err)
 	}
-	server := NewServer(serverURL, serverURL, storage, dns, cache)
+	server := NewServer(serverURL, serverURL, storage, dns, nil, nil, nil, nil, nil, cache, "")
 	go func() {
 		persist.NewCleanupService(storage).Start(context.Background())
 	}()
@@ -378,3 +383,24 @@ func getRandomPort() (int, error) {
 	listener.Close()
 	return port, nil
 }
+
+func TestDebugVarsRequiresAdminToken(t *testing.T) {
+	serverURL, _ := url.Parse("http://localhost")
+	handler := initRootHandler(serverURL, persist.NewMemoryStore(), &MockDns{}, nil, nil, nil, nil, nil, cache.NewCache(time.Minute), "secret")
+
+	for _, path := range []string{"/debug/vars", "/admin/debug/vars"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code == http.StatusOK {
+			t.Errorf("expected %v to require the admin token, got %v", path, recorder.Code)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/admin/debug/vars", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status code 200, got %v", recorder.Code)
+	}
+}